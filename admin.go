@@ -0,0 +1,181 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	adminAuth      = flag.String("admin_auth", "", "Basic Auth <username>:<password>, or @<filename> holding it, for the admin endpoints. Empty disables them.")
+	connectionsURL = flag.String("connections_url", "/connections", "Admin path listing active tunnels as JSON. DELETE <path>/<id> terminates one, by its connection id.")
+
+	// Username and password from -admin_auth.
+	adminUser, adminPassword string
+
+	// Open tunnels by connection id.
+	registryMu sync.Mutex
+	registry   = map[string]*liveTunnel{}
+)
+
+// liveTunnel is an open tunnel, as listed by the admin endpoint.
+type liveTunnel struct {
+	id       string
+	remote   string
+	identity string
+	dest     string
+	start    time.Time
+	stats    tunnelStats
+
+	// Where the client came from, and the vhost and -port_policy it
+	// falls under, to check the tunnel against a reloaded policy.
+	src net.IP
+	vh  *vhost
+	pp  *portPolicy
+
+	once sync.Once
+}
+
+// registerTunnel adds a tunnel to the registry until the returned func is
+// called.
+func registerTunnel(id, remote, identity, dest string, src net.IP, vh *vhost, pp *portPolicy) (*liveTunnel, func()) {
+	t := &liveTunnel{
+		id:       id,
+		remote:   remote,
+		identity: identity,
+		dest:     dest,
+		src:      src,
+		vh:       vh,
+		pp:       pp,
+		start:    time.Now(),
+		stats:    tunnelStats{terminate: make(chan struct{})},
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[t.id] = t
+	return t, func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(registry, t.id)
+	}
+}
+
+// terminate asks the tunnel's bridge to close it, for reason.
+func (t *liveTunnel) terminate(reason string) {
+	t.once.Do(func() {
+		t.stats.terminateReason = reason
+		close(t.stats.terminate)
+	})
+}
+
+// setupAdmin parses -admin_auth and adds the admin endpoints to m.
+func setupAdmin(m *mux.Router) error {
+	if *adminAuth == "" {
+		return nil
+	}
+	s := *adminAuth
+	if strings.HasPrefix(s, "@") {
+		b, err := ioutil.ReadFile(s[1:])
+		if err != nil {
+			return err
+		}
+		s = strings.TrimSpace(string(b))
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("-admin_auth must be <username>:<password>")
+	}
+	adminUser, adminPassword = parts[0], parts[1]
+
+	p := "/" + strings.Trim(*connectionsURL, "/")
+	m.HandleFunc(p, requireAdmin(listConnections)).Methods("GET")
+	m.HandleFunc(p+"/{id}", requireAdmin(terminateConnection)).Methods("DELETE")
+	return nil
+}
+
+// requireAdmin wraps h to answer 401 unless the request carries the
+// -admin_auth credentials.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, p, _ := r.BasicAuth()
+		okUser := subtle.ConstantTimeCompare([]byte(u), []byte(adminUser))
+		okPassword := subtle.ConstantTimeCompare([]byte(p), []byte(adminPassword))
+		if okUser&okPassword != 1 {
+			metricRejected.Add("admin_auth", 1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="huproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// connectionInfo is a tunnel in the /connections listing.
+type connectionInfo struct {
+	ID       string  `json:"id"`
+	Remote   string  `json:"remote"`
+	Identity string  `json:"identity,omitempty"`
+	Dest     string  `json:"dest"`
+	Started  string  `json:"started"`
+	AgeSec   float64 `json:"age_seconds"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+}
+
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	registryMu.Lock()
+	list := make([]connectionInfo, 0, len(registry))
+	for _, t := range registry {
+		list = append(list, connectionInfo{
+			ID:       t.id,
+			Remote:   t.remote,
+			Identity: t.identity,
+			Dest:     t.dest,
+			Started:  t.start.UTC().Format(time.RFC3339),
+			AgeSec:   time.Since(t.start).Seconds(),
+			BytesIn:  atomic.LoadInt64(&t.stats.in),
+			BytesOut: atomic.LoadInt64(&t.stats.out),
+		})
+	}
+	registryMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].AgeSec > list[j].AgeSec })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func terminateConnection(w http.ResponseWriter, r *http.Request) {
+	registryMu.Lock()
+	t := registry[mux.Vars(r)["id"]]
+	registryMu.Unlock()
+	if t == nil {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+	t.terminate("terminated by admin")
+	http.Error(w, "terminated", http.StatusAccepted)
+}
@@ -0,0 +1,184 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+func TestSetupAdmin(t *testing.T) {
+	defer func(a, u, p string) { *adminAuth, adminUser, adminPassword = a, u, p }(*adminAuth, adminUser, adminPassword)
+	file := writeTemp(t, "admin", "root:from file\n")
+	for _, test := range []struct {
+		auth       string
+		wantErr    bool
+		wantRoutes bool
+		user, pass string
+	}{
+		{"", false, false, "", ""},
+		{"root:secret", false, true, "root", "secret"},
+		{"root:with:colons", false, true, "root", "with:colons"},
+		{"@" + file, false, true, "root", "from file"},
+		{"@" + file + ".missing", true, false, "", ""},
+		{"root", true, false, "", ""},
+		{"root:", true, false, "", ""},
+		{":secret", true, false, "", ""},
+	} {
+		*adminAuth, adminUser, adminPassword = test.auth, "", ""
+		m := mux.NewRouter()
+		if err := setupAdmin(m); (err != nil) != test.wantErr {
+			t.Errorf("-admin_auth=%q: %v, want error %v", test.auth, err, test.wantErr)
+		}
+		var match mux.RouteMatch
+		if got := m.Match(httptest.NewRequest("GET", "/connections", nil), &match); got != test.wantRoutes {
+			t.Errorf("-admin_auth=%q: routes %v, want %v", test.auth, got, test.wantRoutes)
+		}
+		if adminUser != test.user || adminPassword != test.pass {
+			t.Errorf("-admin_auth=%q: credentials %q:%q, want %q:%q", test.auth, adminUser, adminPassword, test.user, test.pass)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	defer func(u, p string) { adminUser, adminPassword = u, p }(adminUser, adminPassword)
+	adminUser, adminPassword = "root", "secret"
+	h := requireAdmin(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"root", "", http.StatusUnauthorized},
+		{"root", "guess", http.StatusUnauthorized},
+		{"admin", "secret", http.StatusUnauthorized},
+		{"root", "secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/connections", nil)
+		if test.user != "" || test.pass != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != test.want {
+			t.Errorf("%q:%q: status %d, want %d", test.user, test.pass, w.Code, test.want)
+		}
+		if challenged := w.Header().Get("WWW-Authenticate") != ""; challenged != (test.want == http.StatusUnauthorized) {
+			t.Errorf("%q:%q: WWW-Authenticate %q", test.user, test.pass, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// TestConnections lists a tunnel open through handleProxy and terminates
+// it.
+func TestConnections(t *testing.T) {
+	defer func(a, u, p string) { *adminAuth, adminUser, adminPassword = a, u, p }(*adminAuth, adminUser, adminPassword)
+	*adminAuth = "root:secret"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	m := mux.NewRouter()
+	if err := setupAdmin(m); err != nil {
+		t.Fatal(err)
+	}
+	m.HandleFunc("/proxy/{host}/{port}", handleProxy)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	admin := func(method, path string) (*http.Response, []connectionInfo) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("root", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list []connectionInfo
+		if method == "GET" {
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, list
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/proxy/"+host+"/"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id := resp.Header.Get(huproxy.ConnectionIDHeader)
+
+	_, list := admin("GET", "/connections")
+	if len(list) != 1 || list[0].ID != id || list[0].Dest != l.Addr().String() {
+		t.Fatalf("listed %+v, want tunnel %q to %v", list, id, l.Addr())
+	}
+
+	for _, test := range []struct {
+		id   string
+		want int
+	}{
+		{"nonexistent", http.StatusNotFound},
+		{id, http.StatusAccepted},
+	} {
+		if resp, _ := admin("DELETE", "/connections/"+test.id); resp.StatusCode != test.want {
+			t.Errorf("DELETE %q: status %d, want %d", test.id, resp.StatusCode, test.want)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Text != "terminated by admin" {
+		t.Errorf("client read %v, want a going away close saying it was terminated by admin", err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, list = admin("GET", "/connections"); len(list) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("still listed after termination: %+v", list)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	resolveTimeout  = flag.Duration("resolve_timeout", 5*time.Second, "Timeout for resolving backend names, before -dial_timeout applies to connecting.")
+	tcpKeepAlive    = flag.Bool("tcp_keepalive", true, "Enable TCP keepalive on backend connections.")
+	tcpKeepAliveInt = flag.Duration("tcp_keepalive_interval", 15*time.Second, "Interval between TCP keepalive probes on backend connections.")
+	tcpNoDelay      = flag.Bool("tcp_nodelay", true, "Disable Nagle's algorithm on backend connections, sending small writes right away. Turning it off trades latency for fewer packets.")
+	dialTLS         = flag.Bool("dial_tls", false, "Connect to backends over TLS, giving clients a plaintext stream.")
+	dialTLSCA       = flag.String("dial_tls_cacert", "", "PEM file with CA certificates for verifying -dial_tls backends. Defaults to the system roots.")
+	dialTLSSNI      = flag.String("dial_tls_sni", "", "Server name sent to and verified for -dial_tls backends. Defaults to the requested host.")
+	dialTLSInsecure = flag.Bool("dial_tls_insecure", false, "Don't verify -dial_tls backend certificates.")
+
+	// TLS config for backends, nil unless -dial_tls.
+	backendTLS *tls.Config
+)
+
+// setupBackendTLS builds backendTLS from flags.
+func setupBackendTLS() error {
+	if !*dialTLS {
+		return nil
+	}
+	backendTLS = &tls.Config{
+		ServerName:         *dialTLSSNI,
+		InsecureSkipVerify: *dialTLSInsecure,
+	}
+	if *dialTLSCA != "" {
+		b, err := ioutil.ReadFile(*dialTLSCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %q", *dialTLSCA)
+		}
+		backendTLS.RootCAs = pool
+	}
+	return nil
+}
+
+// backendError is a failure to reach a backend, with the HTTP status and
+// message to give the client.
+type backendError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+// resolveBackend looks up the addresses of host within -resolve_timeout,
+// or in the -resolve_cache_ttl cache.
+func resolveBackend(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	key := strings.ToLower(host)
+	if *resolveCacheTTL > 0 {
+		if addrs, ok := resolveCache.get(key); ok {
+			return addrs, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &backendError{http.StatusGatewayTimeout, "backend name resolution timed out", err}
+		}
+		return nil, &backendError{http.StatusBadGateway, "backend name resolution failed", err}
+	}
+	if *resolveCacheTTL > 0 {
+		resolveCache.put(key, addrs)
+	}
+	return addrs, nil
+}
+
+// dialBackend connects to the destination of a tunnel, the way its
+// -route says, if any. Resolving the name and connecting have separate
+// timeouts, connecting taking up to timeout.
+func dialBackend(rt *backendRoute, host, port string, timeout time.Duration) (net.Conn, error) {
+	cfg := backendTLS
+	if rt != nil {
+		if rt.socket != "" {
+			return dialSocket(rt.socket, timeout)
+		}
+		cfg = rt.tls
+	}
+	addrs, err := resolveBackend(host)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	var s net.Conn
+	for i, a := range addrs {
+		// Keepalive is set below instead.
+		d := &net.Dialer{Deadline: partialDeadline(time.Now(), deadline, len(addrs)-i), KeepAlive: -1}
+		if s, err = d.Dial("tcp", net.JoinHostPort(a, port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &backendError{http.StatusGatewayTimeout, "backend connect timed out", err}
+		}
+		return nil, &backendError{http.StatusBadGateway, "backend unreachable", err}
+	}
+	if tc, ok := s.(*net.TCPConn); ok {
+		tc.SetNoDelay(*tcpNoDelay)
+		tc.SetKeepAlive(*tcpKeepAlive)
+		if *tcpKeepAlive {
+			tc.SetKeepAlivePeriod(*tcpKeepAliveInt)
+		}
+	}
+	if cfg == nil {
+		return s, nil
+	}
+
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	tc := tls.Client(s, cfg)
+	tc.SetDeadline(deadline)
+	if err := tc.Handshake(); err != nil {
+		s.Close()
+		return nil, &backendError{http.StatusBadGateway, "backend TLS handshake failed", err}
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// Least time given to each backend address, unless the timeout is
+// shorter, as in the net package.
+const minAddrTimeout = 2 * time.Second
+
+// partialDeadline returns the deadline for connecting to the next of left
+// addresses at now, sharing what's left until deadline between them, so
+// that one that drops packets can't starve the others.
+func partialDeadline(now, deadline time.Time, left int) time.Time {
+	remaining := deadline.Sub(now)
+	if left <= 1 || remaining <= 0 {
+		return deadline
+	}
+	share := remaining / time.Duration(left)
+	if share < minAddrTimeout {
+		share = minAddrTimeout
+	}
+	if share >= remaining {
+		return deadline
+	}
+	return now.Add(share)
+}
+
+// dialSocket connects to the Unix socket of a -route.
+func dialSocket(socket string, timeout time.Duration) (net.Conn, error) {
+	s, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &backendError{http.StatusGatewayTimeout, "backend connect timed out", err}
+		}
+		return nil, &backendError{http.StatusBadGateway, "backend unreachable", err}
+	}
+	return s, nil
+}
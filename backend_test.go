@@ -0,0 +1,68 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, test := range []struct {
+		remaining time.Duration
+		left      int
+		want      time.Duration
+	}{
+		{10 * time.Second, 1, 10 * time.Second},
+		{10 * time.Second, 2, 5 * time.Second},
+		{9 * time.Second, 3, 3 * time.Second},
+		{10 * time.Second, 10, minAddrTimeout},
+		{3 * time.Second, 2, minAddrTimeout},
+		{time.Second, 4, time.Second},
+		{0, 3, 0},
+		{-time.Second, 3, -time.Second},
+	} {
+		got := partialDeadline(now, now.Add(test.remaining), test.left).Sub(now)
+		if got != test.want {
+			t.Errorf("partialDeadline(%v left, %d addresses) = %v, want %v", test.remaining, test.left, got, test.want)
+		}
+	}
+}
+
+func TestDialBackendSharesTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	defer func(ttl time.Duration) { *resolveCacheTTL = ttl }(*resolveCacheTTL)
+	*resolveCacheTTL = time.Minute
+	// 192.0.2.1 is reserved for documentation, so dialing it either fails
+	// at once or, where it's dropped, times out.
+	resolveCache.put("multi.test", []string{"192.0.2.1", "127.0.0.1"})
+
+	start := time.Now()
+	s, err := dialBackend(nil, "multi.test", port, 6*time.Second)
+	if err != nil {
+		t.Fatalf("dialBackend: %v", err)
+	}
+	s.Close()
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("dialBackend took %v, the first address used up the timeout", d)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.uber.org/goleak"
+)
+
+// answerAtEOF listens for one backend connection, which gets back what
+// was sent to it once it ended.
+func answerAtEOF(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		c.Write(b)
+	}()
+	return l
+}
+
+// bridgeServer serves one tunnel to the backend at addr through bridge,
+// giving its stats to stats once it's over.
+func bridgeServer(t *testing.T, addr string, stats chan<- *tunnelStats) *httptest.Server {
+	t.Helper()
+	var up websocket.Upgrader
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		st := &tunnelStats{}
+		bridge(ctx, cancel, conn, s, st)
+		stats <- st
+	}))
+}
+
+func TestBridgeHalfClose(t *testing.T) {
+	defer func(old time.Duration) { *halfCloseTimeout = old }(*halfCloseTimeout)
+	for _, test := range []struct {
+		desc    string
+		timeout time.Duration
+		want    string
+	}{
+		{"half close", 2 * time.Second, "hello world\n"},
+		{"full close", 0, ""},
+	} {
+		*halfCloseTimeout = test.timeout
+		l := answerAtEOF(t)
+		stats := make(chan *tunnelStats, 1)
+		srv := bridgeServer(t, l.Addr().String(), stats)
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello world\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var got []byte
+		for {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Errorf("%s: reading tunnel: %v, want a normal close", test.desc, err)
+				}
+				break
+			}
+			b, _ := ioutil.ReadAll(r)
+			got = append(got, b...)
+		}
+		conn.Close()
+		if string(got) != test.want {
+			t.Errorf("%s: got %q back, want %q", test.desc, got, test.want)
+		}
+		st := <-stats
+		if st.reason != "client closed" || st.in != 12 || st.out != int64(len(test.want)) {
+			t.Errorf("%s: tunnel ended with %q, %d bytes in and %d out, want %q, 12 and %d", test.desc, st.reason, st.in, st.out, "client closed", len(test.want))
+		}
+		srv.Close()
+		l.Close()
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	p, _ := net.Pipe()
+	for _, test := range []struct {
+		desc string
+		c    net.Conn
+		want bool
+	}{
+		{"tcp", dial(), true},
+		{"sampled", &sampledConn{Conn: dial()}, true},
+		{"throttled", &throttledConn{Conn: &sampledConn{Conn: dial()}}, true},
+		{"pipe", p, false},
+		{"throttled pipe", &throttledConn{Conn: p}, false},
+	} {
+		if got := closeWrite(test.c); got != test.want {
+			t.Errorf("closeWrite(%s) = %v, want %v", test.desc, got, test.want)
+		}
+		test.c.Close()
+	}
+}
+
+// TestTunnelTeardown opens and ends tunnels through handleProxy in quick
+// succession, each way a tunnel can end, and checks nothing is left running
+// once they're all over.
+func TestTunnelTeardown(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The backend at l echoes, except it hangs, reading nothing, after
+	// "hang" until the test is over, and closes after "quit".
+	stop := make(chan struct{})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(c, b); err != nil {
+						return
+					}
+					switch string(b) {
+					case "hang":
+						<-stop
+						return
+					case "quit":
+						return
+					}
+					c.Write(b)
+				}
+			}()
+		}
+	}()
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{host}/{port}", handleProxy)
+	srv := httptest.NewServer(m)
+	base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/proxy/"
+
+	for _, test := range []struct {
+		desc    string
+		backend string
+		send    string
+		end     func(*websocket.Conn)
+	}{
+		{"client closes", l.Addr().String(), "ping", func(c *websocket.Conn) {
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			c.ReadMessage()
+		}},
+		{"client drops", l.Addr().String(), "ping", func(*websocket.Conn) {}},
+		{"client drops on hung backend", l.Addr().String(), "hang", func(*websocket.Conn) {}},
+		{"backend closes", l.Addr().String(), "quit", func(c *websocket.Conn) {
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}},
+		{"backend refuses", refused.Addr().String(), "", nil},
+	} {
+		host, port, _ := net.SplitHostPort(test.backend)
+		for i := 0; i < 20; i++ {
+			c, _, err := websocket.DefaultDialer.Dial(base+host+"/"+port, nil)
+			if test.end == nil {
+				if err == nil {
+					t.Errorf("%s: tunnel opened", test.desc)
+					c.Close()
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.desc, err)
+			}
+			if test.send != "" {
+				if err := c.WriteMessage(websocket.BinaryMessage, []byte(test.send)); err != nil {
+					t.Fatalf("%s: %v", test.desc, err)
+				}
+			}
+			test.end(c)
+			c.Close()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		activeTunnels.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnels still running")
+	}
+	srv.Close()
+	l.Close()
+	close(stop)
+}
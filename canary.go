@@ -0,0 +1,108 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a canary tunnel stays open without a message from the client.
+const canaryIdleTimeout = 30 * time.Second
+
+var (
+	canaryURL  = flag.String("canary_url", "", "Path of a synthetic tunnel endpoint for monitoring the websocket plumbing without a backend, e.g. /canary. Empty disables.")
+	canaryMode = flag.String("canary_mode", "echo", "What -canary_url does: 'echo' upgrades and sends each message back, 'fail' answers 502 like an unreachable backend.")
+
+	metricCanary = expvar.NewMap("canary_requests")
+)
+
+// setupCanary adds -canary_url to m, behind wrap as the tunnel routes.
+func setupCanary(m *mux.Router, wrap func(http.HandlerFunc) http.HandlerFunc) error {
+	if *canaryURL == "" {
+		return nil
+	}
+	if *canaryMode != "echo" && *canaryMode != "fail" {
+		return fmt.Errorf("-canary_mode must be 'echo' or 'fail', got %q", *canaryMode)
+	}
+	p := "/" + strings.TrimPrefix(*canaryURL, "/")
+	if *pathSecret != "" {
+		p = "/{secret}" + p
+	}
+	m.HandleFunc(p, wrap(handleCanary))
+	return nil
+}
+
+// handleCanary answers a tunnel request to -canary_url as -canary_mode
+// says, going through the upgrade and the checks before it, but not any
+// backend.
+func handleCanary(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		metricCanary.Add("not_websocket", 1)
+		http.Error(w, "this is a websocket endpoint; expected \"Connection: Upgrade\" and \"Upgrade: websocket\" headers", http.StatusBadRequest)
+		return
+	}
+	if underMaintenance() {
+		metricCanary.Add("maintenance", 1)
+		refuseMaintenance(w)
+		return
+	}
+	if !allowUpgrade() {
+		metricCanary.Add("upgrade_rate", 1)
+		w.Header().Set("Retry-After", "1")
+		refuse(w, "too many new tunnels, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if *canaryMode == "fail" {
+		metricCanary.Add("fail", 1)
+		http.Error(w, "canary failing as configured", http.StatusBadGateway)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		metricCanary.Add("upgrade_failed", 1)
+		log.Warningf("Canary upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxClientMessage)
+	metricCanary.Add("echo", 1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(canaryIdleTimeout))
+		mt, rd, err := conn.NextReader()
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		wr, err := conn.NextWriter(mt)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(wr, rd); err != nil {
+			return
+		}
+		if err := wr.Close(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	huproxy "github.com/google/huproxy/lib"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestCanary(t *testing.T) {
+	defer func(u, mode, secret string) { *canaryURL, *canaryMode, *pathSecret = u, mode, secret }(*canaryURL, *canaryMode, *pathSecret)
+	defer func(l *huproxy.Limiter) { upgradeLimiter = l }(upgradeLimiter)
+	defer setMaintenance(false)
+	pathSecrets.Store([]string{"s3cret"})
+	*canaryURL = "/canary"
+
+	for _, test := range []struct {
+		desc        string
+		mode        string
+		secret      string
+		maintenance bool
+		limiter     *huproxy.Limiter
+		path        string
+		want        int
+	}{
+		{"echo", "echo", "", false, nil, "/canary", http.StatusSwitchingProtocols},
+		{"fail", "fail", "", false, nil, "/canary", http.StatusBadGateway},
+		{"secret", "echo", "s3cret", false, nil, "/s3cret/canary", http.StatusSwitchingProtocols},
+		{"no secret", "echo", "s3cret", false, nil, "/canary", http.StatusNotFound},
+		{"wrong secret", "echo", "s3cret", false, nil, "/guess/canary", http.StatusNotFound},
+		{"maintenance", "echo", "", true, nil, "/canary", http.StatusServiceUnavailable},
+		{"upgrade rate", "echo", "", false, huproxy.NewLimiter(1e-9), "/canary", http.StatusServiceUnavailable},
+	} {
+		*canaryMode, *pathSecret = test.mode, test.secret
+		setMaintenance(test.maintenance)
+		upgradeLimiter = test.limiter
+		if test.limiter != nil {
+			// Use up the burst.
+			for test.limiter.Allow() {
+			}
+		}
+		m := mux.NewRouter()
+		m.NotFoundHandler = http.HandlerFunc(notFound)
+		wrap := func(h http.HandlerFunc) http.HandlerFunc { return h }
+		if test.secret != "" {
+			wrap = requireSecret
+		}
+		if err := setupCanary(m, wrap); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(m)
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+test.path, nil)
+		if resp == nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: status %d, want %d", test.desc, resp.StatusCode, test.want)
+		}
+		if conn != nil {
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, b, err := conn.ReadMessage(); err != nil || string(b) != "ping" {
+				t.Errorf("%s: echo = %q, %v; want \"ping\"", test.desc, b, err)
+			}
+			// Over the read limit.
+			conn.WriteMessage(websocket.BinaryMessage, make([]byte, maxClientMessage+1))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("%s: after an oversized message got %v, want close %d", test.desc, err, websocket.CloseMessageTooBig)
+			}
+			conn.Close()
+		}
+		srv.Close()
+	}
+}
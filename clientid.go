@@ -0,0 +1,80 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	clientIDHeader = "X-Huproxy-Client-Id"
+
+	// Longest client id accepted.
+	maxClientIDLen = 64
+
+	// Client ids beyond this many distinct ones are counted as "other".
+	maxClientIDMetrics = 100
+)
+
+var (
+	clientIDMode = flag.String("client_id", "log", "What to do with the client id header: 'ignore', 'log', or 'require'.")
+
+	metricByClientID = expvar.NewMap("tunnels_by_client_id")
+	clientIDsSeen    = struct {
+		sync.Mutex
+		m map[string]bool
+	}{m: make(map[string]bool)}
+)
+
+// clientID returns the client id sent by the client, if any.
+func clientID(r *http.Request) (string, error) {
+	if *clientIDMode == "ignore" {
+		return "", nil
+	}
+	id := r.Header.Get(clientIDHeader)
+	if id == "" && *clientIDMode == "require" {
+		return "", fmt.Errorf("missing %s header", clientIDHeader)
+	}
+	if len(id) > maxClientIDLen {
+		return "", fmt.Errorf("%s header longer than %d", clientIDHeader, maxClientIDLen)
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return "", fmt.Errorf("%s header has invalid characters", clientIDHeader)
+		}
+	}
+	return id, nil
+}
+
+// countClientID bumps the per-client-id tunnel counter, keeping the
+// number of distinct keys bounded.
+func countClientID(id string) {
+	if id == "" {
+		id = "none"
+	}
+	clientIDsSeen.Lock()
+	if !clientIDsSeen.m[id] {
+		if len(clientIDsSeen.m) >= maxClientIDMetrics {
+			id = "other"
+		} else {
+			clientIDsSeen.m[id] = true
+		}
+	}
+	clientIDsSeen.Unlock()
+	metricByClientID.Add(id, 1)
+}
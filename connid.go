@@ -0,0 +1,67 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var (
+	connIDMode = flag.String("connection_id", "random", "Id given to each tunnel request, sent to the client in the X-Huproxy-Connection-Id header and included in logs, webhooks and the admin listing: 'random' (16 hex digits), 'sequential' (the server start time and a counter), or 'off', a plain counter that isn't sent to clients.")
+
+	// For -connection_id sequential.
+	connIDStart = fmt.Sprintf("%x", time.Now().Unix())
+	lastConnID  int64
+)
+
+// checkConnIDMode validates -connection_id.
+func checkConnIDMode() error {
+	switch *connIDMode {
+	case "random", "sequential", "off":
+		return nil
+	}
+	return fmt.Errorf("invalid -connection_id %q", *connIDMode)
+}
+
+// newConnID returns the id of a new tunnel request, which is also the
+// tunnel's in the admin listing.
+func newConnID() string {
+	switch *connIDMode {
+	case "random":
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err == nil {
+			return hex.EncodeToString(b[:])
+		}
+	case "off":
+		return strconv.FormatInt(atomic.AddInt64(&lastConnID, 1), 10)
+	}
+	return fmt.Sprintf("%s-%d", connIDStart, atomic.AddInt64(&lastConnID, 1))
+}
+
+// setConnID adds the connection id to the response headers h, unless
+// -connection_id is off.
+func setConnID(h http.Header, id string) {
+	if *connIDMode != "off" {
+		h.Set(huproxy.ConnectionIDHeader, id)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+func TestConnID(t *testing.T) {
+	defer func(mode string) { *connIDMode = mode }(*connIDMode)
+	for _, test := range []struct {
+		mode       string
+		re         string
+		wantHeader bool
+	}{
+		{"random", `^[0-9a-f]{16}$`, true},
+		{"sequential", `^` + connIDStart + `-[0-9]+$`, true},
+		{"off", `^[0-9]+$`, false},
+	} {
+		*connIDMode = test.mode
+		if err := checkConnIDMode(); err != nil {
+			t.Errorf("checkConnIDMode(%q): %v", test.mode, err)
+		}
+		a, b := newConnID(), newConnID()
+		for _, id := range []string{a, b} {
+			if !regexp.MustCompile(test.re).MatchString(id) {
+				t.Errorf("-connection_id %s: id %q doesn't match %s", test.mode, id, test.re)
+			}
+		}
+		if a == b {
+			t.Errorf("-connection_id %s: two tunnels got id %q", test.mode, a)
+		}
+		h := http.Header{}
+		setConnID(h, a)
+		if got := h.Get(huproxy.ConnectionIDHeader); (got == a) != test.wantHeader || (got != "" && got != a) {
+			t.Errorf("-connection_id %s: header %q, want sent %v", test.mode, got, test.wantHeader)
+		}
+	}
+	*connIDMode = "uuid"
+	if checkConnIDMode() == nil {
+		t.Error("checkConnIDMode accepted \"uuid\"")
+	}
+}
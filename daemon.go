@@ -0,0 +1,168 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	pidFile         = flag.String("pidfile", "", "File to write the server PID to. Removed on shutdown.")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second, "On SIGTERM or SIGINT, how long to wait for active tunnels to finish before asking their clients to reconnect. 0 asks them at once.")
+
+	// Active tunnels, waited for on shutdown.
+	activeTunnels sync.WaitGroup
+
+	// Their websockets, told about the restart if still open once
+	// -shutdown_timeout runs out.
+	liveMu      sync.Mutex
+	liveTunnels = map[*websocket.Conn]bool{}
+)
+
+// How long clients get to close tunnels after being asked to reconnect.
+const restartGrace = 2 * time.Second
+
+// trackTunnel registers conn for notifyRestart until the returned func is
+// called.
+func trackTunnel(conn *websocket.Conn) func() {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	liveTunnels[conn] = true
+	return func() {
+		liveMu.Lock()
+		defer liveMu.Unlock()
+		delete(liveTunnels, conn)
+	}
+}
+
+// notifyRestart sends every open tunnel a close frame saying the server
+// is restarting, which clients can take as a cue to reconnect. It returns
+// the number of tunnels notified.
+func notifyRestart() int {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	for conn := range liveTunnels {
+		if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(*writeTimeout)); err != nil && err != websocket.ErrCloseSent {
+			log.Warningf("Sending restart notice to %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+	return len(liveTunnels)
+}
+
+// processAlive returns true if a process with the given PID exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// writePidFile writes our PID to fn, refusing to if it names another
+// running process. A pidfile left behind by a dead process is
+// overwritten.
+func writePidFile(fn string) error {
+	if b, err := ioutil.ReadFile(fn); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("%q names running process %d", fn, pid)
+		}
+		log.Warningf("Overwriting stale pidfile %q", fn)
+	}
+	return ioutil.WriteFile(fn, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+func removePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	if err := os.Remove(*pidFile); err != nil {
+		log.Warningf("Removing pidfile: %v", err)
+	}
+}
+
+// serve runs the HTTP server until it fails or a terminating signal
+// arrives, then waits up to -shutdown_timeout for tunnels to finish.
+func serve(s *http.Server) {
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("Writing pidfile: %v", err)
+		}
+		log.RegisterExitHandler(removePidFile)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// Closed once Shutdown returned, when no request is left that hasn't
+	// either finished or been counted in activeTunnels.
+	shutDown := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Infof("Got %v, shutting down", sig)
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Warningf("Shutting down HTTP server: %v", err)
+		}
+		close(shutDown)
+	}()
+
+	l, err := listenTCP(s.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %q: %v", s.Addr, err)
+	}
+	if *tlsCert != "" {
+		err = s.ServeTLS(l, *tlsCert, *tlsKey)
+	} else {
+		err = s.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as Shutdown starts, while it still lets
+	// requests in flight reach handleProxy.
+	<-shutDown
+
+	done := make(chan struct{})
+	go func() {
+		activeTunnels.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*shutdownTimeout):
+		n := notifyRestart()
+		log.Warningf("Shutting down with tunnels still active, asked %d clients to reconnect", n)
+		select {
+		case <-done:
+		case <-time.After(restartGrace):
+		}
+	}
+	removePidFile()
+}
@@ -0,0 +1,185 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max destinations whose -dest_budget use is tracked at once.
+const destBudgetSize = 4096
+
+var (
+	destBudget = flag.String("dest_budget", "", "Max new tunnels to any single host:port per time window, as count/window, e.g. 100/1m, over a sliding window. Beyond that, clients get 429. Empty is unlimited.")
+
+	// Budget tracker for -dest_budget, nil if unlimited.
+	destBudgets *budgetTracker
+)
+
+func init() {
+	expvar.Publish("dest_budget_used", expvar.Func(func() interface{} { return destBudgets.snapshot() }))
+}
+
+// parseBudget parses count/window.
+func parseBudget(s string) (int, time.Duration, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("want count/window, e.g. 100/1m, got %q", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("bad count %q", parts[0])
+	}
+	w, err := time.ParseDuration(parts[1])
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("bad window %q", parts[1])
+	}
+	return n, w, nil
+}
+
+// setupDestBudget prepares -dest_budget.
+func setupDestBudget() error {
+	if *destBudget == "" {
+		return nil
+	}
+	n, w, err := parseBudget(*destBudget)
+	if err != nil {
+		return fmt.Errorf("-dest_budget: %v", err)
+	}
+	destBudgets = newBudgetTracker(n, w)
+	return nil
+}
+
+// budgetTracker counts new tunnels per destination over a sliding window.
+type budgetTracker struct {
+	limit  int
+	window time.Duration
+
+	mu sync.Mutex
+	// Start times of the last up to limit tunnels to each destination,
+	// as a ring.
+	m map[string]*budgetRing
+}
+
+type budgetRing struct {
+	times []time.Time
+	next  int
+	// Start of the latest tunnel.
+	last time.Time
+}
+
+func newBudgetTracker(limit int, window time.Duration) *budgetTracker {
+	return &budgetTracker{limit: limit, window: window, m: make(map[string]*budgetRing)}
+}
+
+// used returns how many of the ring's tunnels started within the window
+// before now.
+func (b *budgetTracker) used(r *budgetRing, now time.Time) int {
+	n := 0
+	for _, t := range r.times {
+		if now.Sub(t) < b.window {
+			n++
+		}
+	}
+	return n
+}
+
+// allow counts a new tunnel to dest, returning false, and how long until
+// one is allowed again, if the budget is used up. A nil *budgetTracker
+// allows everything.
+func (b *budgetTracker) allow(dest string) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	return b.allowAt(dest, time.Now())
+}
+
+// allowAt is allow for a tunnel at now.
+func (b *budgetTracker) allowAt(dest string, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.m[dest]
+	if !ok {
+		if len(b.m) >= destBudgetSize {
+			b.gcLocked(now)
+		}
+		if len(b.m) >= destBudgetSize {
+			// Too many busy destinations to track another.
+			// Forgetting the one idle for longest lets it start
+			// over, but letting new ones through untracked would
+			// allow anyone to get around the budget.
+			b.evictLocked()
+		}
+		r = &budgetRing{}
+		b.m[dest] = r
+	}
+	if len(r.times) < b.limit {
+		r.times = append(r.times, now)
+		r.last = now
+		return true, 0
+	}
+	// The oldest of the last limit tunnels.
+	if oldest := r.times[r.next]; now.Sub(oldest) < b.window {
+		return false, b.window - now.Sub(oldest)
+	}
+	r.times[r.next] = now
+	r.next = (r.next + 1) % b.limit
+	r.last = now
+	return true, 0
+}
+
+// gcLocked drops destinations without tunnels in the window.
+func (b *budgetTracker) gcLocked(now time.Time) {
+	for d, r := range b.m {
+		if b.used(r, now) == 0 {
+			delete(b.m, d)
+		}
+	}
+}
+
+// evictLocked drops the destination whose latest tunnel is the oldest.
+func (b *budgetTracker) evictLocked() {
+	var lru string
+	var t time.Time
+	for d, r := range b.m {
+		if lru == "" || r.last.Before(t) {
+			lru, t = d, r.last
+		}
+	}
+	delete(b.m, lru)
+}
+
+// snapshot returns the budget used by each tracked destination, for
+// metrics.
+func (b *budgetTracker) snapshot() map[string]int {
+	m := make(map[string]int)
+	if b == nil {
+		return m
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for d, r := range b.m {
+		if n := b.used(r, now); n > 0 {
+			m[d] = n
+		}
+	}
+	return m
+}
@@ -0,0 +1,138 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseBudget(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		n       int
+		w       time.Duration
+		wantErr bool
+	}{
+		{"100/1m", 100, time.Minute, false},
+		{"1/500ms", 1, 500 * time.Millisecond, false},
+		{"100", 0, 0, true},
+		{"0/1m", 0, 0, true},
+		{"x/1m", 0, 0, true},
+		{"10/0s", 0, 0, true},
+		{"10/soon", 0, 0, true},
+	} {
+		n, w, err := parseBudget(test.in)
+		if (err != nil) != test.wantErr || n != test.n || w != test.w {
+			t.Errorf("parseBudget(%q) = %d, %v, %v; want %d, %v, error %v", test.in, n, w, err, test.n, test.w, test.wantErr)
+		}
+	}
+}
+
+func TestBudgetTracker(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	type try struct {
+		dest     string
+		at       time.Duration
+		want     bool
+		wantWait time.Duration
+	}
+	for _, test := range []struct {
+		desc  string
+		limit int
+		tries []try
+	}{
+		{"under budget", 2, []try{
+			{"a:1", 0, true, 0},
+			{"a:1", time.Second, true, 0},
+		}},
+		{"over budget", 2, []try{
+			{"a:1", 0, true, 0},
+			{"a:1", time.Second, true, 0},
+			{"a:1", 2 * time.Second, false, 58 * time.Second},
+		}},
+		{"per destination", 1, []try{
+			{"a:1", 0, true, 0},
+			{"b:1", 0, true, 0},
+			{"a:1", time.Second, false, 59 * time.Second},
+		}},
+		{"sliding window", 2, []try{
+			{"a:1", 0, true, 0},
+			{"a:1", 30 * time.Second, true, 0},
+			{"a:1", 59 * time.Second, false, time.Second},
+			{"a:1", 60 * time.Second, true, 0},
+			{"a:1", 61 * time.Second, false, 29 * time.Second},
+			{"a:1", 90 * time.Second, true, 0},
+		}},
+	} {
+		b := newBudgetTracker(test.limit, time.Minute)
+		for i, tr := range test.tries {
+			ok, wait := b.allowAt(tr.dest, t0.Add(tr.at))
+			if ok != tr.want || wait != tr.wantWait {
+				t.Errorf("%s: try %d to %s at %v = %v, %v; want %v, %v", test.desc, i, tr.dest, tr.at, ok, wait, tr.want, tr.wantWait)
+			}
+		}
+	}
+}
+
+func TestBudgetTrackerFull(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	for _, test := range []struct {
+		desc string
+		// Time since the tracked destinations' tunnels when a new one
+		// comes along.
+		after time.Duration
+	}{
+		{"expired", 2 * time.Minute},
+		{"all busy", time.Second},
+	} {
+		b := newBudgetTracker(1, time.Minute)
+		for i := 0; i < destBudgetSize; i++ {
+			if ok, _ := b.allowAt(fmt.Sprintf("h%d:1", i), t0.Add(time.Duration(i)*time.Millisecond)); !ok {
+				t.Fatalf("%s: destination %d refused", test.desc, i)
+			}
+		}
+		now := t0.Add(time.Duration(destBudgetSize)*time.Millisecond + test.after)
+		if ok, _ := b.allowAt("new:1", now); !ok {
+			t.Errorf("%s: new destination refused", test.desc)
+		}
+		// The new destination is tracked, and so limited.
+		if ok, _ := b.allowAt("new:1", now); ok {
+			t.Errorf("%s: new destination not limited", test.desc)
+		}
+		if len(b.m) > destBudgetSize {
+			t.Errorf("%s: tracking %d destinations, want at most %d", test.desc, len(b.m), destBudgetSize)
+		}
+		if test.after < time.Minute {
+			// Only the least recently used one was forgotten.
+			if _, ok := b.m["h0:1"]; ok {
+				t.Errorf("%s: least recently used destination not evicted", test.desc)
+			}
+			if ok, _ := b.allowAt("h1:1", now); ok {
+				t.Errorf("%s: busy destination no longer limited", test.desc)
+			}
+		}
+	}
+}
+
+func TestBudgetTrackerNil(t *testing.T) {
+	var b *budgetTracker
+	if ok, _ := b.allow("a:1"); !ok {
+		t.Error("nil budgetTracker refused a tunnel")
+	}
+	if len(b.snapshot()) != 0 {
+		t.Error("nil budgetTracker has a snapshot")
+	}
+}
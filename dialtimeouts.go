@@ -0,0 +1,104 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dialTimeoutsFile = flag.String("dial_timeouts", "", "File of \"host:port timeout\" lines, with globs, overriding -dial_timeout for matching destinations. The first match wins.")
+
+	// Current []dialTimeoutRule.
+	dialTimeoutRules atomic.Value
+)
+
+type dialTimeoutRule struct {
+	dest    destPattern
+	timeout time.Duration
+}
+
+// loadDialTimeouts reads -dial_timeouts:
+//
+//	# destination       timeout
+//	*.db.example.com:*  30s
+//	*:22                3s
+func loadDialTimeouts() error {
+	f, err := os.Open(*dialTimeoutsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rules []dialTimeoutRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want \"host:port timeout\", got %q", *dialTimeoutsFile, n, line)
+		}
+		host, port, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad destination %q: %v", *dialTimeoutsFile, n, fields[0], err)
+		}
+		host = strings.ToLower(host)
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("%s:%d: bad host pattern %q: %v", *dialTimeoutsFile, n, host, err)
+		}
+		if _, err := path.Match(port, ""); err != nil {
+			return fmt.Errorf("%s:%d: bad port pattern %q: %v", *dialTimeoutsFile, n, port, err)
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s:%d: bad timeout %q", *dialTimeoutsFile, n, fields[1])
+		}
+		rules = append(rules, dialTimeoutRule{dest: destPattern{host: host, port: port}, timeout: d})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	dialTimeoutRules.Store(rules)
+	return nil
+}
+
+// dialTimeoutFor returns the connect timeout for dest, a normalized
+// host:port.
+func dialTimeoutFor(dest string) time.Duration {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return *dialTimeout
+	}
+	rules, _ := dialTimeoutRules.Load().([]dialTimeoutRule)
+	for _, r := range rules {
+		if r.dest.match(host, port) {
+			return r.timeout
+		}
+	}
+	return *dialTimeout
+}
@@ -0,0 +1,97 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	errorPage403 = flag.String("error_page_403", "", "Body of 403 answers to tunnel requests refused by -policy or certificate pinning, as a string or @<filename>. Empty sends a short default.")
+	errorPage429 = flag.String("error_page_429", "", "Body of 429 answers to tunnel requests over -dest_budget, as a string or @<filename>. Empty sends a short default.")
+	errorPage502 = flag.String("error_page_502", "", "Body of 502 answers to tunnel requests whose backend is unreachable, as a string or @<filename>. Empty sends a short default.")
+	errorPage503 = flag.String("error_page_503", "", "Body of 503 answers to tunnel requests refused for maintenance or limits, as a string or @<filename>. Empty sends a short default.")
+	errorPage504 = flag.String("error_page_504", "", "Body of 504 answers to tunnel requests whose backend timed out, as a string or @<filename>. Empty sends a short default.")
+
+	// Current map[int]errorPage of configured pages, by status.
+	errorPages atomic.Value
+)
+
+// errorPage is a configured body for refused tunnel requests.
+type errorPage struct {
+	body  []byte
+	ctype string
+}
+
+func errorPageFlags() map[int]*string {
+	return map[int]*string{
+		http.StatusForbidden:          errorPage403,
+		http.StatusTooManyRequests:    errorPage429,
+		http.StatusBadGateway:         errorPage502,
+		http.StatusServiceUnavailable: errorPage503,
+		http.StatusGatewayTimeout:     errorPage504,
+	}
+}
+
+// haveErrorPages returns true if any -error_page_* is set, and whether any
+// is read from a file, to be reread on reload.
+func haveErrorPages() (set, files bool) {
+	for _, p := range errorPageFlags() {
+		set = set || *p != ""
+		files = files || strings.HasPrefix(*p, "@")
+	}
+	return set, files
+}
+
+// loadErrorPages (re)reads the -error_page_* flags.
+func loadErrorPages() error {
+	pages := make(map[int]errorPage)
+	for status, p := range errorPageFlags() {
+		if *p == "" {
+			continue
+		}
+		body := []byte(*p)
+		if strings.HasPrefix(*p, "@") {
+			b, err := ioutil.ReadFile((*p)[1:])
+			if err != nil {
+				return fmt.Errorf("-error_page_%d: %v", status, err)
+			}
+			body = b
+		}
+		pages[status] = errorPage{body: body, ctype: http.DetectContentType(body)}
+	}
+	errorPages.Store(pages)
+	return nil
+}
+
+// refuse answers a tunnel request with status, and the configured error
+// page for it, or msg if there is none. Pages are sent as configured, with
+// nothing about the request or the server filled in.
+func refuse(w http.ResponseWriter, msg string, status int) {
+	pages, _ := errorPages.Load().(map[int]errorPage)
+	p, ok := pages[status]
+	if !ok {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", p.ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(p.body)
+}
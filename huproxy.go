@@ -15,11 +15,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -35,92 +41,811 @@ var (
 	handshakeTimeout = flag.Duration("handshake_timeout", 10*time.Second, "Handshake timeout.")
 	writeTimeout     = flag.Duration("write_timeout", 10*time.Second, "Write timeout.")
 	url              = flag.String("url", "proxy", "Path to listen to.")
+	maxHeaderBytes   = flag.Int("max_header_bytes", 64<<10, "Max size of request headers. Larger requests get 431 Request Header Fields Too Large.")
+	headerTimeout    = flag.Duration("read_header_timeout", 5*time.Second, "Max time to read request headers.")
+	wsReadBuffer     = flag.Int("ws_read_buffer", 1024, "Websocket read buffer size in bytes, per tunnel.")
+	wsWriteBuffer    = flag.Int("ws_write_buffer", 1024, "Websocket write buffer size in bytes, per tunnel.")
+	wsCompression    = flag.Bool("ws_compression", false, "Accept the permessage-deflate websocket extension when clients offer it.")
+	verbose          = flag.Bool("verbose", false, "Log websocket handshake details.")
+	wsBufferPool     = flag.Bool("ws_buffer_pool", false, "Share websocket write buffers between tunnels, instead of one per tunnel. Saves memory with many mostly idle tunnels.")
+	ctrlHandshake    = flag.Bool("control_handshake", false, "Exchange capabilities with clients offering it, in a text message each way before tunnel data. Other clients tunnel as before.")
+	firstByteTimeout = flag.Duration("first_byte_timeout", time.Minute, "Close tunnels that carry no data either way this long after opening, e.g. from port scanners. 0 disables.")
+	halfCloseTimeout = flag.Duration("half_close_timeout", huproxy.DefaultDrainTimeout, "When a client closes a tunnel, shut down the sending side of the backend connection and keep sending what the backend sends to the client for up to this long, until the backend closes too. 0 closes the backend right away.")
 
 	upgrader websocket.Upgrader
 )
 
 func handleProxy(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	// Counted from the start, so that shutdown also waits for tunnels
+	// still dialing or upgrading.
+	activeTunnels.Add(1)
+	defer activeTunnels.Done()
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
+	connID := newConnID()
+
 	vars := mux.Vars(r)
 	host := vars["host"]
 	port := vars["port"]
+	rt := requestRoute(r)
+	proto := requestProtocol(r)
+	if prt := routeByProtocol[proto]; rt == nil && prt != nil {
+		rt = prt
+	}
+	if rt != nil && rt.socket != "" {
+		// Destination "unix:/path", for policies, limits and logs.
+		host, port = "unix", rt.socket
+	}
+
+	dest := normalizeDest(host, port)
+
+	vh, ok := requestVhost(r)
+	if !ok {
+		metricRejected.Add("vhost", 1)
+		notFound(w, r)
+		return
+	}
+	// Only now that the request is for a known route, so that probes of
+	// others get nothing to tell huproxy by.
+	setConnID(w.Header(), connID)
+
+	// Checked before dialing, so that browsers and scanners get a clear
+	// answer instead of a backend connection and an upgrade error.
+	if r.Method != http.MethodGet {
+		metricRejected.Add("method", 1)
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed, websocket upgrade must be a GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		metricRejected.Add("not_websocket", 1)
+		http.Error(w, "this is a websocket endpoint; expected \"Connection: Upgrade\" and \"Upgrade: websocket\" headers", http.StatusBadRequest)
+		return
+	}
+	if underMaintenance() {
+		metricRejected.Add("maintenance", 1)
+		refuseMaintenance(w)
+		return
+	}
+	if !allowUpgrade() {
+		metricRejected.Add("upgrade_rate", 1)
+		w.Header().Set("Retry-After", "1")
+		refuse(w, "too many new tunnels, try again later", http.StatusServiceUnavailable)
+		return
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	id, err := clientID(r)
 	if err != nil {
-		log.Warningf("Failed to upgrade to websockets: %v", err)
+		log.Warningf("Rejecting tunnel from %s: %v", r.RemoteAddr, err)
+		metricRejected.Add("client_id", 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry := log.WithFields(log.Fields{
+		"remote":  r.RemoteAddr,
+		"dest":    dest,
+		"conn_id": connID,
+	})
+	if id != "" {
+		entry = entry.WithField("client_id", id)
+	}
+	if vh != nil {
+		entry = entry.WithField("vhost", vh.name)
+	}
+	pp := portPolicyFor(port)
+	if pp != nil {
+		entry = entry.WithField("port_policy", pp.name)
+	}
+	if proto != "" {
+		entry = entry.WithField("protocol", proto)
+	}
+	who := identity(r)
+	if who != "" {
+		entry = entry.WithField("identity", who)
+	}
+	if p := negotiatedALPN(r); p != "" {
+		entry = entry.WithField("alpn", p)
+	}
+	if fp := requestJA3(r); fp != "" {
+		entry = entry.WithField("ja3", fp)
+	}
+
+	if pin, ok := checkPinned(r); !ok {
+		entry.WithField("spki_pin", pin).Warning("Client certificate is not pinned")
+		metricRejected.Add("pinned_cert", 1)
+		refuse(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if vh != nil && vh.requireIdentity && who == "" {
+		entry.Warning("No client identity for vhost requiring one")
+		metricRejected.Add("vhost_identity", 1)
+		askForIdentity(w, vh.name)
+		refuse(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	if pp != nil && pp.requireCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		entry.Warning("No verified client certificate for port requiring one")
+		metricRejected.Add("port_cert", 1)
+		refuse(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	if pp != nil && pp.requireIdentity && who == "" {
+		entry.Warning("No client identity for port requiring one")
+		metricRejected.Add("port_identity", 1)
+		askForIdentity(w, "huproxy")
+		refuse(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if v := pp.verifier(); v != nil {
+		tok := bearerToken(r)
+		if tok == "" {
+			entry.Warning("No bearer token for port requiring one")
+			metricRejected.Add("port_jwt", 1)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			refuse(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if err := v.verify(tok, time.Now()); err != nil {
+			entry.WithError(err).Warning("Bad bearer token for port requiring one")
+			metricRejected.Add("port_jwt", 1)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			refuse(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+	if pp != nil && pp.limiter != nil && !pp.limiter.Allow() {
+		entry.Warning("Port over its new tunnel rate, rejecting")
+		metricRejected.Add("port_rate", 1)
+		w.Header().Set("Retry-After", "1")
+		refuse(w, "too many new tunnels to port, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !tunnelAllowed(vh, pp, who, sourceIP(r), dest) {
+		entry.WithField("source", sourceIP(r)).Warning("Destination not allowed by policy")
+		metricRejected.Add("policy", 1)
+		refuse(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	defer conn.Close()
 
-	s, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), *dialTimeout)
+	qu, ok := acquireQuota(who, clientAddr(r))
+	if !ok {
+		entry.Warning("Identity has its quota of tunnels, rejecting")
+		metricRejected.Add("identity_quota", 1)
+		refuse(w, "too many tunnels for identity", http.StatusServiceUnavailable)
+		return
+	}
+	defer qu.release()
+
+	if !destLimits.acquire(dest, *maxPerDest) {
+		entry.Warning("Too many tunnels to destination, rejecting")
+		metricRejected.Add("max_per_dest", 1)
+		refuse(w, "too many connections to destination", http.StatusServiceUnavailable)
+		return
+	}
+	defer destLimits.release(dest)
+
+	if ok, wait := destBudgets.allow(dest); !ok {
+		entry.Warning("Destination has used its -dest_budget, rejecting")
+		metricRejected.Add("dest_budget", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		refuse(w, "too many new connections to destination, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	timeout := dialTimeoutFor(dest)
+	s, err := dialBackend(rt, host, port, timeout)
 	if err != nil {
-		log.Warningf("Failed to connect to %q:%q: %v", host, port, err)
+		entry.Warningf("Failed to connect: %v", err)
+		status, msg := http.StatusBadGateway, "backend unreachable"
+		var be *backendError
+		if errors.As(err, &be) {
+			status, msg = be.status, be.msg
+		}
+		noteSetup(entry, port, timeout, time.Since(received), msg)
+		refuse(w, msg, status)
 		return
 	}
 	defer s.Close()
+	s = qu.wrap(ctx, s)
+	if *payloadSample > 0 {
+		var flush func()
+		s, flush = samplePayload(entry, s)
+		defer flush()
+	}
+
+	respHeader := http.Header{huproxy.VersionHeader: {huproxy.Version}}
+	setConnID(respHeader, connID)
+	handshake := *ctrlHandshake && huproxy.AcceptHandshake(r, respHeader)
+	conn, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		entry.Warningf("Failed to upgrade to websockets: %v", err)
+		return
+	}
+	if copyBufferSize > 0 {
+		// Messages are streamed to the backend rather than held
+		// whole, so this only turns away clients misbehaving.
+		conn.SetReadLimit(maxClientMessage)
+	}
+	defer conn.Close()
+	noteSetup(entry, port, timeout, time.Since(received), "ok")
+	if *verbose {
+		logUpgrade(entry, r)
+	}
+	integrity := false
+	if handshake {
+		hs, err := huproxy.ServerHandshake(conn, huproxy.Capabilities{
+			Version:  huproxy.Version,
+			Features: []string{huproxy.FeatureIntegrity},
+		}, 0)
+		if err != nil {
+			entry.Warningf("Handshake failed: %v", err)
+			return
+		}
+		entry = entry.WithField("client_version", hs.Peer.Version)
+		integrity = hs.Has(huproxy.FeatureIntegrity)
+	}
+
+	defer trackTunnel(conn)()
+	metricTotal.Add(1)
+	metricActive.Add(1)
+	defer metricActive.Add(-1)
+	route := routeName(r)
+	metricRouteTotal.Add(route, 1)
+	metricRouteActive.Add(route, 1)
+	defer metricRouteActive.Add(route, -1)
+	countClientID(id)
+
+	t, untrack := registerTunnel(connID, r.RemoteAddr, who, dest, sourceIP(r), vh, pp)
+	defer untrack()
+	st := &t.stats
+	st.integrity = integrity
+	if pp != nil {
+		st.idleTimeout = pp.idleTimeout
+	}
+
+	start := t.start
+	withDestName(entry, host).Info("Tunnel opened")
+	sendEvent(&tunnelEvent{
+		Event:    "open",
+		Remote:   r.RemoteAddr,
+		Identity: who,
+		ClientID: id,
+		ConnID:   connID,
+		Dest:     dest,
+	})
+
+	bridge(ctx, cancel, conn, s, st)
+	d := time.Since(start)
+	metricRouteBytesIn.Add(route, st.in)
+	metricRouteBytesOut.Add(route, st.out)
+	qu.count(st.in + st.out)
+	if st.integrity {
+		entry = entry.WithField("integrity", st.integrityResult)
+	}
+	withDestName(entry, host).WithFields(log.Fields{
+		"duration":  d.String(),
+		"bytes_in":  st.in,
+		"bytes_out": st.out,
+		"reason":    st.reason,
+	}).Info("Tunnel closed")
+	sendEvent(&tunnelEvent{
+		Event:      "close",
+		Remote:     r.RemoteAddr,
+		Identity:   who,
+		ClientID:   id,
+		ConnID:     connID,
+		Dest:       dest,
+		BytesIn:    st.in,
+		BytesOut:   st.out,
+		DurationMS: float64(d.Microseconds()) / 1000,
+		Reason:     st.reason,
+	})
+}
+
+// Request headers not logged by logUpgrade.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// logUpgrade logs the headers of the upgrade request and what was made of
+// the websocket extensions offered, to help find middleboxes that
+// interfere with them.
+func logUpgrade(entry *log.Entry, r *http.Request) {
+	var keys []string
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := strings.Join(r.Header[k], ", ")
+		if secretHeaders[k] {
+			v = "<redacted>"
+		}
+		entry.Infof("Upgrade request header %s: %s", k, v)
+	}
+	offered := strings.Join(r.Header.Values("Sec-Websocket-Extensions"), ", ")
+	if offered == "" {
+		entry.Infof("No websocket extensions offered")
+		return
+	}
+	deflate := "not accepted"
+	if *wsCompression && strings.Contains(offered, "permessage-deflate") {
+		deflate = "accepted"
+	}
+	entry.Infof("Websocket extensions offered: %s; permessage-deflate %s", offered, deflate)
+}
+
+// routeName returns the name of the route r matched, for metrics.
+func routeName(r *http.Request) string {
+	if rt := mux.CurrentRoute(r); rt != nil && rt.GetName() != "" {
+		return rt.GetName()
+	}
+	return "other"
+}
+
+// tunnelStats describes how a tunnel went, for logs and webhooks.
+type tunnelStats struct {
+	// Bytes from client to backend, and from backend to client.
+	in, out int64
+	reason  string
+
+	// Set if the client agreed on huproxy.FeatureIntegrity, and then
+	// "ok", "partial" or "mismatch" from checking its report, if any.
+	integrity       bool
+	integrityResult string
+
+	// If nonzero, the tunnel is closed after this long without data.
+	idleTimeout time.Duration
+
+	// Closed to end the tunnel from outside, as an admin or on a policy
+	// reload, once terminateReason is set.
+	terminate       chan struct{}
+	terminateReason string
+}
+
+// bridge copies data both ways between the websocket and the backend
+// until either side closes or ctx is cancelled. Anything that should end
+// the tunnel (a timeout, an error in either direction) cancels ctx, which
+// closes the backend and expires websocket reads so that neither copy
+// stays blocked. If the server sent a close message, reads expire only
+// after giving the client a moment to answer it, dropping any data it
+// still sends. If the client closes first, with -half_close_timeout the
+// backend only gets the end of its input, and its answer still goes to
+// the client before the server's close. bridge returns only once both
+// directions, and any other
+// goroutine it started, have stopped. The byte counts in st are kept up
+// to date as data flows.
+func bridge(ctx context.Context, cancel func(), conn *websocket.Conn, s net.Conn, st *tunnelStats) {
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		writeMu sync.Mutex
+	)
+	// end records why the tunnel ended, if nothing else did first.
+	end := func(reason string) {
+		once.Do(func() { st.reason = reason })
+		cancel()
+	}
+	// Set once a close message went out, before ending the tunnel.
+	var closeSent int32
+	sendClose := func(code int, reason string) error {
+		err := conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(*writeTimeout))
+		if err == nil {
+			atomic.StoreInt32(&closeSent, 1)
+		}
+		return err
+	}
+	// With integrity checks, digests of the tunnel data, and a way to send
+	// our report once.
+	var sentDigest, receivedDigest *huproxy.StreamDigest
+	var reported int32
+	sendIntegrity := func() {
+		if sentDigest == nil || !atomic.CompareAndSwapInt32(&reported, 0, 1) {
+			return
+		}
+		if err := huproxy.SendIntegrity(conn, &writeMu, sentDigest, receivedDigest, *writeTimeout); err != nil && ctx.Err() == nil {
+			log.Warningf("Sending integrity report: %v", err)
+		}
+	}
+	if st.integrity {
+		sentDigest, receivedDigest = huproxy.NewStreamDigest(), huproxy.NewStreamDigest()
+		st.integrityResult = "no report"
+	}
+	// A normal close from the client is answered once the backend is done
+	// too, see below, rather than right away.
+	conn.SetCloseHandler(func(code int, text string) error {
+		if code != websocket.CloseNormalClosure || *halfCloseTimeout <= 0 {
+			sendClose(code, "")
+		}
+		return nil
+	})
+	// spawn runs f in a goroutine that bridge waits for.
+	spawn := func(f func()) {
+		wg.Add(1)
+		metricBridgeGoroutines.Add(1)
+		go func() {
+			defer wg.Done()
+			defer metricBridgeGoroutines.Add(-1)
+			f()
+		}()
+	}
+	defer wg.Wait()
+	defer end("cancelled")
+
+	spawn(func() {
+		select {
+		case <-ctx.Done():
+		case <-st.terminate:
+			sendClose(websocket.CloseGoingAway, st.terminateReason)
+			end(st.terminateReason)
+		}
+		s.Close()
+		if atomic.LoadInt32(&closeSent) == 1 {
+			// The reader drains until the client answers.
+			conn.SetReadDeadline(time.Now().Add(huproxy.DefaultDrainTimeout))
+		} else {
+			conn.SetReadDeadline(time.Now())
+		}
+	})
+
+	if st.idleTimeout > 0 {
+		spawn(func() {
+			watchIdle(ctx.Done(), st, st.idleTimeout, func() {
+				const reason = "idle timeout"
+				sendClose(websocket.CloseGoingAway, reason)
+				end(reason)
+			})
+		})
+	}
+
+	if *textKeepalive > 0 {
+		spawn(func() { sendTextKeepalives(ctx, conn, &writeMu) })
+	}
+
+	var backend io.Reader = s
+	if backendSentinel != nil {
+		backend = &sentinelReader{r: s, sentinel: backendSentinel}
+	}
+	src := &countingReader{r: backend, n: &st.out}
+
+	if *firstByteTimeout > 0 {
+		t := time.AfterFunc(*firstByteTimeout, func() {
+			if atomic.LoadInt64(&st.in) > 0 || atomic.LoadInt64(&st.out) > 0 {
+				return
+			}
+			const reason = "no data before first-byte timeout"
+			sendClose(websocket.CloseGoingAway, reason)
+			end(reason)
+		})
+		defer t.Stop()
+	}
 
 	// websocket -> server
-	go func() {
+	spawn(func() {
+		var buf []byte
+		if copyBufferSize > 0 {
+			buf = make([]byte, copyBufferSize)
+		}
 		for {
 			mt, r, err := conn.NextReader()
+			if ctx.Err() != nil {
+				if err == nil && atomic.LoadInt32(&closeSent) == 1 {
+					huproxy.DrainClose(conn, huproxy.DefaultDrainTimeout)
+				}
+				end("cancelled")
+				return
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) && atomic.LoadInt32(&closeSent) == 0 && *halfCloseTimeout > 0 {
+				// The client is done sending. Pass that on, and
+				// keep sending it the backend's answer.
+				once.Do(func() { st.reason = "client closed" })
+				if closeWrite(s) {
+					t := time.NewTimer(*halfCloseTimeout)
+					defer t.Stop()
+					select {
+					case <-ctx.Done():
+						return
+					case <-t.C:
+					}
+				}
+				sendIntegrity()
+				sendClose(websocket.CloseNormalClosure, "")
+				end("client closed")
+				return
+			}
 			if websocket.IsCloseError(err,
 				websocket.CloseNormalClosure,   // Normal.
 				websocket.CloseAbnormalClosure, // OpenSSH killed proxy client.
+				websocket.CloseServiceRestart,  // Reply to notifyRestart.
 			) {
+				end("client closed")
 				return
 			}
 			if err != nil {
 				log.Errorf("nextreader: %v", err)
+				end("client error")
 				return
 			}
+			if mt == websocket.TextMessage && receivedDigest != nil {
+				report, err := huproxy.ReadIntegrity(r)
+				if err != nil {
+					log.Warningf("Reading integrity report: %v", err)
+					end("client error")
+					return
+				}
+				if report == nil {
+					continue
+				}
+				c := huproxy.CheckIntegrity(report, sentDigest, receivedDigest)
+				switch {
+				case c.Err != nil:
+					log.Errorf("Integrity check of tunnel from %v failed: %v", conn.RemoteAddr(), c.Err)
+					st.integrityResult = "mismatch"
+				case c.Complete:
+					st.integrityResult = "ok"
+				default:
+					st.integrityResult = "partial"
+				}
+				// Answer, so that the client can check both
+				// directions. With -half_close_timeout that's
+				// left to the server's close, which the one
+				// following the report waits for, so that the
+				// answer covers all the backend sent.
+				if *halfCloseTimeout <= 0 {
+					sendIntegrity()
+				}
+				continue
+			}
 			if mt != websocket.BinaryMessage {
-				log.Errorf("received non-binary websocket message")
+				log.Error(huproxy.ErrNonBinaryMessage)
+				end("client error")
+				return
+			}
+			if receivedDigest != nil {
+				r = io.TeeReader(r, receivedDigest)
+			}
+			n, err := copyToBackend(s, r, buf)
+			atomic.AddInt64(&st.in, n)
+			if err == websocket.ErrReadLimit {
+				log.Warningf("Client message over %d bytes, closing", maxClientMessage)
+				end("client error")
 				return
 			}
-			if _, err := io.Copy(s, r); err != nil {
-				log.Warningf("Reading from websocket: %v", err)
-				cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warningf("Reading from websocket: %v", err)
+				}
+				end("backend error")
+				return
 			}
 		}
-	}()
+	})
 
 	// server -> websocket
 	// TODO: NextWriter() seems to be broken.
-	if err := huproxy.File2WS(ctx, cancel, s, conn); err == io.EOF {
-		if err := conn.WriteControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-			time.Now().Add(*writeTimeout)); err == websocket.ErrCloseSent {
+	err := huproxy.File2WSOptions(ctx, func() {}, src, conn, huproxy.CopyOptions{WriteMu: &writeMu, BufferSize: copyBufferSize, Digest: sentDigest})
+	if err == io.EOF || err == errSentinel {
+		// Before the close message, which ends the tunnel data.
+		sendIntegrity()
+		if err == errSentinel {
+			end("backend sentinel")
+		}
+		end("backend closed")
+		if err := sendClose(websocket.CloseNormalClosure, ""); err == websocket.ErrCloseSent {
 		} else if err != nil {
 			log.Warningf("Error sending close message: %v", err)
 		}
-	} else if err != nil {
+	} else if we := (*huproxy.WriteError)(nil); errors.As(err, &we) {
+		if ctx.Err() == nil {
+			log.Warning(err)
+		}
+		end("client error")
+	} else if err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Warningf("Reading from file: %v", err)
+		end("backend error")
 	}
 }
 
+// closeWrite shuts down the sending side of the backend connection c,
+// looking through the wrappers of this package. It returns false if c
+// can't be half closed.
+func closeWrite(c net.Conn) bool {
+	for {
+		switch cc := c.(type) {
+		case interface{ CloseWrite() error }:
+			return cc.CloseWrite() == nil
+		case *sampledConn:
+			c = cc.Conn
+		case *throttledConn:
+			c = cc.Conn
+		default:
+			return false
+		}
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
 func main() {
 	flag.Parse()
 
+	if err := checkConnIDMode(); err != nil {
+		log.Fatal(err)
+	}
+	switch *clientIDMode {
+	case "ignore", "log", "require":
+	default:
+		log.Fatalf("Invalid -client_id %q", *clientIDMode)
+	}
+
+	if err := setupConnMemory(); err != nil {
+		log.Fatal(err)
+	}
 	upgrader = websocket.Upgrader{
-		ReadBufferSize:   1024,
-		WriteBufferSize:  1024,
-		HandshakeTimeout: *handshakeTimeout,
+		ReadBufferSize:    *wsReadBuffer,
+		WriteBufferSize:   *wsWriteBuffer,
+		HandshakeTimeout:  *handshakeTimeout,
+		EnableCompression: *wsCompression,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
+	if *wsBufferPool {
+		upgrader.WriteBufferPool = &sync.Pool{}
+	}
+
+	if err := setupBackendTLS(); err != nil {
+		log.Fatalf("Setting up backend TLS: %v", err)
+	}
+	if err := setupWebhooks(); err != nil {
+		log.Fatalf("Setting up webhooks: %v", err)
+	}
+	if err := checkPayloadSample(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseSentinel(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupUpgradeRate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupDestBudget(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *policyFile != "" {
+		p, err := loadPolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("Loading policy: %v", err)
+		}
+		if err := checkRequireACL(p); err != nil {
+			log.Fatal(err)
+		}
+		aclPolicy.Store(p)
+		onReload("policy", func() error {
+			p, err := loadPolicy(*policyFile)
+			if err != nil {
+				return err
+			}
+			if err := checkRequireACL(p); err != nil {
+				return err
+			}
+			aclPolicy.Store(p)
+			enforcePolicy()
+			return nil
+		})
+	} else if err := checkRequireACL(nil); err != nil {
+		log.Fatal(err)
+	}
+	if *quotasFile != "" {
+		if err := loadIdentityQuotas(); err != nil {
+			log.Fatalf("Loading quotas: %v", err)
+		}
+		onReload("quotas", loadIdentityQuotas)
+	}
+	if *pinnedCertsFile != "" {
+		if err := loadPinnedCerts(); err != nil {
+			log.Fatalf("Loading pinned client certs: %v", err)
+		}
+		onReload("pinned client certs", loadPinnedCerts)
+	}
+	if *dialTimeoutsFile != "" {
+		if err := loadDialTimeouts(); err != nil {
+			log.Fatalf("Loading dial timeouts: %v", err)
+		}
+		onReload("dial timeouts", loadDialTimeouts)
+	}
+	if *pathSecret != "" {
+		if err := loadPathSecrets(); err != nil {
+			log.Fatalf("Loading path secrets: %v", err)
+		}
+		if strings.HasPrefix(*pathSecret, "@") {
+			onReload("path secrets", loadPathSecrets)
+		}
+	}
+	if set, files := haveErrorPages(); set {
+		if err := loadErrorPages(); err != nil {
+			log.Fatalf("Loading error pages: %v", err)
+		}
+		if files {
+			onReload("error pages", loadErrorPages)
+		}
+	}
+	if err := setupVhosts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupPortPolicies(); err != nil {
+		log.Fatal(err)
+	}
+	handleReloads()
+	if *maintenance {
+		setMaintenance(true)
+	}
+	handleMaintenanceSignals()
 
 	log.Infof("huproxy %s", huproxy.Version)
 	m := mux.NewRouter()
-	m.HandleFunc(fmt.Sprintf("/%s/{host}/{port}", *url), handleProxy)
+	wrap := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if *pathSecret != "" {
+		wrap = requireSecret
+		m.HandleFunc(fmt.Sprintf("/{secret}/%s/{host}/{port}", *url), requireSecret(handleProxy)).Name(*url)
+	} else {
+		m.HandleFunc(fmt.Sprintf("/%s/{host}/{port}", *url), handleProxy).Name(*url)
+	}
+	if err := setupRoutes(m, wrap); err != nil {
+		log.Fatalf("Setting up -route: %v", err)
+	}
+	if err := setupProtocolRoutes(); err != nil {
+		log.Fatal(err)
+	}
+	if *landingPage != "" {
+		h, err := landingHandler(*landingPage)
+		if err != nil {
+			log.Fatalf("Loading landing page: %v", err)
+		}
+		m.Handle("/", h)
+	}
+	m.NotFoundHandler = http.HandlerFunc(notFound)
+	if *readyzURL != "" {
+		m.HandleFunc("/"+strings.TrimPrefix(*readyzURL, "/"), readyz)
+	}
+	if err := setupCanary(m, wrap); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupAdmin(m); err != nil {
+		log.Fatalf("Setting up admin endpoints: %v", err)
+	}
+	setupMetrics(m, wrap)
 	s := &http.Server{
-		Addr:           *listen,
-		Handler:        m,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              *listen,
+		Handler:           m,
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: *headerTimeout,
+		WriteTimeout:      10 * time.Second,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+	if err := setupServerTLS(s); err != nil {
+		log.Fatalf("Setting up TLS: %v", err)
 	}
-	log.Fatal(s.ListenAndServe())
+	serve(s)
 }
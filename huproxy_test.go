@@ -0,0 +1,79 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHandleProxyNotUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			dialed <- struct{}{}
+			c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	for _, test := range []struct {
+		method    string
+		header    map[string]string
+		want      int
+		wantAllow bool
+		wantBody  string
+	}{
+		{"POST", nil, http.StatusMethodNotAllowed, true, "must be a GET"},
+		{"HEAD", nil, http.StatusMethodNotAllowed, true, ""},
+		{"POST", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, http.StatusMethodNotAllowed, true, "must be a GET"},
+		{"GET", nil, http.StatusBadRequest, false, "this is a websocket endpoint"},
+		{"GET", map[string]string{"Connection": "Upgrade"}, http.StatusBadRequest, false, "this is a websocket endpoint"},
+		{"GET", map[string]string{"Upgrade": "websocket"}, http.StatusBadRequest, false, "this is a websocket endpoint"},
+		{"GET", map[string]string{"Connection": "keep-alive", "Upgrade": "websocket"}, http.StatusBadRequest, false, "this is a websocket endpoint"},
+	} {
+		r := httptest.NewRequest(test.method, "/proxy/"+host+"/"+port, nil)
+		for k, v := range test.header {
+			r.Header.Set(k, v)
+		}
+		r = mux.SetURLVars(r, map[string]string{"host": host, "port": port})
+		w := httptest.NewRecorder()
+		handleProxy(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %v: status %d, want %d", test.method, test.header, w.Code, test.want)
+		}
+		if got := w.Header().Get("Allow") == http.MethodGet; got != test.wantAllow {
+			t.Errorf("%s %v: Allow: %q", test.method, test.header, w.Header().Get("Allow"))
+		}
+		if !strings.Contains(w.Body.String(), test.wantBody) {
+			t.Errorf("%s %v: body %q, want it to contain %q", test.method, test.header, w.Body, test.wantBody)
+		}
+	}
+	select {
+	case <-dialed:
+		t.Error("backend dialed for a request that's not a websocket upgrade")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Most of -auth_helper's output that's read.
+const maxHelperOutput = 64 << 10
+
+var (
+	authHelper        = flag.String("auth_helper", "", "Program printing the credentials for the server to stdout, instead of -auth: a username and a password line for Basic Auth, or a single token line for Bearer auth. Split on spaces into the program and its arguments; no shell is involved.")
+	authHelperTimeout = flag.Duration("auth_helper_timeout", 30*time.Second, "How long -auth_helper may take.")
+)
+
+// helperAuthorization runs -auth_helper and returns the Authorization
+// header value for what it printed. Errors never include its output.
+func helperAuthorization() (string, error) {
+	args := strings.Fields(*authHelper)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *authHelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Stdin may be the tunnel's data, so the helper doesn't get it. It may
+	// still prompt on stderr, or on the terminal.
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%q failed: %v", args[0], err)
+	}
+	// Read here rather than in cmd.Wait, which on timeout would wait for
+	// anything the helper started that still holds its stdout.
+	read := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(io.LimitReader(stdout, maxHelperOutput))
+		read <- b
+	}()
+	var out []byte
+	select {
+	case out = <-read:
+	case <-ctx.Done():
+		go cmd.Wait()
+		return "", fmt.Errorf("%q timed out after %v", args[0], *authHelperTimeout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("%q failed: %v", args[0], err)
+	}
+
+	var lines []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimRight(l, "\r"); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	switch len(lines) {
+	case 1:
+		return "Bearer " + lines[0], nil
+	case 2:
+		if strings.Contains(lines[0], ":") {
+			return "", fmt.Errorf("%q printed a username containing ':'", args[0])
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(lines[0]+":"+lines[1])), nil
+	}
+	return "", fmt.Errorf("%q printed %d lines; want a token line, or a username and a password line", args[0], len(lines))
+}
@@ -0,0 +1,105 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var authMethodList = flag.String("auth_methods", "", "Comma separated auth methods to try in order, moving on to the next when the server answers 401 or 403: 'cert' (-cert/-pem), 'basic' (-auth or -auth_helper) and 'none'. Empty sends all configured credentials at once.")
+
+// authMethod is a way of authenticating to the server: a dialer and
+// headers carrying only that method's credentials.
+type authMethod struct {
+	name   string
+	dialer *websocket.Dialer
+	head   http.Header
+}
+
+// authMethods splits the credentials in dialer and head by -auth_methods.
+// Without -auth_methods there is one method sending everything.
+func authMethods(dialer *websocket.Dialer, head http.Header) ([]authMethod, error) {
+	if *authMethodList == "" {
+		return []authMethod{{name: "default", dialer: dialer, head: head}}, nil
+	}
+	haveCert := dialer.TLSClientConfig != nil && len(dialer.TLSClientConfig.Certificates) > 0
+	haveBasic := head.Get("Authorization") != ""
+
+	var ms []authMethod
+	for _, name := range strings.Split(*authMethodList, ",") {
+		name = strings.TrimSpace(name)
+		d := *dialer
+		if d.TLSClientConfig != nil {
+			d.TLSClientConfig = d.TLSClientConfig.Clone()
+		}
+		h := head.Clone()
+		switch name {
+		case "cert":
+			if !haveCert {
+				return nil, fmt.Errorf("auth method %q needs -cert and -key, or -pem", name)
+			}
+			h.Del("Authorization")
+		case "basic":
+			if !haveBasic {
+				return nil, fmt.Errorf("auth method %q needs -auth or -auth_helper", name)
+			}
+			if d.TLSClientConfig != nil {
+				d.TLSClientConfig.Certificates = nil
+			}
+		case "none":
+			if d.TLSClientConfig != nil {
+				d.TLSClientConfig.Certificates = nil
+			}
+			h.Del("Authorization")
+		default:
+			return nil, fmt.Errorf("unknown auth method %q", name)
+		}
+		ms = append(ms, authMethod{name: name, dialer: &d, head: h})
+	}
+	return ms, nil
+}
+
+// authRefused returns true if the server turned down the credentials, as
+// opposed to failing for some other reason, which trying other
+// credentials wouldn't help with.
+func authRefused(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)
+}
+
+// dialAuth opens the tunnel with the first of methods the server accepts,
+// returning its index.
+func dialAuth(methods []authMethod, u string, retry bool) (*websocket.Conn, *http.Response, int, error) {
+	for i, m := range methods {
+		diag.setAuth(m.name)
+		conn, resp, err := dialRetry(m.dialer, u, m.head, retry)
+		if err == nil {
+			diag.setConnected()
+			if *verbose && *authMethodList != "" {
+				log.Infof("Authenticated with auth method %q", m.name)
+			}
+			return conn, resp, i, nil
+		}
+		if !authRefused(resp) || i == len(methods)-1 {
+			return nil, resp, i, err
+		}
+		log.Warningf("Server refused auth method %q with %s, trying %q", m.name, resp.Status, methods[i+1].name)
+	}
+	return nil, nil, 0, fmt.Errorf("no auth methods")
+}
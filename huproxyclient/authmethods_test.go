@@ -0,0 +1,122 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuthMethods(t *testing.T) {
+	defer func(v string) { *authMethodList = v }(*authMethodList)
+	certDialer := &websocket.Dialer{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{{}}}}
+	basicHead := http.Header{"Authorization": {"Basic YTpi"}}
+	for _, test := range []struct {
+		list    string
+		dialer  *websocket.Dialer
+		head    http.Header
+		want    []string // name, "c" with a cert, "b" with basic auth
+		wantErr string
+	}{
+		{"", certDialer, basicHead, []string{"default cb"}, ""},
+		{"cert,basic", certDialer, basicHead, []string{"cert c", "basic b"}, ""},
+		{" basic , none ", certDialer, basicHead, []string{"basic b", "none "}, ""},
+		{"none", &websocket.Dialer{}, http.Header{}, []string{"none "}, ""},
+		{"cert", &websocket.Dialer{}, basicHead, nil, "needs -cert"},
+		{"basic", certDialer, http.Header{}, nil, "needs -auth"},
+		{"cert,kerberos", certDialer, basicHead, nil, `unknown auth method "kerberos"`},
+	} {
+		*authMethodList = test.list
+		ms, err := authMethods(test.dialer, test.head)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("-auth_methods=%q: %v, want error containing %q", test.list, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-auth_methods=%q: %v", test.list, err)
+			continue
+		}
+		var got []string
+		for _, m := range ms {
+			s := m.name + " "
+			if m.dialer.TLSClientConfig != nil && len(m.dialer.TLSClientConfig.Certificates) > 0 {
+				s += "c"
+			}
+			if m.head.Get("Authorization") != "" {
+				s += "b"
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("-auth_methods=%q: got %q, want %q", test.list, got, test.want)
+		}
+	}
+	// Methods don't share what they changed.
+	if len(certDialer.TLSClientConfig.Certificates) != 1 || basicHead.Get("Authorization") == "" {
+		t.Error("authMethods changed the dialer or headers it was given")
+	}
+}
+
+func TestDialAuth(t *testing.T) {
+	var up websocket.Upgrader
+	for _, test := range []struct {
+		desc      string
+		refusal   int // answer to requests without Authorization
+		wantIndex int
+		wantErr   bool
+		wantTries int32
+	}{
+		{"falls back on 401", http.StatusUnauthorized, 1, false, 2},
+		{"falls back on 403", http.StatusForbidden, 1, false, 2},
+		{"no fallback on other errors", http.StatusBadGateway, 0, true, 1},
+	} {
+		var tries int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&tries, 1)
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "no", test.refusal)
+				return
+			}
+			if c, err := up.Upgrade(w, r, nil); err == nil {
+				c.Close()
+			}
+		}))
+		methods := []authMethod{
+			{name: "none", dialer: websocket.DefaultDialer, head: http.Header{}},
+			{name: "basic", dialer: websocket.DefaultDialer, head: http.Header{"Authorization": {"Basic YTpi"}}},
+		}
+		conn, _, i, err := dialAuth(methods, "ws"+strings.TrimPrefix(srv.URL, "http"), false)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: dialAuth: %v, want error %v", test.desc, err, test.wantErr)
+		}
+		if i != test.wantIndex {
+			t.Errorf("%s: dialAuth used method %d, want %d", test.desc, i, test.wantIndex)
+		}
+		if tries != test.wantTries {
+			t.Errorf("%s: %d requests, want %d", test.desc, tries, test.wantTries)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var base64IO = flag.Bool("base64_io", false, "Read stdin as lines of base64, and write what's received to stdout as lines of base64, for pipes that can't carry binary data. Only a local transform; the server sees the decoded bytes.")
+
+// base64Reader decodes lines of base64, each padded on its own.
+type base64Reader struct {
+	r    *bufio.Reader
+	line int
+	buf  []byte
+}
+
+func newBase64Reader(r io.Reader) *base64Reader {
+	return &base64Reader{r: bufio.NewReader(r)}
+}
+
+func (r *base64Reader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		s, err := r.r.ReadString('\n')
+		if s != "" {
+			r.line++
+			if s = strings.TrimSpace(s); s != "" {
+				d, derr := base64.StdEncoding.DecodeString(s)
+				if derr != nil {
+					return 0, fmt.Errorf("stdin line %d isn't base64: %v", r.line, derr)
+				}
+				r.buf = d
+			}
+		}
+		if err != nil {
+			if len(r.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// base64Writer writes each chunk as a line of base64.
+type base64Writer struct {
+	w io.Writer
+}
+
+func (w *base64Writer) Write(b []byte) (int, error) {
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(b))+1)
+	base64.StdEncoding.Encode(line, b)
+	line[len(line)-1] = '\n'
+	if _, err := w.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBase64RoundTrip(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, test := range []struct {
+		desc string
+		data []byte
+		// Lengths of the writes, the last repeated until all is written.
+		writes []int
+	}{
+		{"all bytes at once", all, []int{len(all)}},
+		{"all bytes a byte at a time", all, []int{1}},
+		{"all bytes in threes", all, []int{3}},
+		{"all bytes at odd points", all, []int{5, 1, 100, 2, 7}},
+		{"not a multiple of 3", all[:200], []int{200}},
+		{"two bytes over a multiple of 3", all[:47], []int{13, 31, 3}},
+		{"one byte", all[7:8], []int{1}},
+	} {
+		var enc bytes.Buffer
+		w := &base64Writer{w: &enc}
+		rest, writes := test.data, test.writes
+		lines := 0
+		for ; len(rest) > 0; lines++ {
+			n := writes[0]
+			if len(writes) > 1 {
+				writes = writes[1:]
+			}
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if got, err := w.Write(rest[:n]); err != nil || got != n {
+				t.Fatalf("%s: Write = %d, %v, want %d", test.desc, got, err, n)
+			}
+			rest = rest[n:]
+		}
+		if got := strings.Count(enc.String(), "\n"); got != lines {
+			t.Errorf("%s: got %d lines for %d writes", test.desc, got, lines)
+		}
+
+		// Also read back in reads smaller than the lines.
+		for _, oneByte := range []bool{false, true} {
+			r := newBase64Reader(bytes.NewReader(enc.Bytes()))
+			var got []byte
+			var err error
+			if oneByte {
+				got, err = ioutil.ReadAll(iotest.OneByteReader(r))
+			} else {
+				got, err = ioutil.ReadAll(r)
+			}
+			if err != nil {
+				t.Errorf("%s: %v", test.desc, err)
+			}
+			if !bytes.Equal(got, test.data) {
+				t.Errorf("%s: got %x back, want %x", test.desc, got, test.data)
+			}
+		}
+	}
+}
+
+func TestBase64Reader(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"aGVsbG8=\n", "hello", ""},
+		{"aGVs\nbG8=\n", "hello", ""},
+		{"aGVsbG8=", "hello", ""},
+		{"aGVs\r\n\r\nbG8=\r\n", "hello", ""},
+		{"aGVs\nnot base64!\n", "hel", "stdin line 2 isn't base64"},
+		{"aGVsbG8\n", "", "stdin line 1 isn't base64"},
+	} {
+		got, err := ioutil.ReadAll(newBase64Reader(strings.NewReader(test.in)))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%q: got error %v, want %q", test.in, err, test.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var (
+	batchFile        = flag.String("batch", "", "Instead of tunneling stdin/stdout, run through the targets in this file, one \"host:port [input-file]\" per line. The arg is then the server URL up to the host, as for -probe.")
+	batchConcurrency = flag.Int("batch_concurrency", 4, "In -batch mode, how many targets to run at once.")
+	batchTimeout     = flag.Duration("batch_timeout", 30*time.Second, "In -batch mode, timeout for each target.")
+)
+
+// batchTarget is one line of the -batch file. Without an input file the
+// target is only checked for reachability, like -probe does.
+type batchTarget struct {
+	host, port string
+	input      string
+}
+
+type batchResult struct {
+	Target        string  `json:"target"`
+	Input         string  `json:"input,omitempty"`
+	OK            bool    `json:"ok"`
+	LatencyMS     float64 `json:"latency_ms"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// readBatch parses the -batch file. Blank lines and lines starting with
+// '#' are skipped.
+func readBatch(fn string) ([]batchTarget, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ts []batchTarget
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs := strings.Fields(line)
+		if len(fs) > 2 {
+			return nil, fmt.Errorf("%s:%d: want \"host:port [input-file]\", got %q", fn, n, line)
+		}
+		host, port, err := net.SplitHostPort(fs[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, n, err)
+		}
+		t := batchTarget{host: host, port: port}
+		if len(fs) == 2 {
+			t.input = fs[1]
+		}
+		ts = append(ts, t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// sendBatchInput tunnels the contents of fn to u, then closes the tunnel
+// and waits for the server to confirm. Whatever comes back until then is
+// counted and discarded.
+func sendBatchInput(dialer *websocket.Dialer, head http.Header, u, fn string, res *batchResult) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conn, resp, err := dialer.Dial(u, head)
+	if err != nil {
+		return errors.New(dialErrorString(u, resp, err))
+	}
+	defer conn.Close()
+	if err := checkServerVersion(u, resp); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *batchTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// websocket -> discard
+	recvDone := make(chan error, 1)
+	go func() {
+		for {
+			mt, r, err := conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				recvDone <- nil
+				return
+			}
+			if err != nil {
+				recvDone <- huproxy.ReadError(err)
+				return
+			}
+			if mt == websocket.TextMessage {
+				// Server -text_keepalive.
+				continue
+			}
+			if mt != websocket.BinaryMessage {
+				recvDone <- huproxy.ErrNonBinaryMessage
+				return
+			}
+			n, err := io.Copy(io.Discard, r)
+			res.BytesReceived += n
+			if err != nil {
+				recvDone <- err
+				return
+			}
+		}
+	}()
+
+	// file -> websocket. File2WSOptions cancels its context when done, so
+	// it gets its own.
+	src := &countingReader{r: f}
+	sctx, scancel := context.WithCancel(ctx)
+	err = huproxy.File2WSOptions(sctx, scancel, src, conn, copyOptions())
+	res.BytesSent = atomic.LoadInt64(&src.n)
+	if err == io.EOF {
+		err = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(*writeTimeout))
+	}
+	if err == nil {
+		err = <-recvDone
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", *batchTimeout)
+	}
+	return err
+}
+
+func runBatchTarget(dialer *websocket.Dialer, head http.Header, base string, t batchTarget) batchResult {
+	res := batchResult{
+		Target: net.JoinHostPort(t.host, t.port),
+		Input:  t.input,
+	}
+	u := fmt.Sprintf("%s/%s/%s", base, t.host, t.port)
+	start := time.Now()
+	var err error
+	if t.input == "" {
+		err = checkTunnel(dialer, head, u)
+	} else {
+		err = sendBatchInput(dialer, head, u, t.input, &res)
+	}
+	res.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	res.OK = err == nil
+	if err != nil {
+		res.Error = strings.TrimSpace(err.Error())
+	}
+	return res
+}
+
+// runBatch runs the -batch targets, up to -batch_concurrency at a time,
+// printing a JSON line for each as it finishes. It exits nonzero if any
+// target failed.
+func runBatch(dialer *websocket.Dialer, head http.Header, base string) {
+	targets, err := readBatch(*batchFile)
+	if err != nil {
+		log.Fatalf("Reading -batch: %v", err)
+	}
+	if *batchConcurrency < 1 {
+		log.Fatalf("-batch_concurrency must be at least 1")
+	}
+	d := *dialer
+	d.HandshakeTimeout = *batchTimeout
+	base = strings.TrimSuffix(base, "/")
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	enc := json.NewEncoder(os.Stdout)
+	sem := make(chan struct{}, *batchConcurrency)
+	for _, t := range targets {
+		t := t
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := runBatchTarget(&d, head, base, t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !res.OK {
+				failed++
+			}
+			if err := enc.Encode(res); err != nil {
+				log.Fatalf("Writing result: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		log.Warningf("%d of %d targets failed", failed, len(targets))
+		os.Exit(1)
+	}
+}
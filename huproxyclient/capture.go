@@ -0,0 +1,168 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Capture file format: the 8 bytes "HUPXCAP1", then one record per read
+// from stdin or from the tunnel:
+//
+//	8 bytes  time, nanoseconds since the Unix epoch, big endian
+//	1 byte   direction: '>' sent to the server, '<' received from it
+//	4 bytes  length of the data, big endian
+//	data
+const captureMagic = "HUPXCAP1"
+
+const (
+	captureSent     = '>'
+	captureReceived = '<'
+)
+
+// Records that can wait to be written before new ones are dropped.
+const captureQueue = 1024
+
+// How often to report dropped records.
+const captureDropLogInterval = 10 * time.Second
+
+var captureFile = flag.String("capture", "", "Also write everything sent and received through the tunnel to this file, with timestamps. See the README for the format. Records are dropped, with a warning, if writing falls behind.")
+
+type captureRecord struct {
+	t    time.Time
+	dir  byte
+	data []byte
+}
+
+// capture writes records in the background, so that a slow disk never
+// holds up the tunnel.
+type capture struct {
+	done chan struct{}
+
+	mu sync.Mutex
+	// Nil once closed.
+	ch      chan captureRecord
+	dropped int
+	lastLog time.Time
+}
+
+func openCapture(fn string) (*capture, error) {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(captureMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c := &capture{
+		ch:   make(chan captureRecord, captureQueue),
+		done: make(chan struct{}),
+	}
+	go c.write(c.ch, f, w)
+	return c, nil
+}
+
+func (c *capture) write(ch <-chan captureRecord, f *os.File, w *bufio.Writer) {
+	defer close(c.done)
+	var hdr [13]byte
+	failed := false
+	for r := range ch {
+		if failed {
+			continue
+		}
+		binary.BigEndian.PutUint64(hdr[0:8], uint64(r.t.UnixNano()))
+		hdr[8] = r.dir
+		binary.BigEndian.PutUint32(hdr[9:13], uint32(len(r.data)))
+		w.Write(hdr[:])
+		w.Write(r.data)
+		// Keep the file current while the tunnel is idle.
+		if len(ch) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Warningf("Writing -capture file, no longer capturing: %v", err)
+				failed = true
+			}
+		}
+	}
+	if !failed {
+		if err := w.Flush(); err != nil {
+			log.Warningf("Writing -capture file: %v", err)
+		}
+	}
+	f.Close()
+}
+
+// record queues a copy of b, or drops it if the writer is behind.
+func (c *capture) record(dir byte, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	r := captureRecord{t: time.Now(), dir: dir, data: append([]byte(nil), b...)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		return
+	}
+	select {
+	case c.ch <- r:
+	default:
+		c.dropped++
+		if time.Since(c.lastLog) >= captureDropLogInterval {
+			log.Warningf("Capture file can't keep up, %d records dropped", c.dropped)
+			c.lastLog = time.Now()
+		}
+	}
+}
+
+// close writes out what's queued. Records after close are dropped.
+func (c *capture) close() {
+	c.mu.Lock()
+	ch := c.ch
+	c.ch = nil
+	c.mu.Unlock()
+	if ch != nil {
+		close(ch)
+		<-c.done
+	}
+}
+
+type captureReader struct {
+	c *capture
+	r io.Reader
+}
+
+func (r *captureReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.c.record(captureSent, b[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	c *capture
+	w io.Writer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.c.record(captureReceived, b)
+	return w.w.Write(b)
+}
@@ -0,0 +1,161 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+	"github.com/gorilla/websocket"
+)
+
+func TestServerEnded(t *testing.T) {
+	closed := func(code int, text string) error {
+		return huproxy.ReadError(&websocket.CloseError{Code: code, Text: text})
+	}
+	for _, test := range []struct {
+		desc   string
+		reason huproxy.EndReason
+		err    error
+		want   bool
+	}{
+		{"idle timeout", huproxy.EndReadFailed, closed(websocket.CloseGoingAway, "idle timeout"), true},
+		{"admin", huproxy.EndReadFailed, closed(websocket.CloseGoingAway, "terminated by admin"), true},
+		{"normal with reason", huproxy.EndReadFailed, closed(websocket.CloseNormalClosure, "max runtime reached"), true},
+		{"going away without reason", huproxy.EndReadFailed, closed(websocket.CloseGoingAway, ""), false},
+		{"internal error", huproxy.EndReadFailed, closed(websocket.CloseInternalServerErr, "oops"), false},
+		{"network error", huproxy.EndReadFailed, errors.New("connection reset by peer"), false},
+		{"peer closed", huproxy.EndPeerClosed, nil, false},
+		{"restart", huproxy.EndPeerRestart, closed(websocket.CloseServiceRestart, "server restarting"), false},
+	} {
+		got := serverEnded(&huproxy.BridgeResult{Reason: test.reason, Err: test.err})
+		if (got != nil) != test.want {
+			t.Errorf("%s: serverEnded = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+// testChain returns a private key and its certificate signed by an
+// intermediate CA, all PEM encoded, and the DER of both certificates.
+func testChain(t *testing.T) (key, leaf, intermediate []byte, certs [][]byte) {
+	t.Helper()
+	var parent *x509.Certificate
+	var parentKey *ecdsa.PrivateKey
+	for i, name := range []string{"root", "intermediate", "leaf"} {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  name != "leaf",
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, k
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &k.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent, err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+		parentKey = k
+		switch name {
+		case "intermediate":
+			intermediate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			certs = append(certs, der)
+		case "leaf":
+			leaf = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			certs = append([][]byte{der}, certs...)
+			b, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+		}
+	}
+	return key, leaf, intermediate, certs
+}
+
+func TestLoadCombinedPEM(t *testing.T) {
+	defer func(v bool) { *noPermCheck = v }(*noPermCheck)
+	*noPermCheck = false
+	key, leaf, intermediate, certs := testChain(t)
+	dir := t.TempDir()
+	for _, test := range []struct {
+		desc    string
+		blocks  [][]byte
+		perm    os.FileMode
+		want    [][]byte
+		wantErr string
+	}{
+		{"key then chain", [][]byte{key, leaf, intermediate}, 0600, certs, ""},
+		{"chain then key", [][]byte{leaf, intermediate, key}, 0600, certs, ""},
+		{"key within the chain", [][]byte{leaf, key, intermediate}, 0600, certs, ""},
+		{"leaf only", [][]byte{key, leaf}, 0400, certs[:1], ""},
+		{"no key", [][]byte{leaf, intermediate}, 0600, nil, "PRIVATE KEY"},
+		{"no certificate", [][]byte{key}, 0600, nil, "certificate"},
+		{"group readable", [][]byte{key, leaf, intermediate}, 0640, nil, "valid permissions"},
+		{"world readable", [][]byte{key, leaf, intermediate}, 0644, nil, "valid permissions"},
+	} {
+		fn := filepath.Join(dir, strings.ReplaceAll(test.desc, " ", "_")+".pem")
+		if err := ioutil.WriteFile(fn, bytes.Join(test.blocks, nil), test.perm); err != nil {
+			t.Fatal(err)
+		}
+		// Not subject to the umask.
+		if err := os.Chmod(fn, test.perm); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := loadCombinedPEM(fn)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if len(cert.Certificate) != len(test.want) {
+			t.Errorf("%s: got %d certificates, want %d", test.desc, len(cert.Certificate), len(test.want))
+			continue
+		}
+		for i := range test.want {
+			if !bytes.Equal(cert.Certificate[i], test.want[i]) {
+				t.Errorf("%s: certificate %d isn't the one expected", test.desc, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long -diag_on_fail waits for resolving the server name.
+const diagResolveTimeout = 2 * time.Second
+
+var diagOnFail = flag.Bool("diag_on_fail", false, "If the client fails, write a short summary of the server, transport, auth method and kind of failure to stderr. For ProxyCommand, where SSH shows little else. No secrets are included.")
+
+// diagState is what -diag_on_fail reports.
+type diagState struct {
+	mu        sync.Mutex
+	gateway   string
+	scheme    string
+	auth      string
+	category  string
+	connected bool
+	failed    bool
+}
+
+var diag diagState
+
+// setupDiag prepares -diag_on_fail for the server at u.
+func setupDiag(u string) {
+	if !*diagOnFail {
+		return
+	}
+	diag.scheme = "?"
+	if pu, err := url.Parse(u); err == nil {
+		diag.scheme = pu.Scheme
+		port := pu.Port()
+		if port == "" {
+			port = "80"
+			if pu.Scheme == "wss" {
+				port = "443"
+			}
+		}
+		diag.gateway = net.JoinHostPort(pu.Hostname(), port)
+	}
+	var auth []string
+	if *certFile != "" || *pemFile != "" {
+		auth = append(auth, "cert")
+	}
+	if *basicAuth != "" {
+		auth = append(auth, "basic")
+	}
+	if *authHelper != "" {
+		auth = append(auth, "auth helper")
+	}
+	if len(auth) == 0 {
+		auth = append(auth, "none")
+	}
+	diag.auth = strings.Join(auth, "+")
+	log.AddHook(&diag)
+	log.RegisterExitHandler(diag.report)
+}
+
+// setAuth records the auth method being tried.
+func (d *diagState) setAuth(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if name != "default" {
+		d.auth = name
+	}
+}
+
+func (d *diagState) setConnected() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connected = true
+}
+
+// setDialError records what kind of failure opening the tunnel was.
+func (d *diagState) setDialError(resp *http.Response, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.category = dialErrorCategory(resp, err)
+}
+
+func dialErrorCategory(resp *http.Response, err error) string {
+	var (
+		ve   *versionError
+		pe   *proxyError
+		dnse *net.DNSError
+		uae  x509.UnknownAuthorityError
+		hne  x509.HostnameError
+		cie  x509.CertificateInvalidError
+		ne   net.Error
+	)
+	switch {
+	case errors.As(err, &ve):
+		return "server too old for -min_server_version"
+	case errors.As(err, &pe):
+		return fmt.Sprintf("forward proxy refused the connection (%s)", pe.status)
+	case resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		return fmt.Sprintf("server refused auth or destination (HTTP %d)", resp.StatusCode)
+	case resp != nil && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout):
+		return fmt.Sprintf("server couldn't reach the destination (HTTP %d)", resp.StatusCode)
+	case resp != nil:
+		return fmt.Sprintf("server refused the upgrade (HTTP %d)", resp.StatusCode)
+	case errors.As(err, &dnse):
+		return "server name resolution failed"
+	case errors.As(err, &uae), errors.As(err, &hne), errors.As(err, &cie):
+		return "server certificate not trusted"
+	case err != nil && strings.Contains(err.Error(), "tls:"):
+		return "TLS handshake failed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timed out connecting to server"
+	}
+	return "couldn't connect to server"
+}
+
+// Levels and Fire make diagState a logrus hook, noting that something
+// failed.
+func (d *diagState) Levels() []log.Level { return []log.Level{log.ErrorLevel, log.FatalLevel} }
+
+func (d *diagState) Fire(*log.Entry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failed = true
+	return nil
+}
+
+func (d *diagState) transport() string {
+	var t []string
+	switch {
+	case d.scheme == "ws":
+		t = append(t, "ws (plaintext)")
+	case *insecure:
+		t = append(t, "wss, certificate not verified (-insecure_conn)")
+	default:
+		t = append(t, "wss, certificate verified")
+	}
+	if *fwProxyURL != "" {
+		if pu, err := url.Parse(*fwProxyURL); err == nil {
+			t = append(t, fmt.Sprintf("via forward proxy %s://%s", pu.Scheme, pu.Host))
+		}
+	}
+	if *sshJump != "" {
+		host := *sshJump
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		t = append(t, "via SSH jump host "+host)
+	}
+	return strings.Join(t, ", ")
+}
+
+// report writes the diagnostics, if anything failed.
+func (d *diagState) report() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.failed {
+		return
+	}
+	resolved := "not resolved"
+	if host, _, err := net.SplitHostPort(d.gateway); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), diagResolveTimeout)
+		defer cancel()
+		if addrs, err := net.DefaultResolver.LookupHost(ctx, host); err == nil {
+			resolved = "resolves to " + strings.Join(addrs, ", ")
+		}
+	}
+	category := d.category
+	switch {
+	case category != "":
+	case d.connected:
+		category = "tunnel failed after opening, see the error above"
+	default:
+		category = "see the error above"
+	}
+	fmt.Fprintf(os.Stderr, "huproxyclient diagnostics:\n"+
+		"  gateway:   %s (%s)\n"+
+		"  transport: %s\n"+
+		"  auth:      %s\n"+
+		"  failure:   %s\n",
+		d.gateway, resolved, d.transport(), d.auth, category)
+}
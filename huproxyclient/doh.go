@@ -0,0 +1,153 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Largest DNS response read from a -doh server.
+const maxDoHResponse = 64 << 10
+
+var (
+	dohURL     = flag.String("doh", "", "Resolve the server's hostname, and that of a forward proxy or -ssh_jump host, with this DNS-over-HTTPS URL (RFC 8484) instead of the system resolver, e.g. https://1.1.1.1/dns-query. Certificates are still checked against the hostname.")
+	dohTimeout = flag.Duration("doh_timeout", 5*time.Second, "Timeout for each -doh request.")
+)
+
+// dohDialer wraps dial to resolve hostnames with -doh, trying the
+// addresses in turn. Without -doh it returns dial.
+func dohDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if *dohURL == "" {
+		return dial, nil
+	}
+	u, err := url.Parse(*dohURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("want an https:// URL, got %q", *dohURL)
+	}
+	client := &http.Client{Timeout: *dohTimeout}
+	// The Go resolver builds the queries and parses the answers, including
+	// /etc/hosts and search domains; only the transport is DoH.
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, url: u.String()}, nil
+		},
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			// The error names the system name server that wasn't asked.
+			var dnse *net.DNSError
+			if errors.As(err, &dnse) {
+				err = errors.New(dnse.Err)
+			}
+			return nil, fmt.Errorf("resolving %q with -doh %s: %v", host, *dohURL, err)
+		}
+		var last error
+		for _, ip := range ips {
+			c, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return c, nil
+			}
+			last = err
+		}
+		return nil, last
+	}, nil
+}
+
+// dohConn carries the Go resolver's DNS queries over HTTPS. Not being a
+// net.PacketConn, it gets the TCP framing of a two byte length before
+// each message, both ways.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	resp     bytes.Buffer
+	deadline time.Time
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("-doh: partial DNS query")
+	}
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("-doh server answered %s", resp.Status)
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponse+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > maxDoHResponse {
+		return 0, errors.New("-doh server answer too large")
+	}
+	c.resp.Reset()
+	binary.Write(&c.resp, binary.BigEndian, uint16(len(msg)))
+	c.resp.Write(msg)
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.resp.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.resp.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return *dohURL }
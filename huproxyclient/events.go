@@ -0,0 +1,188 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events that can wait to be written before new ones are dropped.
+const eventQueue = 256
+
+// The first "bytes" event is sent once this much has been tunneled in
+// total, then each time the total doubles.
+const firstByteMilestone = 1 << 20
+
+var eventFD = flag.Int("event_fd", -1, "Write JSON lines describing the tunnel's progress to this already open file descriptor, e.g. 3. See the README for the events. -1 disables.")
+
+// clientEvent is one line written to -event_fd.
+type clientEvent struct {
+	Event         string `json:"event"`
+	Time          string `json:"time"`
+	URL           string `json:"url,omitempty"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	Error         string `json:"error,omitempty"`
+}
+
+// eventLog writes events in the background, so that a slow reader of
+// -event_fd never holds up the tunnel. A nil *eventLog drops everything.
+type eventLog struct {
+	url  string
+	done chan struct{}
+
+	sent, received int64
+	milestone      int64
+
+	mu sync.Mutex
+	// Nil once closed.
+	ch chan clientEvent
+}
+
+// events is nil without -event_fd.
+var events *eventLog
+
+func openEvents(fd int, url string) (*eventLog, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, err
+	}
+	e := &eventLog{
+		url:       url,
+		done:      make(chan struct{}),
+		milestone: firstByteMilestone,
+		ch:        make(chan clientEvent, eventQueue),
+	}
+	go e.write(e.ch, f)
+	// Logged errors are sent as "error" events.
+	log.AddHook(e)
+	return e, nil
+}
+
+func (e *eventLog) write(ch <-chan clientEvent, f *os.File) {
+	defer close(e.done)
+	enc := json.NewEncoder(f)
+	for ev := range ch {
+		if err := enc.Encode(ev); err != nil {
+			log.Warningf("Writing -event_fd, no longer sending events: %v", err)
+			break
+		}
+	}
+	for range ch {
+	}
+}
+
+// emit queues an event, or drops it if the writer is behind.
+func (e *eventLog) emit(name, errMsg string) {
+	if e == nil {
+		return
+	}
+	ev := clientEvent{
+		Event:         name,
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		URL:           e.url,
+		BytesSent:     atomic.LoadInt64(&e.sent),
+		BytesReceived: atomic.LoadInt64(&e.received),
+		Error:         errMsg,
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ch == nil {
+		return
+	}
+	select {
+	case e.ch <- ev:
+	default:
+	}
+}
+
+// count adds n bytes to *p, sending a "bytes" event at each milestone.
+func (e *eventLog) count(p *int64, n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(p, int64(n))
+	total := atomic.LoadInt64(&e.sent) + atomic.LoadInt64(&e.received)
+	m := atomic.LoadInt64(&e.milestone)
+	if total < m {
+		return
+	}
+	next := m
+	for next <= total {
+		next *= 2
+	}
+	if atomic.CompareAndSwapInt64(&e.milestone, m, next) {
+		e.emit("bytes", "")
+	}
+}
+
+// close sends the "closed" event and writes out what's queued. Events
+// after close are dropped.
+func (e *eventLog) close() {
+	if e == nil {
+		return
+	}
+	e.emit("closed", "")
+	e.mu.Lock()
+	ch := e.ch
+	e.ch = nil
+	e.mu.Unlock()
+	if ch != nil {
+		close(ch)
+		<-e.done
+	}
+}
+
+// Levels and Fire make eventLog a logrus hook, sending logged errors as
+// "error" events.
+func (e *eventLog) Levels() []log.Level { return []log.Level{log.ErrorLevel, log.FatalLevel} }
+
+func (e *eventLog) Fire(entry *log.Entry) error {
+	e.emit("error", entry.Message)
+	return nil
+}
+
+type eventReader struct {
+	e *eventLog
+	r io.Reader
+}
+
+func (r *eventReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.e.count(&r.e.sent, n)
+	return n, err
+}
+
+type eventWriter struct {
+	e *eventLog
+	w io.Writer
+}
+
+func (w *eventWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.e.count(&w.e.received, n)
+	return n, err
+}
@@ -0,0 +1,393 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var (
+	listenAddr      = flag.String("listen", "", "Instead of using stdin/stdout, accept TCP connections on this address and tunnel each one. Several server URLs may then be given.")
+	probeInterval   = flag.Duration("probe_interval", 30*time.Second, "In -listen mode, how often to probe healthy servers.")
+	probeTimeout    = flag.Duration("probe_timeout", 10*time.Second, "In -listen mode, timeout for probing a server.")
+	probeMaxBackoff = flag.Duration("probe_max_backoff", 5*time.Minute, "In -listen mode, max time between probes of an unhealthy server.")
+	localhostOnly   = flag.Bool("listen_only_localhost", true, "Refuse to -listen or -status_listen on anything but loopback addresses.")
+	statusListen    = flag.String("status_listen", "", "In -listen mode, address to serve server health on, as JSON.")
+	lbStrategy      = flag.String("lb_strategy", "failover", "In -listen mode, which healthy server gets each new connection: 'failover' the first given, 'round-robin' each in turn, 'least-connections' the one with the fewest open tunnels.")
+)
+
+// endpoint is one huproxy server URL in -listen mode, with its health as
+// seen by probes and by real tunnels.
+type endpoint struct {
+	url string
+
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	lastErr   string
+	lastCheck time.Time
+	// Tunnels open through it.
+	active int
+}
+
+type endpointStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	Active    int       `json:"active"`
+}
+
+// mark records the outcome of a dial to the endpoint.
+func (e *endpoint) mark(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastCheck = time.Now()
+	if err == nil {
+		if !e.healthy {
+			log.Infof("Server %q is healthy", e.url)
+		}
+		e.healthy = true
+		e.failures = 0
+		e.lastErr = ""
+		return
+	}
+	if e.healthy {
+		log.Warningf("Server %q is unhealthy: %v", e.url, err)
+	}
+	e.healthy = false
+	e.failures++
+	e.lastErr = err.Error()
+}
+
+func (e *endpoint) isHealthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy
+}
+
+func (e *endpoint) addActive(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.active += n
+}
+
+func (e *endpoint) activeCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.active
+}
+
+// nextProbe returns how long to wait before probing again. Unhealthy
+// endpoints are retried with exponential backoff.
+func (e *endpoint) nextProbe() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.healthy {
+		return *probeInterval
+	}
+	d := time.Second
+	for i := 1; i < e.failures && d < *probeMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > *probeMaxBackoff {
+		d = *probeMaxBackoff
+	}
+	return d
+}
+
+func (e *endpoint) status() endpointStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return endpointStatus{
+		URL:       e.url,
+		Healthy:   e.healthy,
+		Failures:  e.failures,
+		LastError: e.lastErr,
+		LastCheck: e.lastCheck,
+		Active:    e.active,
+	}
+}
+
+// forwarder accepts local connections and tunnels each of them to a
+// healthy endpoint picked by -lb_strategy.
+type forwarder struct {
+	dialer      *websocket.Dialer
+	probeDialer *websocket.Dialer
+	header      http.Header
+	endpoints   []*endpoint
+
+	// Connections so far, for round-robin.
+	next uint32
+}
+
+func checkLBStrategy() error {
+	switch *lbStrategy {
+	case "failover", "round-robin", "least-connections":
+		return nil
+	}
+	return fmt.Errorf("invalid -lb_strategy %q", *lbStrategy)
+}
+
+func (f *forwarder) dial(d *websocket.Dialer, e *endpoint) (*websocket.Conn, error) {
+	conn, resp, err := d.Dial(e.url, f.header)
+	if err != nil {
+		err = errors.New(dialErrorString(e.url, resp, err))
+	} else if err = checkServerVersion(e.url, resp); err != nil {
+		conn.Close()
+		conn = nil
+	}
+	e.mark(err)
+	return conn, err
+}
+
+// probe checks an endpoint by opening a tunnel and closing it again.
+func (f *forwarder) probe(e *endpoint) {
+	for {
+		conn, err := f.dial(f.probeDialer, e)
+		if err == nil {
+			if err := conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(*writeTimeout)); err == nil {
+				huproxy.DrainClose(conn, huproxy.DefaultDrainTimeout)
+			}
+			conn.Close()
+		}
+		time.Sleep(e.nextProbe())
+	}
+}
+
+// order returns the healthy endpoints in the order -lb_strategy prefers
+// them.
+func (f *forwarder) order(healthy []*endpoint) []*endpoint {
+	switch *lbStrategy {
+	case "round-robin":
+		if len(healthy) > 0 {
+			i := int((atomic.AddUint32(&f.next, 1) - 1) % uint32(len(healthy)))
+			healthy = append(healthy[i:], healthy[:i]...)
+		}
+	case "least-connections":
+		active := make(map[*endpoint]int, len(healthy))
+		for _, e := range healthy {
+			active[e] = e.activeCount()
+		}
+		sort.SliceStable(healthy, func(i, j int) bool { return active[healthy[i]] < active[healthy[j]] })
+	}
+	return healthy
+}
+
+// connect tries the healthy endpoints, then the unhealthy ones in order.
+// The tunnel is counted as active on its endpoint from the start of the
+// dial, so that concurrent connects spread out under least-connections;
+// the caller must addActive(-1) when done with it.
+func (f *forwarder) connect() (*websocket.Conn, *endpoint, error) {
+	var healthy, unhealthy []*endpoint
+	for _, e := range f.endpoints {
+		if e.isHealthy() {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	var err error
+	for _, e := range append(f.order(healthy), unhealthy...) {
+		var conn *websocket.Conn
+		e.addActive(1)
+		if conn, err = f.dial(f.dialer, e); err == nil {
+			return conn, e, nil
+		}
+		e.addActive(-1)
+	}
+	return nil, nil, err
+}
+
+func (f *forwarder) handle(c net.Conn) {
+	defer c.Close()
+	conn, e, err := f.connect()
+	if err != nil {
+		log.Warningf("No server reachable for connection from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	defer e.addActive(-1)
+	pipe(conn, c)
+}
+
+func (f *forwarder) serveStatus(w http.ResponseWriter, r *http.Request) {
+	var st []endpointStatus
+	for _, e := range f.endpoints {
+		st = append(st, e.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Warningf("Writing status: %v", err)
+	}
+}
+
+// pipe copies data both ways between the websocket and a local
+// connection until either side closes.
+func pipe(conn *websocket.Conn, c net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		c.Close()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	// websocket -> local
+	var dst io.Writer = c
+	if bandwidth != nil {
+		dst = huproxy.NewRateLimitedWriter(ctx, c, bandwidth)
+	}
+	go func() {
+		defer cancel()
+		for {
+			mt, r, err := conn.NextReader()
+			if ctx.Err() != nil || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return
+			}
+			if err != nil {
+				log.Warningf("Reading from websocket: %v", huproxy.ReadError(err))
+				return
+			}
+			if mt == websocket.TextMessage {
+				// Server -text_keepalive.
+				continue
+			}
+			if mt != websocket.BinaryMessage {
+				log.Warning(huproxy.ErrNonBinaryMessage)
+				return
+			}
+			if _, err := io.Copy(dst, r); err != nil {
+				if ctx.Err() == nil {
+					log.Warningf("Writing to %v: %v", c.RemoteAddr(), err)
+				}
+				return
+			}
+		}
+	}()
+
+	// local -> websocket
+	if err := huproxy.File2WSOptions(ctx, cancel, c, conn, copyOptions()); err == io.EOF {
+		if err := conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(*writeTimeout)); err != nil && err != websocket.ErrCloseSent {
+			log.Warningf("Error sending 'close' message: %v", err)
+		}
+	} else if we := (*huproxy.WriteError)(nil); errors.As(err, &we) {
+		log.Warningf("Forwarding %v: %v", c.RemoteAddr(), err)
+	} else if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Warningf("Reading from %v: %v", c.RemoteAddr(), err)
+	}
+}
+
+// checkLoopback returns an error if listening on addr would accept
+// connections from other hosts. Port 0 picks a free port.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("%q listens on all interfaces", addr)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return fmt.Errorf("%q is not a loopback address", addr)
+		}
+	}
+	return nil
+}
+
+// listenLocal listens on addr, enforcing -listen_only_localhost.
+func listenLocal(addr string) (net.Listener, error) {
+	if *localhostOnly {
+		if err := checkLoopback(addr); err != nil {
+			return nil, fmt.Errorf("%v; use -listen_only_localhost=false to allow that", err)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// runForward serves -listen mode, with the given server URLs to choose
+// from for each new connection.
+func runForward(dialer *websocket.Dialer, head http.Header, urls []string) {
+	if err := checkLBStrategy(); err != nil {
+		log.Fatal(err)
+	}
+	pd := *dialer
+	pd.HandshakeTimeout = *probeTimeout
+	f := &forwarder{
+		dialer:      dialer,
+		probeDialer: &pd,
+		header:      head,
+	}
+	for _, u := range urls {
+		e := &endpoint{url: u, healthy: true}
+		f.endpoints = append(f.endpoints, e)
+		go f.probe(e)
+	}
+
+	if *statusListen != "" {
+		sl, err := listenLocal(*statusListen)
+		if err != nil {
+			log.Fatalf("Failed to listen on %q: %v", *statusListen, err)
+		}
+		log.Infof("Serving status on %v", sl.Addr())
+		go func() {
+			log.Fatal(http.Serve(sl, http.HandlerFunc(f.serveStatus)))
+		}()
+	}
+
+	l, err := listenLocal(*listenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %q: %v", *listenAddr, err)
+	}
+	// Reported also to print the port picked for port 0, on stdout as
+	// well, which the tunnels don't use, for scripts and -quiet.
+	log.Infof("Listening on %v", l.Addr())
+	fmt.Println(l.Addr())
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatalf("Accept: %v", err)
+		}
+		go f.handle(c)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	for _, test := range []struct {
+		addr    string
+		wantErr string
+	}{
+		{"127.0.0.1:2222", ""},
+		{"127.0.0.1:0", ""},
+		{"[::1]:0", ""},
+		{"localhost:0", ""},
+		{":2222", "all interfaces"},
+		{"0.0.0.0:2222", "not a loopback address"},
+		{"[::]:0", "not a loopback address"},
+		{"192.0.2.1:2222", "not a loopback address"},
+		{"127.0.0.1", "missing port"},
+	} {
+		err := checkLoopback(test.addr)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkLoopback(%q): %v", test.addr, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("checkLoopback(%q) = %v, want error containing %q", test.addr, err, test.wantErr)
+		}
+	}
+}
+
+func TestListenLocal(t *testing.T) {
+	defer func(v bool) { *localhostOnly = v }(*localhostOnly)
+	for _, test := range []struct {
+		addr          string
+		localhostOnly bool
+		wantErr       bool
+	}{
+		{"127.0.0.1:0", true, false},
+		{"0.0.0.0:0", true, true},
+		{":0", true, true},
+		{"0.0.0.0:0", false, false},
+		{":0", false, false},
+	} {
+		*localhostOnly = test.localhostOnly
+		l, err := listenLocal(test.addr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("listenLocal(%q) with -listen_only_localhost=%v: %v, want error %v", test.addr, test.localhostOnly, err, test.wantErr)
+		}
+		if l == nil {
+			continue
+		}
+		// Port 0 picks a free port, which is what gets reported.
+		if _, port, _ := net.SplitHostPort(l.Addr().String()); port == "0" {
+			t.Errorf("listenLocal(%q) listens on %v, want a picked port", test.addr, l.Addr())
+		}
+		l.Close()
+	}
+}
+
+func TestCheckLBStrategy(t *testing.T) {
+	defer func(v string) { *lbStrategy = v }(*lbStrategy)
+	for _, test := range []struct {
+		strategy string
+		wantErr  bool
+	}{
+		{"failover", false},
+		{"round-robin", false},
+		{"least-connections", false},
+		{"random", true},
+		{"", true},
+	} {
+		*lbStrategy = test.strategy
+		if err := checkLBStrategy(); (err != nil) != test.wantErr {
+			t.Errorf("checkLBStrategy(%q) = %v, want error %v", test.strategy, err, test.wantErr)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	defer func(v string) { *lbStrategy = v }(*lbStrategy)
+	for _, test := range []struct {
+		strategy string
+		active   []int
+		// First endpoint picked by each of as many connects.
+		want string
+	}{
+		{"failover", []int{0, 0, 0}, "aaaaaa"},
+		{"round-robin", []int{0, 0, 0}, "abcabc"},
+		{"round-robin", []int{5, 0, 9}, "abcabc"},
+		{"least-connections", []int{2, 0, 1}, "bbbbbb"},
+		// Ties go to the first given.
+		{"least-connections", []int{1, 0, 0}, "bbbbbb"},
+	} {
+		*lbStrategy = test.strategy
+		f := &forwarder{}
+		var eps []*endpoint
+		for i, n := range test.active {
+			eps = append(eps, &endpoint{url: string(rune('a' + i)), active: n})
+		}
+		var got string
+		for range test.want {
+			got += f.order(append([]*endpoint(nil), eps...))[0].url
+		}
+		if got != test.want {
+			t.Errorf("%s with %v active: picked %q, want %q", test.strategy, test.active, got, test.want)
+		}
+	}
+}
+
+// TestConnect tunnels connections through forwarder.connect to servers
+// counting the tunnels they get, one of them down.
+func TestConnect(t *testing.T) {
+	defer func(v string) { *lbStrategy = v }(*lbStrategy)
+	var up websocket.Upgrader
+	var hits [3]int32
+	f := &forwarder{dialer: websocket.DefaultDialer}
+	for i := range hits {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			if c, err := up.Upgrade(w, r, nil); err == nil {
+				c.Close()
+			}
+		}))
+		defer srv.Close()
+		f.endpoints = append(f.endpoints, &endpoint{url: "ws" + strings.TrimPrefix(srv.URL, "http"), healthy: true})
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	f.endpoints = append(f.endpoints, &endpoint{url: "ws" + strings.TrimPrefix(down.URL, "http"), healthy: true})
+
+	for _, test := range []struct {
+		strategy string
+		want     [3]int32
+	}{
+		// Once marked unhealthy, the server down is left out of the
+		// turns.
+		{"round-robin", [3]int32{4, 4, 4}},
+		{"failover", [3]int32{12, 0, 0}},
+	} {
+		*lbStrategy = test.strategy
+		hits = [3]int32{}
+		f.next = 0
+		for i := 0; i < 12; i++ {
+			conn, e, err := f.connect()
+			if err != nil {
+				t.Fatalf("%s: connect #%d: %v", test.strategy, i, err)
+			}
+			conn.Close()
+			e.addActive(-1)
+		}
+		if hits != test.want {
+			t.Errorf("%s: tunnels per server %v, want %v", test.strategy, hits, test.want)
+		}
+	}
+	for _, e := range f.endpoints {
+		if n := e.activeCount(); n != 0 {
+			t.Errorf("%s has %d active tunnels, want 0", e.url, n)
+		}
+	}
+	if f.endpoints[3].isHealthy() {
+		t.Errorf("server down is still healthy")
+	}
+}
+
+func TestNextProbe(t *testing.T) {
+	defer func(i, m time.Duration) { *probeInterval, *probeMaxBackoff = i, m }(*probeInterval, *probeMaxBackoff)
+	*probeInterval, *probeMaxBackoff = 10*time.Second, 30*time.Second
+	for _, test := range []struct {
+		healthy  bool
+		failures int
+		want     time.Duration
+	}{
+		{true, 0, 10 * time.Second},
+		{false, 1, time.Second},
+		{false, 2, 2 * time.Second},
+		{false, 4, 8 * time.Second},
+		{false, 6, 30 * time.Second},
+		{false, 100, 30 * time.Second},
+	} {
+		e := &endpoint{healthy: test.healthy, failures: test.failures}
+		if got := e.nextProbe(); got != test.want {
+			t.Errorf("nextProbe with healthy=%v, %d failures = %v, want %v", test.healthy, test.failures, got, test.want)
+		}
+	}
+}
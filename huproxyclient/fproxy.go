@@ -0,0 +1,177 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var fwProxyHeaders = headerFlag{}
+
+func init() {
+	flag.Var(fwProxyHeaders, "fproxy_header", "Extra \"Name: value\" header to send in the CONNECT to the forward proxy. May be repeated.")
+}
+
+// headerFlag collects repeated "Name: value" flags.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var s []string
+	for k, vs := range h {
+		for _, v := range vs {
+			s = append(s, k+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlag) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("want \"Name: value\", got %q", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+// proxyError is returned when the forward proxy answers the CONNECT with
+// anything other than 200.
+type proxyError struct {
+	proxy  string
+	status string
+	code   int
+	// Value of Proxy-Authenticate, if any.
+	challenge string
+}
+
+func (e *proxyError) Error() string {
+	if e.code == http.StatusProxyAuthRequired {
+		s := fmt.Sprintf("forward proxy %s requires authentication (%s); check -fpauth and -fpauth_scheme", e.proxy, e.status)
+		if e.challenge != "" {
+			s += fmt.Sprintf(", proxy offered %q", e.challenge)
+		}
+		return s
+	}
+	return fmt.Sprintf("forward proxy %s refused CONNECT: %s", e.proxy, e.status)
+}
+
+// proxyAuthHeader returns the Proxy-Authorization value for the given
+// secret string in <username>:<password> format.
+func proxyAuthHeader(scheme, ss string) (string, error) {
+	switch scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(ss)), nil
+	default:
+		return "", fmt.Errorf("unsupported forward proxy auth scheme %q", scheme)
+	}
+}
+
+// fproxyDialer connects to addr by issuing a CONNECT to an HTTP forward
+// proxy. Unlike gorilla's built-in proxy support it sends the
+// Proxy-Authorization header explicitly, which some proxies insist on.
+//
+// For https:// proxy URLs the CONNECT is sent over TLS to the proxy, so a
+// wss:// tunnel ends up with two TLS layers: client->proxy and, inside
+// the CONNECT tunnel, client->huproxy server.
+type fproxyDialer struct {
+	proxyURL *url.URL
+	header   http.Header
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLS config used for https:// proxies.
+	tlsConfig *tls.Config
+}
+
+func (d *fproxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		port := "80"
+		if d.proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), port)
+	}
+	conn, err := d.dial(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if d.proxyURL.Scheme == "https" {
+		cfg := d.tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = d.proxyURL.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with forward proxy %s: %v", d.proxyURL.Host, err)
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: d.header.Clone(),
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &proxyError{
+			proxy:     d.proxyURL.Host,
+			status:    resp.Status,
+			code:      resp.StatusCode,
+			challenge: strings.Join(resp.Header.Values("Proxy-Authenticate"), ", "),
+		}
+	}
+	if br.Buffered() > 0 {
+		return &bufConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufConn is a net.Conn whose first bytes were already read into a
+// bufio.Reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,167 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy is a forward proxy taking CONNECTs with the basic auth
+// credentials user:pass.
+func connectProxy(t *testing.T) http.Handler {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		b, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer b.Close()
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(b, c)
+		io.Copy(c, b)
+	})
+}
+
+// echoBackend echoes what's sent on each connection.
+func echoBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestFproxyDialer(t *testing.T) {
+	defer func(v string) { *fwProxyURL = v }(*fwProxyURL)
+	defer func(v string) { *fwProxyAuth = v }(*fwProxyAuth)
+	defer func(v string) { *fwProxyCA = v }(*fwProxyCA)
+
+	backend := echoBackend(t)
+	defer backend.Close()
+	proxy := httptest.NewServer(connectProxy(t))
+	defer proxy.Close()
+	tlsProxy := httptest.NewTLSServer(connectProxy(t))
+	defer tlsProxy.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsProxy.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := strings.TrimPrefix(proxy.URL, "http://")
+	httpsAddr := strings.TrimPrefix(tlsProxy.URL, "https://")
+	const authErr = `requires authentication (407 Proxy Authentication Required); check -fpauth and -fpauth_scheme, proxy offered "Basic realm=\"test\""`
+
+	for _, test := range []struct {
+		desc    string
+		url     string
+		auth    string
+		wantErr string
+	}{
+		{"credentials in the URL", "http://user:pass@" + httpAddr, "", ""},
+		{"-fpauth", "http://" + httpAddr, "user:pass", ""},
+		{"-fpauth over the URL", "http://user:wrong@" + httpAddr, "user:pass", ""},
+		{"no credentials", "http://" + httpAddr, "", authErr},
+		{"wrong credentials in the URL", "http://user:wrong@" + httpAddr, "", authErr},
+		{"wrong -fpauth", "http://user:pass@" + httpAddr, "user:wrong", authErr},
+		{"https proxy", "https://user:pass@" + httpsAddr, "", ""},
+		{"https proxy without credentials", "https://" + httpsAddr, "", authErr},
+	} {
+		*fwProxyURL, *fwProxyAuth, *fwProxyCA = test.url, test.auth, ca
+		dialer, _ := newDialer()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := dialer.NetDialContext(ctx, "tcp", backend.Addr().String())
+		cancel()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.desc, err, test.wantErr)
+			}
+			if err == nil {
+				c.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if _, err := io.WriteString(c, "hello"); err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Errorf("%s: got %q, %v back, want %q", test.desc, b, err, "hello")
+		}
+		c.Close()
+	}
+}
+
+func TestProxyAuthHeader(t *testing.T) {
+	for _, test := range []struct {
+		scheme  string
+		want    string
+		wantErr string
+	}{
+		{"basic", "Basic dXNlcjpwYXNz", ""},
+		{"digest", "", `unsupported forward proxy auth scheme "digest"`},
+	} {
+		got, err := proxyAuthHeader(test.scheme, "user:pass")
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: got error %v, want %q", test.scheme, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.scheme, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var gatewayIP = flag.String("gateway_ip", "", "Connect to the server at this IP address instead of the one its hostname resolves to, e.g. to test one load balancer backend. The hostname is still used for SNI, certificate checks and the Host header.")
+
+// pinGateway makes dialer connect to -gateway_ip for the host of the
+// server URLs, which must all have the same one.
+func pinGateway(dialer *websocket.Dialer, urls []string) error {
+	if *gatewayIP == "" {
+		return nil
+	}
+	ip := net.ParseIP(*gatewayIP)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", *gatewayIP)
+	}
+	host := ""
+	for _, u := range urls {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		if pu.Scheme != "ws" && pu.Scheme != "wss" {
+			return fmt.Errorf("server URL %q isn't ws:// or wss://", u)
+		}
+		h := pu.Hostname()
+		if hip := net.ParseIP(h); hip != nil && !hip.Equal(ip) {
+			return fmt.Errorf("server URL %q already has the address %s", u, h)
+		}
+		if host != "" && !strings.EqualFold(h, host) {
+			return fmt.Errorf("server URLs have different hosts, %q and %q", host, h)
+		}
+		host = h
+	}
+	dial := dialer.NetDialContext
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if h, port, err := net.SplitHostPort(addr); err == nil && strings.EqualFold(h, host) {
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+		return dial(ctx, network, addr)
+	}
+	return nil
+}
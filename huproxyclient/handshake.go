@@ -0,0 +1,87 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+
+	huproxy "github.com/google/huproxy/lib"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ctrlHandshake = flag.Bool("control_handshake", false, "Offer to exchange capabilities with the server, in a text message each way before tunnel data. Servers that don't know about it tunnel as before.")
+
+	// How long to wait for the server's capabilities.
+	handshakeTimeout = huproxy.DefaultHandshakeTimeout
+)
+
+// offerHandshake adds the -control_handshake offer to the headers of
+// methods.
+func offerHandshake(methods []authMethod) {
+	if !*ctrlHandshake && !*verifyIntegrity {
+		return
+	}
+	for _, m := range methods {
+		huproxy.OfferHandshake(m.head)
+	}
+}
+
+// handshakeOrRaw runs the handshake on a tunnel just opened with one of
+// methods. If the server accepted the handshake but didn't go through with
+// it in time, it stops offering the handshake on methods and opens the
+// tunnel again with dial, without it.
+func handshakeOrRaw(conn *websocket.Conn, resp *http.Response, methods []authMethod, dial func() (*websocket.Conn, *http.Response, error)) (*websocket.Conn, *http.Response, error) {
+	err := clientHandshake(conn, resp)
+	if !errors.Is(err, huproxy.ErrHandshakeTimeout) {
+		return conn, resp, err
+	}
+	log.Warningf("Control handshake: %v, reconnecting without it", err)
+	conn.Close()
+	for _, m := range methods {
+		m.head.Del(huproxy.HandshakeHeader)
+	}
+	return dial()
+}
+
+// clientHandshake runs the handshake on a tunnel just opened, if the
+// server accepted it.
+func clientHandshake(conn *websocket.Conn, resp *http.Response) error {
+	if !*ctrlHandshake && !*verifyIntegrity {
+		return nil
+	}
+	hs, err := huproxy.ClientHandshake(conn, resp, huproxy.Capabilities{
+		Version:  huproxy.Version,
+		Features: integrityFeatures(),
+	}, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	integrityAgreed = hs.Has(huproxy.FeatureIntegrity)
+	if *verifyIntegrity && !integrityAgreed {
+		log.Warningf("Server doesn't support -verify_integrity, tunneling without the check")
+	}
+	if *verbose {
+		if hs == nil {
+			log.Infof("Server doesn't do the control handshake")
+		} else {
+			log.Infof("Control handshake with huproxy %s, common features: [%s]", hs.Peer.Version, strings.Join(hs.Features, " "))
+		}
+	}
+	return nil
+}
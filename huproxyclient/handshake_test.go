@@ -0,0 +1,93 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+	"github.com/gorilla/websocket"
+)
+
+func TestHandshakeOrRaw(t *testing.T) {
+	defer func(v bool) { *ctrlHandshake = v }(*ctrlHandshake)
+	defer func(v time.Duration) { handshakeTimeout = v }(handshakeTimeout)
+	*ctrlHandshake = true
+	handshakeTimeout = 200 * time.Millisecond
+
+	// Accepts the handshake without going through with it, and echoes
+	// the first message of tunnels without it.
+	offers := make(chan bool, 2)
+	var up websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := http.Header{}
+		offered := huproxy.AcceptHandshake(r, h)
+		offers <- offered
+		c, err := up.Upgrade(w, r, h)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if !offered {
+				c.WriteMessage(mt, msg)
+			}
+		}
+	}))
+	defer srv.Close()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	methods := []authMethod{{dialer: websocket.DefaultDialer, head: http.Header{}}}
+	offerHandshake(methods)
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(u, methods[0].head)
+	}
+	conn, resp, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err = handshakeOrRaw(conn, resp, methods, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := methods[0].head.Get(huproxy.HandshakeHeader); got != "" {
+		t.Errorf("Still offering the handshake with %s: %q", huproxy.HandshakeHeader, got)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	mt, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage || string(msg) != "data" {
+		t.Errorf("Got message %d %q back, want the binary %q", mt, msg, "data")
+	}
+	if got := fmt.Sprint(<-offers, <-offers); got != "true false" {
+		t.Errorf("Server got handshake offers %s, want true false", got)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var appHeartbeat = flag.String("app_heartbeat", "", "INTERVAL:DATA, e.g. '30s:\\n'. Send DATA, with Go escapes such as \\n or \\x00, through the tunnel every INTERVAL, mixed into stdin, for backends that drop idle sessions. It's part of the tunneled stream, so only use bytes the backend's protocol ignores.")
+
+// heartbeat is a parsed -app_heartbeat.
+type heartbeat struct {
+	interval time.Duration
+	data     []byte
+}
+
+func parseHeartbeat(s string) (*heartbeat, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("want INTERVAL:DATA, got %q", s)
+	}
+	d, err := time.ParseDuration(s[:i])
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("bad interval %q", s[:i])
+	}
+	data, err := strconv.Unquote(`"` + s[i+1:] + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("bad data %q, escape quotes and backslashes", s[i+1:])
+	}
+	if data == "" {
+		return nil, fmt.Errorf("no data to send")
+	}
+	return &heartbeat{interval: d, data: []byte(data)}, nil
+}
+
+// heartbeatReader returns readers like p.reader that also return the
+// heartbeat data every interval. A heartbeat waits for data read from
+// stdin to be taken in full, so it never splits it.
+func (p *stdinPump) heartbeatReader(hb *heartbeat) func(context.Context) io.Reader {
+	return func(ctx context.Context) io.Reader {
+		t := time.NewTicker(hb.interval)
+		go func() {
+			<-ctx.Done()
+			t.Stop()
+		}()
+		return &pumpReader{p: p, ctx: ctx, beat: t.C, beatData: hb.data}
+	}
+}
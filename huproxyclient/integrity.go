@@ -0,0 +1,63 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+
+	huproxy "github.com/google/huproxy/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit status when -verify_integrity found the data differed.
+const exitIntegrity = 5
+
+var verifyIntegrity = flag.Bool("verify_integrity", false, "Check, when the tunnel closes, that the data in both directions arrived intact, by comparing SHA-256 digests with the server. Implies -control_handshake. Servers not supporting it tunnel without the check, with a warning.")
+
+var (
+	// Set if the server agreed on the integrity check for the tunnel in
+	// use.
+	integrityAgreed bool
+	// Set once a check found the data differed.
+	integrityFailed bool
+)
+
+// integrityFeatures returns the handshake features for -verify_integrity.
+func integrityFeatures() []string {
+	if !*verifyIntegrity {
+		return nil
+	}
+	return []string{huproxy.FeatureIntegrity}
+}
+
+// reportIntegrity logs how the integrity check of a tunnel went.
+func reportIntegrity(res *huproxy.BridgeResult) {
+	if !integrityAgreed {
+		return
+	}
+	c := res.Integrity
+	switch {
+	case c == nil && serverEnded(res) != nil:
+		// It ends tunnels that way without a report.
+	case c == nil:
+		log.Warningf("Server sent no integrity report, tunnel data not verified")
+	case c.Err != nil:
+		log.Errorf("Integrity check failed: %v", c.Err)
+		integrityFailed = true
+	case !c.Complete:
+		log.Warningf("Integrity of data from the server verified, but data sent to it was still on the way")
+	case *verbose:
+		log.Infof("Integrity verified, %d bytes sent and %d received", res.BytesSent, res.BytesReceived)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit status when -max_rtt is exceeded.
+const exitMaxRTT = 4
+
+var (
+	latencyProbe = flag.Duration("latency_probe", 0, "If nonzero, send a websocket ping this often and log the round trip time to the server, with a summary on exit. 0 disables.")
+	maxRTT       = flag.Duration("max_rtt", 0, "With -latency_probe, close the tunnel and exit with status 4 once -max_rtt_pings pings in a row take longer than this, or go unanswered for that long. 0 disables.")
+	maxRTTPings  = flag.Int("max_rtt_pings", 3, "Number of consecutive pings over -max_rtt that close the tunnel.")
+
+	// Set once -max_rtt closed the tunnel.
+	rttExceeded int32
+)
+
+// rttStats collects -latency_probe round trip times, over all tunnels of
+// the session.
+type rttStats struct {
+	mu            sync.Mutex
+	n             int
+	min, max, sum time.Duration
+	once          sync.Once
+}
+
+var rtts rttStats
+
+func (s *rttStats) add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.n++
+	s.sum += d
+	log.Infof("RTT %v (min/avg/max %v/%v/%v over %d pings)", d, s.min, s.sum/time.Duration(s.n), s.max, s.n)
+}
+
+// summary logs the round trip times, once.
+func (s *rttStats) summary() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.n == 0 {
+			log.Infof("RTT: no pongs received")
+			return
+		}
+		log.Infof("RTT summary: min/avg/max %v/%v/%v over %d pings", s.min, s.sum/time.Duration(s.n), s.max, s.n)
+	})
+}
+
+// checkMaxRTT validates -max_rtt.
+func checkMaxRTT() error {
+	if *maxRTT == 0 {
+		return nil
+	}
+	if *maxRTT < 0 {
+		return fmt.Errorf("-max_rtt must not be negative")
+	}
+	if *latencyProbe <= 0 {
+		return fmt.Errorf("-max_rtt needs -latency_probe to measure round trip times")
+	}
+	if *maxRTTPings < 1 {
+		return fmt.Errorf("-max_rtt_pings must be at least 1")
+	}
+	return nil
+}
+
+// slowPings counts consecutive pings of one tunnel over -max_rtt, calling
+// abort once there are -max_rtt_pings of them.
+type slowPings struct {
+	mu    sync.Mutex
+	n     int
+	abort func()
+}
+
+// add notes the round trip time of a ping, or how long one has gone
+// unanswered.
+func (s *slowPings) add(d time.Duration) {
+	if *maxRTT <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d <= *maxRTT {
+		s.n = 0
+		return
+	}
+	s.n++
+	if s.n == *maxRTTPings {
+		log.Errorf("Round trip time over -max_rtt of %v for %d pings in a row, closing", *maxRTT, s.n)
+		atomic.StoreInt32(&rttExceeded, 1)
+		s.abort()
+	}
+}
+
+// exceededMaxRTT returns true if -max_rtt closed the tunnel.
+func exceededMaxRTT() bool {
+	return atomic.LoadInt32(&rttExceeded) == 1
+}
+
+// startLatencyProbe pings the server on conn every -latency_probe until
+// ctx is done. Pongs are handled by whatever reads conn. If -max_rtt is
+// exceeded, the tunnel is closed and cancel called.
+func startLatencyProbe(ctx context.Context, cancel func(), conn *websocket.Conn) {
+	if *latencyProbe <= 0 {
+		return
+	}
+	slow := &slowPings{abort: func() {
+		if err := conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "round trip time too high"),
+			time.Now().Add(*writeTimeout)); err != nil && err != websocket.ErrCloseSent {
+			log.Errorf("Error sending 'close' message: %v", err)
+		}
+		cancel()
+	}}
+	// Send time of the oldest ping not yet answered, or 0. Pongs come in
+	// order, so any pong answers at least that one.
+	var pending int64
+	conn.SetPongHandler(func(data string) error {
+		if len(data) == 8 {
+			sent := int64(binary.BigEndian.Uint64([]byte(data)))
+			if p := atomic.LoadInt64(&pending); p != 0 && sent >= p {
+				atomic.CompareAndSwapInt64(&pending, p, 0)
+			}
+			d := time.Since(time.Unix(0, sent))
+			rtts.add(d)
+			slow.add(d)
+		}
+		return nil
+	})
+	go func() {
+		t := time.NewTicker(*latencyProbe)
+		defer t.Stop()
+		payload := make([]byte, 8)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if p := atomic.LoadInt64(&pending); p != 0 {
+				if d := time.Since(time.Unix(0, p)); d > *maxRTT {
+					slow.add(d)
+				}
+			}
+			now := time.Now().UnixNano()
+			atomic.CompareAndSwapInt64(&pending, 0, now)
+			binary.BigEndian.PutUint64(payload, uint64(now))
+			// WriteControl may be called concurrently with the bridge's
+			// writes; the websocket library serializes them.
+			if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(*writeTimeout)); err != nil {
+				if err != websocket.ErrCloseSent {
+					log.Warningf("Sending ping: %v", err)
+				}
+				return
+			}
+		}
+	}()
+}
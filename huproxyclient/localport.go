@@ -0,0 +1,82 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var localPortRange = flag.String("local_port_range", "", "Bind outgoing connections, to the server, forward proxy or -ssh_jump host, to a local port in this range, as low-high. For firewalls only allowing egress from certain ports. Empty lets the OS pick.")
+
+// parsePortRange parses "low-high".
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("want low-high, got %q", s)
+	}
+	low, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port %q", parts[0])
+	}
+	high, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port %q", parts[1])
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("%q is not a range of ports between 1 and 65535", s)
+	}
+	return low, high, nil
+}
+
+// localPortDialer returns a dial func for -local_port_range, or a plain
+// one without it.
+func localPortDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if *localPortRange == "" {
+		return (&net.Dialer{}).DialContext, nil
+	}
+	low, high, err := parsePortRange(*localPortRange)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFromPort(ctx, network, addr, low, high)
+	}, nil
+}
+
+// dialFromPort connects to addr from the first free port in low-high,
+// starting at a random one so that concurrent dials rarely collide.
+func dialFromPort(ctx context.Context, network, addr string, low, high int) (net.Conn, error) {
+	n := high - low + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := low + (start+i)%n
+		d := &net.Dialer{LocalAddr: &net.TCPAddr{Port: port}}
+		c, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("dialing %s: all local ports in -local_port_range %d-%d are in use", addr, low, high)
+}
@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var probeSpec = flag.String("probe", "", "Instead of tunneling, check which ports are reachable through the server, as host:port1,port2,... The arg is then the server URL up to the host, e.g. wss://proxy.example.com/proxy.")
+
+type portResult struct {
+	Port      string  `json:"port"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type probeReport struct {
+	Host    string       `json:"host"`
+	Results []portResult `json:"results"`
+	OK      int          `json:"ok"`
+	Failed  int          `json:"failed"`
+}
+
+// parseProbe splits host:port1,port2,...
+func parseProbe(spec string) (string, []string, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return "", nil, fmt.Errorf("want host:port1,port2,..., got %q", spec)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(spec[:i], "["), "]")
+	var ports []string
+	for _, p := range strings.Split(spec[i+1:], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ports = append(ports, p)
+		}
+	}
+	if host == "" || len(ports) == 0 {
+		return "", nil, fmt.Errorf("want host:port1,port2,..., got %q", spec)
+	}
+	return host, ports, nil
+}
+
+// checkTunnel opens a tunnel to u and closes it again. The server only
+// upgrades once it's connected to the backend, so success means the
+// backend is reachable.
+func checkTunnel(dialer *websocket.Dialer, head http.Header, u string) error {
+	conn, resp, err := dialer.Dial(u, head)
+	if err != nil {
+		return errors.New(dialErrorString(u, resp, err))
+	}
+	if err := conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(*writeTimeout)); err == nil {
+		huproxy.DrainClose(conn, huproxy.DefaultDrainTimeout)
+	}
+	return conn.Close()
+}
+
+// runProbe checks each port in -probe in turn, prints a JSON report, and
+// exits nonzero if any failed.
+func runProbe(dialer *websocket.Dialer, head http.Header, base string) {
+	host, ports, err := parseProbe(*probeSpec)
+	if err != nil {
+		log.Fatalf("Invalid -probe: %v", err)
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	rep := probeReport{Host: host}
+	for _, p := range ports {
+		start := time.Now()
+		err := checkTunnel(dialer, head, fmt.Sprintf("%s/%s/%s", base, host, p))
+		r := portResult{
+			Port:      p,
+			OK:        err == nil,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			r.Error = strings.TrimSpace(err.Error())
+			rep.Failed++
+		} else {
+			rep.OK++
+		}
+		rep.Results = append(rep.Results, r)
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(rep); err != nil {
+		log.Fatalf("Writing report: %v", err)
+	}
+	if rep.Failed > 0 {
+		os.Exit(1)
+	}
+}
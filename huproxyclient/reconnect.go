@@ -0,0 +1,100 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"sync"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var reconnect = flag.Bool("reconnect", false, "When the server shuts down and asks clients to reconnect, open a new tunnel to the same URL and carry on. Data in flight during the switch may be lost. With -retry_mode=connect-only, only before any data flowed.")
+
+// stdinPump reads stdin in the background, so that a tunnel that ends
+// doesn't leave a read of it outstanding, and the next tunnel carries on
+// with the data the last one didn't take.
+type stdinPump struct {
+	ch chan []byte
+	// Set before ch is closed.
+	err error
+
+	// Held by a reader while reading, so that the reader of the next
+	// tunnel waits for the last one to notice its context is done.
+	mu      sync.Mutex
+	pending []byte
+}
+
+func newStdinPump(r io.Reader) *stdinPump {
+	size := copyOptions().BufferSize
+	if size <= 0 {
+		size = huproxy.DefaultBufferSize
+	}
+	p := &stdinPump{ch: make(chan []byte)}
+	go func() {
+		for {
+			b := make([]byte, size)
+			n, err := r.Read(b)
+			if n > 0 {
+				p.ch <- b[:n]
+			}
+			if err != nil {
+				p.err = err
+				close(p.ch)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// reader returns a reader of the pumped data, for one tunnel at a time,
+// that fails once ctx is done.
+func (p *stdinPump) reader(ctx context.Context) io.Reader {
+	return &pumpReader{p: p, ctx: ctx}
+}
+
+type pumpReader struct {
+	p   *stdinPump
+	ctx context.Context
+
+	// With -app_heartbeat, ticks when to return beatData.
+	beat     <-chan time.Time
+	beatData []byte
+}
+
+func (r *pumpReader) Read(b []byte) (int, error) {
+	p := r.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		select {
+		case d, ok := <-p.ch:
+			if !ok {
+				return 0, p.err
+			}
+			p.pending = d
+		case <-r.beat:
+			p.pending = r.beatData
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
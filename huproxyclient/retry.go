@@ -0,0 +1,90 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	retryMode       = flag.String("retry_mode", "off", "'off' never retries. 'connect-only' retries failing to open the tunnel, but never once it's open and data may have flowed.")
+	connectRetries  = flag.Int("connect_retries", 5, "With -retry_mode=connect-only or -reconnect, how many times to retry opening the tunnel.")
+	retryMaxBackoff = flag.Duration("retry_max_backoff", 30*time.Second, "With -retry_mode=connect-only or -reconnect, max time between retries.")
+)
+
+// Set to 1 by the bridge once tunnel data went either way, after which
+// -retry_mode=connect-only rules out -reconnect.
+var dataFlowed int32
+
+// checkReconnect returns why -reconnect may not open a new tunnel, if it
+// may not.
+func checkReconnect() error {
+	if *retryMode == "connect-only" && atomic.LoadInt32(&dataFlowed) != 0 {
+		return errors.New("data has flowed, and -retry_mode=connect-only never reconnects after that")
+	}
+	return nil
+}
+
+func checkRetryMode() error {
+	switch *retryMode {
+	case "off", "connect-only":
+		return nil
+	}
+	return fmt.Errorf("invalid -retry_mode %q", *retryMode)
+}
+
+// retryable returns true if a failed dial may succeed when tried again:
+// network errors and 5xx responses, but not the server or forward proxy
+// turning us away.
+func retryable(resp *http.Response, err error) bool {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		return pe.code >= 500
+	}
+	return resp == nil || resp.StatusCode >= 500
+}
+
+// dialRetry opens the tunnel, retrying if retry is set. Nothing has been
+// read from stdin or written to stdout before it returns, so a retry can
+// never lose or duplicate stream data. Once the tunnel is open, failures
+// end the session.
+func dialRetry(dialer *websocket.Dialer, u string, head http.Header, retry bool) (*websocket.Conn, *http.Response, error) {
+	backoff := time.Second
+	for try := 0; ; try++ {
+		conn, resp, err := dialer.Dial(u, head)
+		if err == nil {
+			if err := checkServerVersion(u, resp); err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+		}
+		if err == nil || !retry || try >= *connectRetries || !retryable(resp, err) {
+			return conn, resp, err
+		}
+		log.Warningf("%s; retrying in %v", strings.TrimSpace(dialErrorString(u, resp, err)), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > *retryMaxBackoff {
+			backoff = *retryMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckReconnect(t *testing.T) {
+	defer func(mode string) { *retryMode = mode }(*retryMode)
+	defer atomic.StoreInt32(&dataFlowed, 0)
+	for _, test := range []struct {
+		mode    string
+		flowed  int32
+		wantErr bool
+	}{
+		{"off", 0, false},
+		{"off", 1, false},
+		{"connect-only", 0, false},
+		{"connect-only", 1, true},
+	} {
+		*retryMode = test.mode
+		atomic.StoreInt32(&dataFlowed, test.flowed)
+		if err := checkReconnect(); (err != nil) != test.wantErr {
+			t.Errorf("checkReconnect() with -retry_mode=%s and flowed %d = %v, want error %v", test.mode, test.flowed, err, test.wantErr)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{"network error", nil, errors.New("connection refused"), true},
+		{"server error", &http.Response{StatusCode: http.StatusBadGateway}, errors.New("bad handshake"), true},
+		{"forbidden", &http.Response{StatusCode: http.StatusForbidden}, errors.New("bad handshake"), false},
+		{"proxy unavailable", nil, fmt.Errorf("dialing: %w", &proxyError{code: http.StatusServiceUnavailable}), true},
+		{"proxy auth", nil, &proxyError{code: http.StatusProxyAuthRequired}, false},
+	} {
+		if got := retryable(test.resp, test.err); got != test.want {
+			t.Errorf("%s: retryable = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
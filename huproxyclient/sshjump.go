@@ -0,0 +1,231 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	sshJump        = flag.String("ssh_jump", "", "Reach the huproxy server through an SSH jump host, in [user@]host[:port] format.")
+	sshKey         = flag.String("ssh_key", "", "Private key for -ssh_jump. ssh-agent is used as well, if running and reachable.")
+	sshKnownHosts  = flag.String("ssh_known_hosts", "", "known_hosts file for -ssh_jump. Defaults to ~/.ssh/known_hosts.")
+	sshJumpTimeout = flag.Duration("ssh_jump_timeout", 10*time.Second, "Timeout connecting to the -ssh_jump host.")
+)
+
+// parseJump splits a jump host spec of the form [user@]host[:port].
+func parseJump(spec string) (string, string, error) {
+	u := ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		u, spec = spec[:i], spec[i+1:]
+	}
+	if u == "" {
+		cur, err := user.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("no user in %q and can't find current user: %v", spec, err)
+		}
+		u = cur.Username
+	}
+	if spec == "" {
+		return "", "", fmt.Errorf("empty jump host")
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		spec = net.JoinHostPort(spec, "22")
+	}
+	return u, spec, nil
+}
+
+// sshAuthMethods returns the private key in keyFile, if given, followed
+// by the keys in the running ssh-agent, if any. Failing to reach the agent
+// is only an error without keyFile.
+func sshAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %v", keyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		c, err := net.Dial("unix", sock)
+		switch {
+		case err == nil:
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(c).Signers))
+		case keyFile == "":
+			return nil, fmt.Errorf("connecting to ssh-agent: %v", err)
+		default:
+			log.Warningf("Not using ssh-agent, connecting to it failed: %v", err)
+		}
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH key given and no ssh-agent running")
+	}
+	return methods, nil
+}
+
+// dialSSHJump connects to the jump host and returns a dial function
+// opening TCP connections from there, for use as the transport to the
+// huproxy server.
+func dialSSHJump(dial func(ctx context.Context, network, addr string) (net.Conn, error), spec, keyFile, knownHostsFile string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	u, addr, err := parseJump(spec)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := sshAuthMethods(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading known hosts: %v", err)
+	}
+
+	j := &jumpHost{
+		dial: dial,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            u,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         *sshJumpTimeout,
+		},
+	}
+	// Connect now, so that a bad jump host is found out at startup.
+	if _, err := j.connected(context.Background(), nil); err != nil {
+		return nil, err
+	}
+	return j.DialContext, nil
+}
+
+// jumpHost holds the SSH connection to the -ssh_jump host, connecting again
+// if it breaks, as an idle one might be dropped between reconnects.
+type jumpHost struct {
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	addr   string
+	config *ssh.ClientConfig
+
+	mu sync.Mutex
+	// Nil until connected, and once broken.
+	client *ssh.Client
+}
+
+// connected returns the SSH connection to the jump host, connecting first
+// if there is none, or if the one there is was found broken.
+func (j *jumpHost) connected(ctx context.Context, broken *ssh.Client) (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.client != nil && j.client != broken {
+		return j.client, nil
+	}
+	if j.client != nil {
+		j.client.Close()
+		j.client = nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *sshJumpTimeout)
+	defer cancel()
+	c, err := j.dial(ctx, "tcp", j.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to jump host %q: %v", j.addr, err)
+	}
+	// ClientConfig.Timeout only covers ssh.Dial, so bound the handshake
+	// too.
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(c, j.addr, j.config)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("connecting to jump host %q: %v", j.addr, err)
+	}
+	c.SetDeadline(time.Time{})
+	j.client = ssh.NewClient(sc, chans, reqs)
+	return j.client, nil
+}
+
+// DialContext opens a TCP connection from the jump host. If the SSH
+// connection turns out broken, it connects to the jump host again and
+// retries once. The jump host refusing the connection isn't retried.
+func (j *jumpHost) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := j.connected(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := sshDialContext(ctx, client, network, addr)
+	var oce *ssh.OpenChannelError
+	if err == nil || ctx.Err() != nil || errors.As(err, &oce) {
+		return c, err
+	}
+	log.Warningf("Connection to jump host %q broken (%v), connecting again", j.addr, err)
+	if client, err = j.connected(ctx, client); err != nil {
+		return nil, err
+	}
+	return sshDialContext(ctx, client, network, addr)
+}
+
+// sshDialContext is client.Dial, giving up once ctx is done. A connection
+// that only opens after that is closed.
+func sshDialContext(ctx context.Context, client *ssh.Client, network, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := client.Dial(network, addr)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseJump(t *testing.T) {
+	for _, test := range []struct {
+		spec, user, addr string
+		wantErr          bool
+	}{
+		{"me@bastion.example.com", "me", "bastion.example.com:22", false},
+		{"me@bastion.example.com:2222", "me", "bastion.example.com:2222", false},
+		{"me@[2001:db8::1]:2222", "me", "[2001:db8::1]:2222", false},
+		{"a@b@bastion", "a@b", "bastion:22", false},
+		{"me@", "", "", true},
+	} {
+		u, addr, err := parseJump(test.spec)
+		if (err != nil) != test.wantErr || u != test.user || addr != test.addr {
+			t.Errorf("parseJump(%q) = %q, %q, %v; want %q, %q, error %v", test.spec, u, addr, err, test.user, test.addr, test.wantErr)
+		}
+	}
+}
+
+func TestSSHAuthMethods(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	dir := t.TempDir()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badKey := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(badKey, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	noAgent := filepath.Join(dir, "no-agent.sock")
+
+	for _, test := range []struct {
+		desc, key, sock string
+		want            int
+		wantErr         string
+	}{
+		{"key", keyFile, "", 1, ""},
+		{"key and unreachable agent", keyFile, noAgent, 1, ""},
+		{"unreachable agent only", "", noAgent, 0, "connecting to ssh-agent"},
+		{"nothing", "", "", 0, "no SSH key given"},
+		{"bad key", badKey, "", 0, "parsing"},
+		{"missing key", filepath.Join(dir, "missing"), "", 0, "no such file"},
+	} {
+		os.Setenv("SSH_AUTH_SOCK", test.sock)
+		methods, err := sshAuthMethods(test.key)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: sshAuthMethods = %v, want error containing %q", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(methods) != test.want {
+			t.Errorf("%s: sshAuthMethods = %d methods, %v; want %d", test.desc, len(methods), err, test.want)
+		}
+	}
+}
+
+// jumpServer is an SSH server forwarding TCP connections for the key in
+// keyFile, with its host key in knownHosts. The transport connections it
+// accepted go to conns.
+func jumpServer(t *testing.T, dir string) (l net.Listener, keyFile, knownHosts string, conns chan net.Conn) {
+	t.Helper()
+	newKey := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	hostKey, err := ssh.NewSignerFromKey(newKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey := newKey()
+	userPub, err := ssh.NewPublicKey(&userKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(k.Marshal()) != string(userPub.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conns = make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					var to struct {
+						Host     string
+						Port     uint32
+						FromHost string
+						FromPort uint32
+					}
+					if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &to) != nil {
+						nc.Reject(ssh.UnknownChannelType, "not a direct-tcpip channel")
+						continue
+					}
+					b, err := net.Dial("tcp", net.JoinHostPort(to.Host, strconv.Itoa(int(to.Port))))
+					if err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, creqs, err := nc.Accept()
+					if err != nil {
+						b.Close()
+						continue
+					}
+					go ssh.DiscardRequests(creqs)
+					go func() {
+						defer ch.Close()
+						defer b.Close()
+						go io.Copy(b, ch)
+						io.Copy(ch, b)
+					}()
+				}
+			}()
+		}
+	}()
+	return l, keyFile, knownHosts, conns
+}
+
+func TestSSHJumpReconnect(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", "")
+	l, keyFile, knownHosts, conns := jumpServer(t, t.TempDir())
+	defer l.Close()
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	dial, err := dialSSHJump((&net.Dialer{}).DialContext, "me@"+l.Addr().String(), keyFile, knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-conns
+	echo := func(desc string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := dial(ctx, "tcp", backend.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		defer c.Close()
+		if _, err := io.WriteString(c, "hello"); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Errorf("%s: got %q, %v back, want %q", desc, b, err, "hello")
+		}
+	}
+	echo("first connection")
+	echo("same SSH connection")
+	select {
+	case <-conns:
+		t.Errorf("Connected to the jump host again while the connection was fine")
+	default:
+	}
+
+	// As if the jump host, or something on the way, dropped it.
+	first.Close()
+	echo("after the SSH connection broke")
+	select {
+	case <-conns:
+	default:
+		t.Errorf("Didn't connect to the jump host again")
+	}
+
+	// The jump host refusing isn't a broken connection.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, err = dial(context.Background(), "tcp", closed.Addr().String())
+	var oce *ssh.OpenChannelError
+	if !errors.As(err, &oce) {
+		t.Errorf("Dialing a closed port got %v, want an *ssh.OpenChannelError", err)
+	}
+	select {
+	case <-conns:
+		t.Errorf("Connected to the jump host again on a refused connection")
+	default:
+	}
+}
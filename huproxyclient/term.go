@@ -0,0 +1,58 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// makeRaw puts stdin into raw mode if it is a terminal, and returns a
+// function restoring the previous mode. The terminal is also restored when
+// exiting through log.Fatal or on a terminating signal.
+func makeRaw() func() {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Warningf("Failed to put terminal in raw mode: %v", err)
+		return func() {}
+	}
+
+	var once sync.Once
+	restore := func() {
+		once.Do(func() {
+			if err := term.Restore(fd, old); err != nil {
+				log.Warningf("Failed to restore terminal: %v", err)
+			}
+		})
+	}
+	log.RegisterExitHandler(restore)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		s := <-sigs
+		restore()
+		log.Fatalf("Got signal %v", s)
+	}()
+	return restore
+}
@@ -0,0 +1,148 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	throughputLog      = flag.String("throughput_log", "", "File to append a JSON line to every -throughput_interval, with the bytes per second tunneled each way since the last one. Empty disables.")
+	throughputInterval = flag.Duration("throughput_interval", 10*time.Second, "How often to write a -throughput_log sample.")
+)
+
+// throughputSample is one line of -throughput_log.
+type throughputSample struct {
+	Time           string  `json:"time"`
+	ElapsedSec     float64 `json:"elapsed_seconds"`
+	BytesSent      int64   `json:"bytes_sent"`
+	BytesReceived  int64   `json:"bytes_received"`
+	SentPerSec     float64 `json:"sent_bytes_per_second"`
+	ReceivedPerSec float64 `json:"received_bytes_per_second"`
+	Final          bool    `json:"final,omitempty"`
+}
+
+// throughputMeter counts bytes tunneled and writes -throughput_log
+// samples from its own goroutine, so that a slow file never holds up the
+// tunnel.
+type throughputMeter struct {
+	sent, received int64
+
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	// Totals as of the last sample.
+	last                   time.Time
+	lastSent, lastReceived int64
+}
+
+func openThroughputLog(fn string) (*throughputMeter, error) {
+	if *throughputInterval <= 0 {
+		return nil, fmt.Errorf("-throughput_interval must be positive")
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	m := &throughputMeter{
+		f:     f,
+		enc:   json.NewEncoder(f),
+		start: now,
+		last:  now,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *throughputMeter) run() {
+	defer close(m.done)
+	t := time.NewTicker(*throughputInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.sample(false)
+		case <-m.stop:
+			m.sample(true)
+			return
+		}
+	}
+}
+
+func (m *throughputMeter) sample(final bool) {
+	now := time.Now()
+	sent, received := atomic.LoadInt64(&m.sent), atomic.LoadInt64(&m.received)
+	s := throughputSample{
+		Time:          now.UTC().Format(time.RFC3339Nano),
+		ElapsedSec:    now.Sub(m.start).Seconds(),
+		BytesSent:     sent,
+		BytesReceived: received,
+		Final:         final,
+	}
+	if d := now.Sub(m.last).Seconds(); d > 0 {
+		s.SentPerSec = float64(sent-m.lastSent) / d
+		s.ReceivedPerSec = float64(received-m.lastReceived) / d
+	}
+	m.last, m.lastSent, m.lastReceived = now, sent, received
+	if err := m.enc.Encode(&s); err != nil {
+		log.Warningf("Writing -throughput_log: %v", err)
+	}
+}
+
+// close writes the final sample and closes the file.
+func (m *throughputMeter) close() {
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.done
+		m.f.Close()
+	})
+}
+
+type meterReader struct {
+	m *throughputMeter
+	r io.Reader
+}
+
+func (r *meterReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.m.sent, int64(n))
+	return n, err
+}
+
+type meterWriter struct {
+	m *throughputMeter
+	w io.Writer
+}
+
+func (w *meterWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	atomic.AddInt64(&w.m.received, int64(n))
+	return n, err
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var printTLS = flag.Bool("print_tls", false, "Log the negotiated TLS version, cipher suite and server certificates after connecting to a wss:// URL.")
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// Key exchange groups accepted by -tls_curves, in the order listed.
+var tlsCurveNames = []struct {
+	name string
+	id   tls.CurveID
+}{
+	{"X25519", tls.X25519},
+	{"P256", tls.CurveP256},
+	{"P384", tls.CurveP384},
+	{"P521", tls.CurveP521},
+}
+
+// parseCurves parses the comma separated -tls_curves names.
+func parseCurves(s string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range tlsCurveNames {
+			if strings.EqualFold(name, c.name) {
+				curves = append(curves, c.id)
+				found = true
+				break
+			}
+		}
+		if !found {
+			var names []string
+			for _, c := range tlsCurveNames {
+				names = append(names, c.name)
+			}
+			return nil, fmt.Errorf("unknown curve %q, want one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	return curves, nil
+}
+
+// logTLSState logs the TLS details of the connection to the server at
+// URL u. With -insecure_conn the chain isn't verified while connecting, so
+// it's verified here to show what strict mode would make of it.
+func logTLSState(conn *websocket.Conn, u string) {
+	tc, ok := conn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		log.Warningf("-print_tls: connection to the server doesn't use TLS")
+		return
+	}
+	cs := tc.ConnectionState()
+	log.Infof("TLS version: %s", tlsVersions[cs.Version])
+	log.Infof("TLS cipher suite: %s", tls.CipherSuiteName(cs.CipherSuite))
+	log.Infof("TLS server name: %q, ALPN protocol: %q", cs.ServerName, cs.NegotiatedProtocol)
+	for i, c := range cs.PeerCertificates {
+		log.Infof("TLS certificate %d: subject %q, issuer %q, valid %v to %v",
+			i, c.Subject, c.Issuer, c.NotBefore.UTC(), c.NotAfter.UTC())
+	}
+	if len(cs.VerifiedChains) > 0 {
+		log.Infof("TLS chain verified")
+		return
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return
+	}
+	host := cs.ServerName
+	if pu, err := url.Parse(u); err == nil && host == "" {
+		host = pu.Hostname()
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		log.Warningf("TLS chain not verified, and would fail verification: %v", err)
+	} else {
+		log.Infof("TLS chain not verified, but would pass verification")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseCurves(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    []tls.CurveID
+		wantErr bool
+	}{
+		{"X25519", []tls.CurveID{tls.X25519}, false},
+		{"p384, x25519", []tls.CurveID{tls.CurveP384, tls.X25519}, false},
+		{"P256,P384,P521", []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}, false},
+		{"P224", nil, true},
+		{"X25519,", nil, true},
+	} {
+		got, err := parseCurves(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCurves(%q): %v, want error %v", test.in, err, test.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "X25519, P256, P384, P521") {
+			t.Errorf("parseCurves(%q) = %v, want the accepted names", test.in, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCurves(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+// TestCurvesHandshake dials a server accepting only P384 with each of
+// several -tls_curves.
+func TestCurvesHandshake(t *testing.T) {
+	var up websocket.Upgrader
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := up.Upgrade(w, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	srv.TLS = &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP384}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, test := range []struct {
+		curves string
+		want   bool
+	}{
+		{"P384", true},
+		{"X25519,P384", true},
+		{"X25519", false},
+		{"P256,P521", false},
+	} {
+		curves, err := parseCurves(test.curves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		config.CurvePreferences = curves
+		d := &websocket.Dialer{TLSClientConfig: config}
+		c, _, err := d.Dial("wss"+strings.TrimPrefix(srv.URL, "https"), nil)
+		if (err == nil) != test.want {
+			t.Errorf("-tls_curves=%s: %v, want success %v", test.curves, err, test.want)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variable with the server URL, if not given as an arg.
+const urlEnv = "HUPROXY_URL"
+
+// Longest URL line accepted from stdin.
+const maxURLLine = 8192
+
+var urlFromStdin = flag.Bool("url_from_stdin", false, "Read the server URL from the first line of stdin, instead of an arg. The rest of stdin is tunneled.")
+
+// readURLLine reads up to the first newline from r one byte at a time,
+// so that nothing after it is consumed.
+func readURLLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxURLLine {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			return "", errors.New("stdin ended before the end of the URL line")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("URL line longer than %d bytes", maxURLLine)
+}
+
+func checkURL(s string) error {
+	if s == "" {
+		return errors.New("empty URL")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("URL %q is not ws:// or wss://", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", s)
+	}
+	return nil
+}
+
+// serverArgs returns the server URLs: the args if any, else the one from
+// -url_from_stdin or $HUPROXY_URL.
+func serverArgs() []string {
+	if flag.NArg() > 0 {
+		if *urlFromStdin {
+			log.Fatalf("-url_from_stdin can't be used with a URL arg")
+		}
+		return flag.Args()
+	}
+	if *urlFromStdin {
+		if *listenAddr != "" || *probeSpec != "" || *batchFile != "" {
+			log.Fatalf("-url_from_stdin only works when tunneling stdin")
+		}
+		u, err := readURLLine(os.Stdin)
+		if err != nil {
+			log.Fatalf("Reading URL from stdin: %v", err)
+		}
+		if err := checkURL(u); err != nil {
+			log.Fatalf("Invalid URL from stdin: %v", err)
+		}
+		return []string{u}
+	}
+	if u, ok := os.LookupEnv(urlEnv); ok {
+		if err := checkURL(strings.TrimSpace(u)); err != nil {
+			log.Fatalf("Invalid $%s: %v", urlEnv, err)
+		}
+		return []string{strings.TrimSpace(u)}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var minServerVersion = flag.String("min_server_version", "", "Refuse servers older than this huproxy version, as reported in their upgrade response. Empty skips the check.")
+
+// Servers, by host, already found new enough.
+var serverVersionOK sync.Map
+
+// versionError is a server too old for -min_server_version.
+type versionError struct {
+	host    string
+	version string
+}
+
+func (e *versionError) Error() string {
+	if e.version == "" {
+		return fmt.Sprintf("server %s doesn't report its huproxy version, so it's older than -min_server_version %s", e.host, *minServerVersion)
+	}
+	return fmt.Sprintf("server %s runs huproxy %s, older than -min_server_version %s", e.host, e.version, *minServerVersion)
+}
+
+func checkMinServerVersion() error {
+	if *minServerVersion == "" {
+		return nil
+	}
+	if _, err := parseVersion(*minServerVersion); err != nil {
+		return fmt.Errorf("invalid -min_server_version: %v", err)
+	}
+	return nil
+}
+
+// checkServerVersion returns a *versionError if the server that sent
+// resp to the upgrade to u is older than -min_server_version.
+func checkServerVersion(u string, resp *http.Response) error {
+	if *minServerVersion == "" || resp == nil {
+		return nil
+	}
+	host := u
+	if pu, err := url.Parse(u); err == nil {
+		host = pu.Host
+	}
+	if _, ok := serverVersionOK.Load(host); ok {
+		return nil
+	}
+	v := resp.Header.Get(huproxy.VersionHeader)
+	have, err := parseVersion(v)
+	if err != nil {
+		return &versionError{host: host, version: v}
+	}
+	want, _ := parseVersion(*minServerVersion)
+	if compareVersions(have, want) < 0 {
+		return &versionError{host: host, version: v}
+	}
+	serverVersionOK.Store(host, true)
+	return nil
+}
+
+// parseVersion splits a dotted version like "0.01" into its numbers.
+func parseVersion(s string) ([]int, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty version")
+	}
+	var v []int
+	for _, f := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad version %q", s)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b. Missing trailing numbers count as 0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logJA3   = flag.Bool("ja3", false, "With -tls_cert, log a JA3-style fingerprint of each client's TLS hello.")
+	blockJA3 = flag.String("block_ja3", "", "With -tls_cert, comma separated fingerprints, or @<filename> with one per line, whose TLS handshakes are refused. Implies -ja3.")
+
+	blockedJA3 = map[string]bool{}
+
+	// Fingerprint of each TLS connection by remote address, from the
+	// handshake until the connection is closed or hijacked.
+	connJA3 sync.Map
+)
+
+// isGREASE returns true for the reserved values (RFC 8701) that clients
+// pick at random, which would make fingerprints differ every time.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func joinUint16(vs []uint16) string {
+	var s []string
+	for _, v := range vs {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+// ja3 returns the MD5 of "version,ciphers,,curves,points", in the format
+// of JA3 but with the extensions left out, as crypto/tls doesn't report
+// them. Fingerprints therefore don't match published JA3 hashes; collect
+// them from the logs instead.
+func ja3(h *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	var points []uint16
+	for _, p := range h.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+	var curves []uint16
+	for _, c := range h.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+	s := fmt.Sprintf("%d,%s,,%s,%s", version, joinUint16(h.CipherSuites), joinUint16(curves), joinUint16(points))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadBlockedJA3 parses -block_ja3.
+func loadBlockedJA3() error {
+	var list []string
+	if strings.HasPrefix(*blockJA3, "@") {
+		b, err := ioutil.ReadFile((*blockJA3)[1:])
+		if err != nil {
+			return err
+		}
+		list = strings.Split(string(b), "\n")
+	} else {
+		list = strings.Split(*blockJA3, ",")
+	}
+	for _, s := range list {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" && !strings.HasPrefix(s, "#") {
+			blockedJA3[s] = true
+		}
+	}
+	return nil
+}
+
+// setupJA3 hooks fingerprinting into the handshakes of s, if enabled.
+func setupJA3(s *http.Server) error {
+	if !*logJA3 && *blockJA3 == "" {
+		return nil
+	}
+	if s.TLSConfig == nil {
+		return fmt.Errorf("-ja3 and -block_ja3 need -tls_cert")
+	}
+	if *blockJA3 != "" {
+		if err := loadBlockedJA3(); err != nil {
+			return err
+		}
+	}
+	s.TLSConfig.GetConfigForClient = func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+		fp := ja3(h)
+		addr := h.Conn.RemoteAddr().String()
+		if blockedJA3[fp] {
+			log.WithFields(log.Fields{"remote": addr, "ja3": fp}).Warning("Refusing TLS handshake with blocked fingerprint")
+			metricRejected.Add("ja3", 1)
+			return nil, fmt.Errorf("blocked fingerprint")
+		}
+		connJA3.Store(addr, fp)
+		return nil, nil
+	}
+	s.ConnState = forgetJA3
+	return nil
+}
+
+func forgetJA3(c net.Conn, st http.ConnState) {
+	if st == http.StateClosed || st == http.StateHijacked {
+		connJA3.Delete(c.RemoteAddr().String())
+	}
+}
+
+// requestJA3 returns the fingerprint of the connection r came in on, if
+// known.
+func requestJA3(r *http.Request) string {
+	if v, ok := connJA3.Load(r.RemoteAddr); ok {
+		return v.(string)
+	}
+	return ""
+}
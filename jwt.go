@@ -0,0 +1,169 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Allowed clock skew between the token issuer and us.
+const jwtLeeway = 30 * time.Second
+
+// jwtVerifier checks JSON Web Tokens signed with one key: an HS256 shared
+// secret, or an RS256 or ES256 public key.
+type jwtVerifier struct {
+	secret []byte
+	rsaKey *rsa.PublicKey
+	ecKey  *ecdsa.PublicKey
+	// Required "iss" claim, if set.
+	issuer string
+}
+
+// loadJWTKey reads a PEM public key or certificate, or else a shared
+// secret, from fn.
+func loadJWTKey(fn string) (*jwtVerifier, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		s := []byte(strings.TrimSpace(string(b)))
+		if len(s) < 32 {
+			return nil, fmt.Errorf("%s: shared secret is shorter than 32 bytes", fn)
+		}
+		return &jwtVerifier{secret: s}, nil
+	}
+	var pub interface{}
+	switch blk.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(blk.Bytes)
+	case "CERTIFICATE":
+		var c *x509.Certificate
+		if c, err = x509.ParseCertificate(blk.Bytes); err == nil {
+			pub = c.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("%s: want a PUBLIC KEY or CERTIFICATE, got %q", fn, blk.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return &jwtVerifier{rsaKey: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("%s: only P-256 keys are supported", fn)
+		}
+		return &jwtVerifier{ecKey: k}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T", fn, pub)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	a := r.Header.Get("Authorization")
+	if len(a) > 7 && strings.EqualFold(a[:7], "bearer ") {
+		return strings.TrimSpace(a[7:])
+	}
+	return ""
+}
+
+// verify checks the signature of token, its expiry and, if set, its issuer.
+func (v *jwtVerifier) verify(token string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return fmt.Errorf("bad header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("bad signature encoding")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch {
+	case v.secret != nil && hdr.Alg == "HS256":
+		m := hmac.New(sha256.New, v.secret)
+		m.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(m.Sum(nil), sig) {
+			return errors.New("bad signature")
+		}
+	case v.rsaKey != nil && hdr.Alg == "RS256":
+		if rsa.VerifyPKCS1v15(v.rsaKey, crypto.SHA256, sum[:], sig) != nil {
+			return errors.New("bad signature")
+		}
+	case v.ecKey != nil && hdr.Alg == "ES256":
+		if len(sig) != 64 {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(v.ecKey, sum[:], r, s) {
+			return errors.New("bad signature")
+		}
+	default:
+		return fmt.Errorf("unexpected algorithm %q", hdr.Alg)
+	}
+
+	var claims struct {
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+		Iss string   `json:"iss"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("bad claims: %v", err)
+	}
+	if claims.Exp == nil {
+		return errors.New("no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.Exp), 0).Add(jwtLeeway)) {
+		return errors.New("expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return errors.New("not yet valid")
+	}
+	if v.issuer != "" && claims.Iss != v.issuer {
+		return fmt.Errorf("issuer %q not accepted", claims.Iss)
+	}
+	return nil
+}
+
+// decodeJWTPart decodes a base64url JSON part of a token into v.
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
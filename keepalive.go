@@ -0,0 +1,52 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var textKeepalive = flag.Duration("text_keepalive", 0, "If nonzero, send an empty text message this often on each tunnel, for proxies that close idle websockets despite pings. Older clients, which don't ignore text messages, fail on them. 0 disables.")
+
+// sendTextKeepalives sends empty text messages on conn every
+// -text_keepalive until ctx is done. Tunnel data is always binary, so
+// clients can tell these apart and drop them.
+func sendTextKeepalives(ctx context.Context, conn *websocket.Conn, mu *sync.Mutex) {
+	t := time.NewTicker(*textKeepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mu.Lock()
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		err := conn.WriteMessage(websocket.TextMessage, nil)
+		conn.SetWriteDeadline(time.Time{})
+		mu.Unlock()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warningf("Sending keepalive to %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
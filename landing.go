@@ -0,0 +1,52 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var landingPage = flag.String("landing_page", "", "Page served on /, as a string or @<filename>. Empty serves a 404.")
+
+// notFound answers unknown paths without saying what server this is.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("Not Found\n"))
+}
+
+// landingHandler returns a handler serving the -landing_page content.
+func landingHandler(page string) (http.Handler, error) {
+	body := []byte(page)
+	if strings.HasPrefix(page, "@") {
+		b, err := ioutil.ReadFile(page[1:])
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	ctype := http.DetectContentType(body)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			notFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Write(body)
+	}), nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// EndReason says why RunClientBridge returned.
+type EndReason string
+
+const (
+	// The input ended, and the websocket was closed (or, with
+	// KeepOpenOnEOF, the peer closed it).
+	EndInputEnded EndReason = "input ended"
+	// The peer closed the websocket normally while the input was still
+	// open.
+	EndPeerClosed EndReason = "peer closed"
+	// The peer closed the websocket saying it's restarting, so a new
+	// tunnel may be opened to carry on.
+	EndPeerRestart EndReason = "peer restarting"
+	// The context was cancelled.
+	EndCancelled EndReason = "cancelled"
+	// Reading from the websocket failed, or the peer closed it abnormally.
+	EndReadFailed EndReason = "websocket read failed"
+	// Sending to the websocket failed.
+	EndWriteFailed EndReason = "websocket write failed"
+	// Reading the input failed.
+	EndInputFailed EndReason = "input failed"
+	// Writing the output failed.
+	EndOutputFailed EndReason = "output failed"
+)
+
+// BridgeOptions tune RunClientBridge.
+type BridgeOptions struct {
+	// How data read from the input becomes messages.
+	Copy CopyOptions
+
+	// If set, the end of the input doesn't close the websocket. Instead
+	// the bridge keeps copying to the output until the peer closes it.
+	KeepOpenOnEOF bool
+
+	// If set, a normal close from the peer doesn't end the bridge until
+	// the input ends too. By default the bridge returns right away,
+	// without waiting for a pending read of the input.
+	WaitForInput bool
+
+	// Timeout for sending the close message. Defaults to a second.
+	CloseTimeout time.Duration
+
+	// How long, once the input ended and the close message was sent, to
+	// keep copying to the output while waiting for the peer's close.
+	// Defaults to DefaultDrainTimeout; negative returns right away.
+	DrainTimeout time.Duration
+
+	// If set, both ends agreed on FeatureIntegrity in the handshake: the
+	// bridge sends an integrity report before its close message, and
+	// checks the peer's.
+	Integrity bool
+
+	// If set, stored 1 once data went either way, as for Copy.Flowed,
+	// which it replaces.
+	Flowed *int32
+
+	// If set, writing to the output is throttled to its rate. Together
+	// with Copy.Limiter, which throttles the input, it may be the same
+	// Limiter, to limit both directions together.
+	OutputLimiter *Limiter
+}
+
+// BridgeResult is how a bridge ended.
+type BridgeResult struct {
+	Reason EndReason
+	// Set for the *Failed reasons, and to the *CloseError for
+	// EndPeerRestart.
+	Err error
+
+	// Bytes read from the input and written to the output.
+	BytesSent     int64
+	BytesReceived int64
+
+	// With Integrity, how the last integrity report of the peer compared,
+	// nil if it sent none.
+	Integrity *IntegrityCheck
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// readOutcome is how reading the websocket ended.
+type readOutcome struct {
+	reason EndReason
+	err    error
+}
+
+// RunClientBridge copies in to conn, and the binary messages received on
+// conn to out, the way huproxyclient tunnels stdin and stdout. Text
+// messages, sent by servers as keepalives, are dropped. When the input
+// ends, a normal close message is sent.
+//
+// It returns as soon as the tunnel is over, which may leave a goroutine
+// blocked reading in; data it reads after that is dropped. The caller
+// closes conn afterwards.
+func RunClientBridge(ctx context.Context, conn *websocket.Conn, in io.Reader, out io.Writer, opts BridgeOptions) *BridgeResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var sent, received int64
+	// Digests of the tunnel data, and the last *IntegrityCheck.
+	var sentDigest, receivedDigest *StreamDigest
+	var check atomic.Value
+	if opts.Integrity {
+		sentDigest, receivedDigest = NewStreamDigest(), NewStreamDigest()
+		opts.Copy.Digest = sentDigest
+	}
+	if opts.Flowed != nil {
+		opts.Copy.Flowed = opts.Flowed
+	}
+	done := func(reason EndReason, err error) *BridgeResult {
+		res := &BridgeResult{
+			Reason:        reason,
+			Err:           err,
+			BytesSent:     atomic.LoadInt64(&sent),
+			BytesReceived: atomic.LoadInt64(&received),
+		}
+		res.Integrity, _ = check.Load().(*IntegrityCheck)
+		return res
+	}
+
+	if opts.OutputLimiter != nil {
+		out = NewRateLimitedWriter(ctx, out, opts.OutputLimiter)
+	}
+
+	// websocket -> out
+	reads := make(chan readOutcome, 1)
+	go func() {
+		for {
+			mt, r, err := conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				reads <- readOutcome{reason: EndPeerClosed}
+				return
+			}
+			if websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				reads <- readOutcome{reason: EndPeerRestart, err: ReadError(err)}
+				return
+			}
+			if err != nil {
+				reads <- readOutcome{reason: EndReadFailed, err: ReadError(err)}
+				return
+			}
+			if mt == websocket.TextMessage {
+				if !opts.Integrity {
+					continue
+				}
+				report, err := ReadIntegrity(r)
+				if err != nil {
+					reads <- readOutcome{reason: EndReadFailed, err: err}
+					return
+				}
+				if report != nil {
+					check.Store(CheckIntegrity(report, sentDigest, receivedDigest))
+				}
+				continue
+			}
+			if mt != websocket.BinaryMessage {
+				reads <- readOutcome{reason: EndReadFailed, err: ErrNonBinaryMessage}
+				return
+			}
+			if receivedDigest != nil {
+				r = io.TeeReader(r, receivedDigest)
+			}
+			n, err := io.Copy(out, r)
+			atomic.AddInt64(&received, n)
+			if n > 0 && opts.Flowed != nil {
+				atomic.StoreInt32(opts.Flowed, 1)
+			}
+			if err != nil && err == ctx.Err() {
+				// Cancelled while throttled.
+				reads <- readOutcome{reason: EndCancelled}
+				return
+			}
+			if err != nil {
+				reads <- readOutcome{reason: EndOutputFailed, err: err}
+				return
+			}
+		}
+	}()
+
+	// in -> websocket
+	copied := make(chan error, 1)
+	go func() {
+		src := &countingReader{r: in, n: &sent}
+		copied <- File2WSOptions(ctx, func() {}, src, conn, opts.Copy)
+	}()
+
+	peerClosed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return done(EndCancelled, nil)
+		case r := <-reads:
+			if r.reason == EndPeerClosed {
+				if !opts.WaitForInput {
+					return done(EndPeerClosed, nil)
+				}
+				peerClosed = true
+				reads = nil
+				continue
+			}
+			return done(r.reason, r.err)
+		case err := <-copied:
+			return done(inputDone(ctx, conn, err, reads, peerClosed, opts, sentDigest, receivedDigest))
+		}
+	}
+}
+
+// inputDone finishes a bridge whose input copy returned err.
+func inputDone(ctx context.Context, conn *websocket.Conn, err error, reads <-chan readOutcome, peerClosed bool, opts BridgeOptions, sent, received *StreamDigest) (EndReason, error) {
+	switch {
+	case err == nil:
+		return EndCancelled, nil
+	case err == io.EOF && opts.KeepOpenOnEOF:
+		// There's no way to tell the other end that we're done
+		// sending, so leave it to the peer to close.
+		if peerClosed {
+			return EndInputEnded, nil
+		}
+		select {
+		case <-ctx.Done():
+			return EndCancelled, nil
+		case r := <-reads:
+			if r.reason == EndPeerClosed {
+				return EndInputEnded, nil
+			}
+			return r.reason, r.err
+		}
+	case err == io.EOF:
+		timeout := opts.CloseTimeout
+		if timeout <= 0 {
+			timeout = closeTimeout
+		}
+		if opts.Integrity && !peerClosed {
+			if err := SendIntegrity(conn, nil, sent, received, timeout); err != nil {
+				log.Errorf("Error sending integrity report: %v", err)
+			}
+		}
+		if err := conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(timeout)); err != nil && err != websocket.ErrCloseSent {
+			log.Errorf("Error sending 'close' message: %v", err)
+			return EndInputEnded, nil
+		}
+		// Wait for the peer's answer, copying any data it sent before,
+		// so that closing conn doesn't reset the connection.
+		drain := opts.DrainTimeout
+		if drain == 0 {
+			drain = DefaultDrainTimeout
+		}
+		if !peerClosed && drain > 0 {
+			t := time.NewTimer(drain)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+			case <-reads:
+			case <-t.C:
+			}
+		}
+		return EndInputEnded, nil
+	}
+	if _, ok := err.(*WriteError); ok {
+		return EndWriteFailed, err
+	}
+	return EndInputFailed, err
+}
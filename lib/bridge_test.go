@@ -0,0 +1,242 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe for the bridge to write while the
+// test reads it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// peerLog is what the peer of a bridge received: the data, and the close
+// code if it got a close before replying.
+type peerLog struct {
+	data  string
+	close int
+}
+
+// readPeer reads data from the bridge until it gets a close or n bytes.
+// n of -1 reads until the close.
+func readPeer(c *websocket.Conn, n int, log *peerLog) bool {
+	for n < 0 || len(log.data) < n {
+		_, b, err := c.ReadMessage()
+		if ce, ok := err.(*websocket.CloseError); ok {
+			log.close = ce.Code
+			return false
+		}
+		if err != nil {
+			return false
+		}
+		log.data += string(b)
+	}
+	return true
+}
+
+func sendClose(c *websocket.Conn) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+func TestRunClientBridge(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		in   string
+		// Whether the input ends after in, or stays open, or ends once the
+		// peer is done.
+		inEnds, inEndsAfterPeer bool
+		opts                    BridgeOptions
+		// The peer; the bridge's input is closed when the bridge
+		// returns, if it's still open.
+		peer       func(*websocket.Conn, *peerLog)
+		cancel     bool
+		wantReason EndReason
+		wantOut    string
+		wantPeer   peerLog
+	}{
+		{
+			desc:   "input ends",
+			in:     "ping",
+			inEnds: true,
+			// Echoes, then answers the close, as websocket does by
+			// default.
+			peer: func(c *websocket.Conn, l *peerLog) {
+				readPeer(c, 4, l)
+				c.WriteMessage(websocket.BinaryMessage, []byte(l.data))
+				readPeer(c, -1, l)
+			},
+			wantReason: EndInputEnded,
+			wantOut:    "ping",
+			wantPeer:   peerLog{"ping", websocket.CloseNormalClosure},
+		},
+		{
+			desc:   "keep open on EOF",
+			in:     "ping",
+			inEnds: true,
+			opts:   BridgeOptions{KeepOpenOnEOF: true},
+			// The answer comes after the input ended, and no close is
+			// sent until the peer's.
+			peer: func(c *websocket.Conn, l *peerLog) {
+				readPeer(c, 4, l)
+				rest := make(chan peerLog, 1)
+				go func() {
+					var r peerLog
+					readPeer(c, -1, &r)
+					rest <- r
+				}()
+				select {
+				case r := <-rest:
+					l.data += r.data
+					// Closed before the peer did.
+					l.close = -r.close
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+				c.WriteMessage(websocket.BinaryMessage, []byte("pong"))
+				sendClose(c)
+				r := <-rest
+				l.data += r.data
+				l.close = r.close
+			},
+			wantReason: EndInputEnded,
+			wantOut:    "pong",
+			wantPeer:   peerLog{"ping", websocket.CloseNormalClosure},
+		},
+		{
+			desc: "peer closes",
+			in:   "ping",
+			peer: func(c *websocket.Conn, l *peerLog) {
+				readPeer(c, 4, l)
+				c.WriteMessage(websocket.BinaryMessage, []byte("bye"))
+				sendClose(c)
+			},
+			wantReason: EndPeerClosed,
+			wantOut:    "bye",
+			wantPeer:   peerLog{"ping", 0},
+		},
+		{
+			desc:            "peer closes, waiting for input",
+			in:              "ping",
+			inEndsAfterPeer: true,
+			opts:            BridgeOptions{WaitForInput: true},
+			peer: func(c *websocket.Conn, l *peerLog) {
+				readPeer(c, 4, l)
+				sendClose(c)
+				readPeer(c, -1, l)
+			},
+			wantReason: EndInputEnded,
+			wantPeer:   peerLog{"ping", websocket.CloseNormalClosure},
+		},
+		{
+			desc:       "cancelled",
+			in:         "ping",
+			peer:       func(c *websocket.Conn, l *peerLog) { readPeer(c, 4, l) },
+			cancel:     true,
+			wantReason: EndCancelled,
+			wantPeer:   peerLog{"ping", 0},
+		},
+	} {
+		test := test
+		client, server := wsPair(t)
+		pr, pw := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		peerDone := make(chan peerLog, 1)
+		peerFinished := make(chan struct{})
+		go func() {
+			var l peerLog
+			test.peer(server, &l)
+			if test.cancel {
+				cancel()
+			}
+			close(peerFinished)
+			peerDone <- l
+		}()
+		go func() {
+			pw.Write([]byte(test.in))
+			if test.inEndsAfterPeer {
+				<-peerFinished
+			}
+			if test.inEnds || test.inEndsAfterPeer {
+				pw.Close()
+			}
+		}()
+		out := &syncBuffer{}
+		test.opts.DrainTimeout = time.Second
+		res := RunClientBridge(ctx, client, pr, out, test.opts)
+		cancel()
+		pw.Close()
+		if res.Reason != test.wantReason {
+			t.Errorf("%s: ended with %v (%v), want %v", test.desc, res.Reason, res.Err, test.wantReason)
+		}
+		if got := out.String(); got != test.wantOut {
+			t.Errorf("%s: output %q, want %q", test.desc, got, test.wantOut)
+		}
+		if res.BytesSent != int64(len(test.in)) || res.BytesReceived != int64(len(test.wantOut)) {
+			t.Errorf("%s: %d bytes sent, %d received; want %d, %d", test.desc, res.BytesSent, res.BytesReceived, len(test.in), len(test.wantOut))
+		}
+		client.Close()
+		if got := <-peerDone; got != test.wantPeer {
+			t.Errorf("%s: peer got %+v, want %+v", test.desc, got, test.wantPeer)
+		}
+	}
+}
+
+func TestRunClientBridgeNoAnswer(t *testing.T) {
+	// A peer that never answers the close delays the end by DrainTimeout,
+	// and no more.
+	for _, drain := range []time.Duration{-1, 50 * time.Millisecond} {
+		client, server := wsPair(t)
+		server.SetCloseHandler(func(int, string) error { return nil })
+		go func() {
+			for {
+				if _, _, err := server.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		start := time.Now()
+		res := RunClientBridge(context.Background(), client, strings.NewReader("ping"), ioutil.Discard, BridgeOptions{DrainTimeout: drain})
+		took := time.Since(start)
+		if res.Reason != EndInputEnded {
+			t.Errorf("DrainTimeout %v: ended with %v (%v), want %v", drain, res.Reason, res.Err, EndInputEnded)
+		}
+		if took < drain || took > drain+time.Second {
+			t.Errorf("DrainTimeout %v: took %v", drain, took)
+		}
+	}
+}
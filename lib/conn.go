@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long Close waits to send the close message.
+const closeTimeout = time.Second
+
+// conn is a net.Conn over the binary messages of a websocket.
+type conn struct {
+	ws *websocket.Conn
+
+	// Reader of the message being read, if any.
+	r io.Reader
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewConn returns a net.Conn that sends what's written to it as binary
+// websocket messages, and reads the stream of binary messages received,
+// regardless of message boundaries. A normal close from the peer reads as
+// io.EOF, and any other close as *CloseError. Text messages are keepalives,
+// not tunnel data, and Read drops them; any other kind of message is
+// ErrNonBinaryMessage. Close sends a normal close message, then closes the
+// websocket.
+//
+// As with the websocket, one goroutine may read while another writes.
+func NewConn(ws *websocket.Conn) net.Conn {
+	return &conn{ws: ws}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, ReadError(err)
+			}
+			if mt == websocket.TextMessage {
+				// Keepalive from the server, not tunnel data.
+				continue
+			}
+			if mt != websocket.BinaryMessage {
+				return 0, ErrNonBinaryMessage
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, &WriteError{Err: err}
+	}
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		err := c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(closeTimeout))
+		if err == websocket.ErrCloseSent {
+			err = nil
+		}
+		if cerr := c.ws.Close(); err == nil {
+			c.closeErr = cerr
+		} else {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *conn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *conn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,114 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsMessage struct {
+	typ  int
+	data string
+}
+
+func TestConnRead(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		msgs     []wsMessage
+		close    []byte
+		want     string
+		wantCode int // 0 for io.EOF
+	}{
+		{
+			desc:  "binary messages are one stream",
+			msgs:  []wsMessage{{websocket.BinaryMessage, "ab"}, {websocket.BinaryMessage, ""}, {websocket.BinaryMessage, "cd"}},
+			close: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			want:  "abcd",
+		},
+		{
+			desc:  "text messages are dropped",
+			msgs:  []wsMessage{{websocket.TextMessage, "keepalive"}, {websocket.BinaryMessage, "ab"}, {websocket.TextMessage, "keepalive"}},
+			close: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			want:  "ab",
+		},
+		{
+			desc:     "other close",
+			msgs:     []wsMessage{{websocket.BinaryMessage, "ab"}},
+			close:    websocket.FormatCloseMessage(websocket.CloseGoingAway, "restarting"),
+			want:     "ab",
+			wantCode: websocket.CloseGoingAway,
+		},
+	} {
+		client, server := wsPair(t)
+		for _, m := range test.msgs {
+			if err := server.WriteMessage(m.typ, []byte(m.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := server.WriteMessage(websocket.CloseMessage, test.close); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(NewConn(client))
+		if string(got) != test.want {
+			t.Errorf("%s: read %q, want %q", test.desc, got, test.want)
+		}
+		var ce *CloseError
+		switch {
+		case test.wantCode == 0 && err != nil:
+			t.Errorf("%s: got %v, want io.EOF", test.desc, err)
+		case test.wantCode != 0 && !errors.As(err, &ce):
+			t.Errorf("%s: got %v, want *CloseError", test.desc, err)
+		case test.wantCode != 0 && ce.Code != test.wantCode:
+			t.Errorf("%s: got close code %d, want %d", test.desc, ce.Code, test.wantCode)
+		}
+	}
+}
+
+func TestConnWriteClose(t *testing.T) {
+	client, server := wsPair(t)
+	c := NewConn(client)
+	if n, err := c.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	mt, b, err := server.ReadMessage()
+	if mt != websocket.BinaryMessage || string(b) != "hello" || err != nil {
+		t.Errorf("ReadMessage = %d, %q, %v; want a binary \"hello\"", mt, b, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close #%d: %v", i+1, err)
+		}
+	}
+	if _, _, err := server.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("server read %v after Close, want a normal close", err)
+	}
+	var we *WriteError
+	if _, err := c.Write([]byte("late")); !errors.As(err, &we) {
+		t.Errorf("Write after Close = %v, want *WriteError", err)
+	}
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	client, _ := wsPair(t)
+	c := NewConn(client)
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Write([]byte("x")); !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("Write past the deadline = %v, want ErrWriteTimeout", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultDrainTimeout is how long to wait for the peer to answer a close
+// message.
+const DefaultDrainTimeout = time.Second
+
+// DrainClose finishes the close handshake after a close message was sent
+// on conn: it reads and discards whatever the peer sent before its own
+// close message, until that arrives or timeout passes, so that closing
+// conn afterwards doesn't reset the connection under unread data.
+//
+// It returns nil if the peer closed normally, a *CloseError if it closed
+// with another code, and otherwise the error that ended reading. Since
+// only one goroutine may read conn, call it only once nothing else does,
+// and not after a read has already failed.
+func DrainClose(conn *websocket.Conn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, r, err := conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		if err != nil {
+			return ReadError(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return ReadError(err)
+		}
+	}
+}
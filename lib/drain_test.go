@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDrainClose(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		msgs     []wsMessage
+		close    []byte // nil for none
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			desc:  "normal close",
+			close: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		},
+		{
+			desc:  "data before the close",
+			msgs:  []wsMessage{{websocket.BinaryMessage, "late"}, {websocket.TextMessage, "keepalive"}},
+			close: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		},
+		{
+			desc:     "other close",
+			close:    websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "oops"),
+			wantErr:  true,
+			wantCode: websocket.CloseInternalServerErr,
+		},
+		{
+			desc:    "no close",
+			wantErr: true,
+		},
+	} {
+		client, server := wsPair(t)
+		for _, m := range test.msgs {
+			if err := server.WriteMessage(m.typ, []byte(m.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.close != nil {
+			if err := server.WriteMessage(websocket.CloseMessage, test.close); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := DrainClose(client, 100*time.Millisecond)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: DrainClose = %v, want error %v", test.desc, err, test.wantErr)
+		}
+		var ce *CloseError
+		if test.wantCode != 0 && (!errors.As(err, &ce) || ce.Code != test.wantCode) {
+			t.Errorf("%s: DrainClose = %v, want close code %d", test.desc, err, test.wantCode)
+		}
+		if err == io.EOF {
+			t.Errorf("%s: DrainClose returned io.EOF", test.desc)
+		}
+	}
+}
+
+// TestDrainCloseRoundTrip sends a close with each code and reason to a
+// peer answering it as websocket does by default, and checks both ends
+// see the code, and the peer the reason.
+func TestDrainCloseRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		code   int
+		reason string
+	}{
+		{websocket.CloseNormalClosure, ""},
+		{websocket.CloseNormalClosure, "input ended"},
+		{websocket.CloseGoingAway, "terminated by admin"},
+		{websocket.CloseServiceRestart, "restarting"},
+		{websocket.CloseInternalServerErr, ""},
+	} {
+		client, server := wsPair(t)
+		got := make(chan error, 1)
+		go func() {
+			for {
+				if _, _, err := server.NextReader(); err != nil {
+					got <- err
+					return
+				}
+			}
+		}()
+		if err := client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(test.code, test.reason), time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		err := DrainClose(client, time.Second)
+		var ce *CloseError
+		switch {
+		case test.code == websocket.CloseNormalClosure && err != nil:
+			t.Errorf("close %d %q: DrainClose = %v, want nil", test.code, test.reason, err)
+		case test.code != websocket.CloseNormalClosure && (!errors.As(err, &ce) || ce.Code != test.code):
+			t.Errorf("close %d %q: DrainClose = %v, want the close code answered", test.code, test.reason, err)
+		}
+		var wce *websocket.CloseError
+		if err := <-got; !errors.As(err, &wce) || wce.Code != test.code || wce.Text != test.reason {
+			t.Errorf("close %d %q: peer read %v", test.code, test.reason, err)
+		}
+	}
+}
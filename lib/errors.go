@@ -0,0 +1,78 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNonBinaryMessage is returned when the peer sends a message that
+	// is neither binary tunnel data nor a text keepalive.
+	ErrNonBinaryMessage = errors.New("non-binary websocket message received")
+
+	// ErrWriteTimeout matches, with errors.Is, a WriteError caused by the
+	// websocket write deadline passing.
+	ErrWriteTimeout = errors.New("timed out writing websocket message")
+)
+
+// WriteError is returned by File2WS and File2WSOptions when sending to the
+// websocket fails, as opposed to reading from the source, whose errors are
+// returned as is.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string { return fmt.Sprintf("writing websocket message: %v", e.Err) }
+func (e *WriteError) Unwrap() error { return e.Err }
+
+func (e *WriteError) Is(target error) bool {
+	if target != ErrWriteTimeout {
+		return false
+	}
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// CloseError is a close message received from the peer, other than a
+// normal close.
+type CloseError struct {
+	Code int
+	Text string
+
+	err *websocket.CloseError
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket closed by peer with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed by peer with code %d: %s", e.Code, e.Text)
+}
+
+func (e *CloseError) Unwrap() error { return e.err }
+
+// ReadError turns an error from reading the websocket into one of the
+// errors above where one applies, and otherwise returns it unchanged.
+func ReadError(err error) error {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return &CloseError{Code: ce.Code, Text: ce.Text, err: ce}
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteErrorIs(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{timeoutError{}, true},
+		{fmt.Errorf("wrapped: %w", timeoutError{}), true},
+		{io.ErrClosedPipe, false},
+		{websocket.ErrCloseSent, false},
+	} {
+		err := error(&WriteError{Err: test.err})
+		if got := errors.Is(err, ErrWriteTimeout); got != test.want {
+			t.Errorf("errors.Is(%v, ErrWriteTimeout) = %v, want %v", err, got, test.want)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("errors.Is(%v, %v) = false, want it to unwrap", err, test.err)
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		wantCode int // 0 for err unchanged
+		wantMsg  string
+	}{
+		{&websocket.CloseError{Code: websocket.CloseGoingAway, Text: "bye"}, websocket.CloseGoingAway, "websocket closed by peer with code 1001: bye"},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, websocket.CloseAbnormalClosure, "websocket closed by peer with code 1006"},
+		{fmt.Errorf("reading: %w", &websocket.CloseError{Code: websocket.ClosePolicyViolation}), websocket.ClosePolicyViolation, "websocket closed by peer with code 1008"},
+		{io.ErrUnexpectedEOF, 0, io.ErrUnexpectedEOF.Error()},
+	} {
+		err := ReadError(test.err)
+		if err.Error() != test.wantMsg {
+			t.Errorf("ReadError(%v) = %q, want %q", test.err, err, test.wantMsg)
+		}
+		var ce *CloseError
+		if test.wantCode == 0 {
+			if err != test.err {
+				t.Errorf("ReadError(%v) = %v, want it unchanged", test.err, err)
+			}
+			continue
+		}
+		if !errors.As(err, &ce) || ce.Code != test.wantCode {
+			t.Errorf("ReadError(%v) = %v, want *CloseError with code %d", test.err, err, test.wantCode)
+		}
+		var wce *websocket.CloseError
+		if !errors.As(err, &wce) {
+			t.Errorf("ReadError(%v) doesn't unwrap to *websocket.CloseError", test.err)
+		}
+	}
+}
+
+// errReader fails reading with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// errWriter fails writing with err.
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestFile2WSErrors(t *testing.T) {
+	srcErr := errors.New("source failed")
+	for _, test := range []struct {
+		desc        string
+		src         io.Reader
+		setup       func(*websocket.Conn)
+		opts        CopyOptions
+		wantWrite   bool
+		wantTimeout bool
+		want        error
+	}{
+		{desc: "source error", src: errReader{srcErr}, want: srcErr},
+		{desc: "queued source error", src: errReader{srcErr}, opts: CopyOptions{QueueSize: 2}, want: srcErr},
+		{
+			desc:      "closed websocket",
+			src:       strings.NewReader("data"),
+			setup:     func(c *websocket.Conn) { c.UnderlyingConn().Close() },
+			wantWrite: true,
+		},
+		{
+			desc:      "queued closed websocket",
+			src:       strings.NewReader("data"),
+			setup:     func(c *websocket.Conn) { c.UnderlyingConn().Close() },
+			opts:      CopyOptions{QueueSize: 2},
+			wantWrite: true,
+		},
+		{
+			desc:        "write deadline",
+			src:         strings.NewReader("data"),
+			setup:       func(c *websocket.Conn) { c.SetWriteDeadline(time.Now().Add(-time.Second)) },
+			wantWrite:   true,
+			wantTimeout: true,
+		},
+		{
+			desc:        "coalesced write deadline",
+			src:         strings.NewReader("data"),
+			setup:       func(c *websocket.Conn) { c.SetWriteDeadline(time.Now().Add(-time.Second)) },
+			opts:        CopyOptions{CoalesceDelay: time.Millisecond},
+			wantWrite:   true,
+			wantTimeout: true,
+		},
+	} {
+		client, _ := wsPair(t)
+		if test.setup != nil {
+			test.setup(client)
+		}
+		err := File2WSOptions(context.Background(), func() {}, test.src, client, test.opts)
+		var we *WriteError
+		if got := errors.As(err, &we); got != test.wantWrite {
+			t.Errorf("%s: got %v, want *WriteError %v", test.desc, err, test.wantWrite)
+		}
+		if got := errors.Is(err, ErrWriteTimeout); got != test.wantTimeout {
+			t.Errorf("%s: got %v, want ErrWriteTimeout %v", test.desc, err, test.wantTimeout)
+		}
+		if test.want != nil && err != test.want {
+			t.Errorf("%s: got %v, want %v", test.desc, err, test.want)
+		}
+	}
+}
+
+func TestBridgeErrors(t *testing.T) {
+	inErr, outErr := errors.New("input failed"), errors.New("output failed")
+	closeWith := func(code int, text string) func(*websocket.Conn) {
+		return func(c *websocket.Conn) {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+		}
+	}
+	for _, test := range []struct {
+		desc       string
+		in         io.Reader // nil for one that never ends
+		out        io.Writer // nil for one that works
+		peer       func(*websocket.Conn)
+		wantReason EndReason
+		wantCode   int // of the *CloseError, if any
+		want       error
+	}{
+		{"peer going away", nil, nil, closeWith(websocket.CloseGoingAway, "bye"), EndReadFailed, websocket.CloseGoingAway, nil},
+		{"peer restarting", nil, nil, closeWith(websocket.CloseServiceRestart, ""), EndPeerRestart, websocket.CloseServiceRestart, nil},
+		{"peer gone", nil, nil, func(c *websocket.Conn) { c.UnderlyingConn().Close() }, EndReadFailed, websocket.CloseAbnormalClosure, nil},
+		{"peer closed", nil, nil, closeWith(websocket.CloseNormalClosure, ""), EndPeerClosed, 0, nil},
+		{"input failed", errReader{inErr}, nil, func(*websocket.Conn) {}, EndInputFailed, 0, inErr},
+		{"output failed", nil, errWriter{outErr}, func(c *websocket.Conn) { c.WriteMessage(websocket.BinaryMessage, []byte("x")) }, EndOutputFailed, 0, outErr},
+	} {
+		client, server := wsPair(t)
+		in, out := test.in, test.out
+		if in == nil {
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			in = pr
+		}
+		if out == nil {
+			out = ioutil.Discard
+		}
+		test.peer(server)
+		res := RunClientBridge(context.Background(), client, in, out, BridgeOptions{DrainTimeout: -1})
+		if res.Reason != test.wantReason {
+			t.Errorf("%s: ended with %v (%v), want %v", test.desc, res.Reason, res.Err, test.wantReason)
+		}
+		var ce *CloseError
+		if got := errors.As(res.Err, &ce); got != (test.wantCode != 0) {
+			t.Errorf("%s: got %v, want *CloseError %v", test.desc, res.Err, test.wantCode != 0)
+		} else if got && ce.Code != test.wantCode {
+			t.Errorf("%s: got close code %d, want %d", test.desc, ce.Code, test.wantCode)
+		}
+		if test.want != nil && !errors.Is(res.Err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, res.Err, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandshakeHeader is sent by clients in the upgrade request to offer the
+// handshake, and echoed by servers in the response to accept it. Peers
+// that don't know about it tunnel as before, so either end can be older.
+const HandshakeHeader = "X-Huproxy-Handshake"
+
+// DefaultHandshakeTimeout is how long to wait for the peer's capabilities
+// once the handshake has been agreed on.
+const DefaultHandshakeTimeout = 5 * time.Second
+
+// ErrHandshakeTimeout is returned when the handshake was agreed on but the
+// peer's capabilities didn't arrive in time. The websocket is broken then,
+// so clients fall back to a raw tunnel by dialing again without the offer.
+var ErrHandshakeTimeout = errors.New("no handshake from the peer in time")
+
+// Capabilities are what each end announces in the handshake.
+type Capabilities struct {
+	// huproxy version of the sender.
+	Version string `json:"version"`
+	// Optional features the sender supports.
+	Features []string `json:"features,omitempty"`
+}
+
+// Handshake is the outcome of a handshake.
+type Handshake struct {
+	// What the peer announced.
+	Peer Capabilities
+	// Features both ends support, in the order of ours.
+	Features []string
+}
+
+// Has returns true if both ends support feature.
+func (h *Handshake) Has(feature string) bool {
+	if h == nil {
+		return false
+	}
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// OfferHandshake adds the offer of a handshake to the headers of a
+// client's upgrade request.
+func OfferHandshake(h http.Header) {
+	h.Set(HandshakeHeader, "1")
+}
+
+// AcceptHandshake returns true if r offered a handshake, in which case it
+// adds the acceptance to the headers of the server's upgrade response.
+func AcceptHandshake(r *http.Request, resp http.Header) bool {
+	if r.Header.Get(HandshakeHeader) != "1" {
+		return false
+	}
+	resp.Set(HandshakeHeader, "1")
+	return true
+}
+
+// ClientHandshake runs the handshake on a websocket freshly opened with
+// OfferHandshake, before any tunnel data is sent. resp is the upgrade
+// response. If the server didn't accept the handshake, it returns nil and
+// the tunnel carries on as raw binary messages. If the server accepted it
+// but didn't send its capabilities within timeout, it returns
+// ErrHandshakeTimeout.
+func ClientHandshake(conn *websocket.Conn, resp *http.Response, mine Capabilities, timeout time.Duration) (*Handshake, error) {
+	if resp == nil || resp.Header.Get(HandshakeHeader) != "1" {
+		return nil, nil
+	}
+	return exchange(conn, mine, timeout)
+}
+
+// ServerHandshake runs the handshake on a websocket freshly upgraded, if
+// AcceptHandshake returned true, before any tunnel data is sent.
+func ServerHandshake(conn *websocket.Conn, mine Capabilities, timeout time.Duration) (*Handshake, error) {
+	return exchange(conn, mine, timeout)
+}
+
+// exchange sends mine and reads the peer's capabilities, each in a text
+// message. As both ends send first, neither waits for the other.
+func exchange(conn *websocket.Conn, mine Capabilities, timeout time.Duration) (*Handshake, error) {
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	b, err := json.Marshal(&mine)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		return nil, &WriteError{Err: err}
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	// A read timing out breaks the websocket, so the tunnel is given up
+	// on then, for the client to open again without the handshake.
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	mt, msg, err := conn.ReadMessage()
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil, ErrHandshakeTimeout
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading handshake: %w", ReadError(err))
+	}
+	if mt != websocket.TextMessage {
+		return nil, fmt.Errorf("got a binary message instead of the handshake")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	h := &Handshake{}
+	if err := json.Unmarshal(msg, &h.Peer); err != nil {
+		return nil, fmt.Errorf("parsing handshake: %v", err)
+	}
+	for _, f := range mine.Features {
+		for _, pf := range h.Peer.Features {
+			if f == pf {
+				h.Features = append(h.Features, f)
+				break
+			}
+		}
+	}
+	return h, nil
+}
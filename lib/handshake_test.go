@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandshake(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	clientCaps := Capabilities{Version: "client", Features: []string{"a", "b"}}
+	serverCaps := Capabilities{Version: "server", Features: []string{"b", "c"}}
+	type result struct {
+		hs  *Handshake
+		err error
+	}
+	// Old ends don't know about the handshake, silent ones agree on it
+	// but never send their capabilities.
+	for _, test := range []struct {
+		desc          string
+		client        string
+		server        string
+		wantClient    []string
+		wantClientErr error
+		wantServer    []string
+		wantServerErr error
+	}{
+		{"both new", "new", "new", []string{"b"}, nil, []string{"b"}, nil},
+		{"new client, old server", "new", "old", nil, nil, nil, nil},
+		{"old client, new server", "old", "new", nil, nil, nil, nil},
+		{"silent server", "new", "silent", nil, ErrHandshakeTimeout, nil, nil},
+		{"silent client", "silent", "new", nil, nil, nil, ErrHandshakeTimeout},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			server := make(chan result, 1)
+			var up websocket.Upgrader
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := http.Header{}
+				accepted := test.server != "old" && AcceptHandshake(r, h)
+				c, err := up.Upgrade(w, r, h)
+				if err != nil {
+					t.Error(err)
+					server <- result{}
+					return
+				}
+				defer c.Close()
+				var res result
+				if accepted && test.server == "new" {
+					res.hs, res.err = ServerHandshake(c, serverCaps, timeout)
+				}
+				server <- res
+				if res.err != nil {
+					return
+				}
+				if test.server == "silent" {
+					for {
+						if _, _, err := c.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}
+				// Echo the first tunnel message.
+				mt, msg, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				c.WriteMessage(mt, msg)
+			}))
+			defer srv.Close()
+
+			head := http.Header{}
+			if test.client != "old" {
+				OfferHandshake(head)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), head)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var client result
+			if test.client == "new" {
+				client.hs, client.err = ClientHandshake(conn, resp, clientCaps, timeout)
+			}
+			if !errors.Is(client.err, test.wantClientErr) {
+				t.Errorf("Client got error %v, want %v", client.err, test.wantClientErr)
+			}
+			var got []string
+			if client.hs != nil {
+				got = client.hs.Features
+			}
+			if !reflect.DeepEqual(got, test.wantClient) {
+				t.Errorf("Client got common features %q, want %q", got, test.wantClient)
+			}
+			if test.client == "silent" {
+				// Nothing to answer the server's capabilities
+				// with for it to time out on.
+				time.Sleep(2 * timeout)
+			}
+
+			res := <-server
+			if !errors.Is(res.err, test.wantServerErr) {
+				t.Errorf("Server got error %v, want %v", res.err, test.wantServerErr)
+			}
+			got = nil
+			if res.hs != nil {
+				got = res.hs.Features
+			}
+			if !reflect.DeepEqual(got, test.wantServer) {
+				t.Errorf("Server got common features %q, want %q", got, test.wantServer)
+			}
+			if client.err != nil || res.err != nil || test.client == "silent" {
+				return
+			}
+
+			// Whether or not the handshake happened, the tunnel
+			// carries on in binary messages.
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("data")); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != websocket.BinaryMessage || string(msg) != "data" {
+				t.Errorf("Got message %d %q back, want the binary %q", mt, msg, "data")
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// FeatureIntegrity is the handshake feature for checking that a tunnel's
+// data arrived intact. An end agreeing on it sends, as it closes the
+// tunnel or answers the peer's, a text message with the length and
+// SHA-256 of the tunnel data it sent and received so far:
+//
+//	{"integrity":{"sent_bytes":N,"sent_sha256":"<hex>","received_bytes":N,"received_sha256":"<hex>"}}
+//
+// Data only counts once sent as, or received in, binary messages, so the
+// sent digest covers exactly the messages before the report, and the
+// receiver can compare it with what it got. The received digest can only
+// be compared if nothing was still on the way.
+const FeatureIntegrity = "integrity-sha256"
+
+// Largest integrity report accepted.
+const maxIntegrityMessage = 1024
+
+// StreamDigest is a running SHA-256 of the data of one direction of a
+// tunnel. It's safe for concurrent use.
+type StreamDigest struct {
+	mu sync.Mutex
+	h  hash.Hash
+	n  int64
+}
+
+// NewStreamDigest returns the digest of no data.
+func NewStreamDigest() *StreamDigest {
+	return &StreamDigest{h: sha256.New()}
+}
+
+// Write adds b to the digest.
+func (d *StreamDigest) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.h.Write(b)
+	d.n += int64(len(b))
+	return len(b), nil
+}
+
+// Sum returns the length and hex SHA-256 of the data so far.
+func (d *StreamDigest) Sum() (int64, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.n, hex.EncodeToString(d.h.Sum(nil))
+}
+
+// IntegrityReport is what one end sent and received.
+type IntegrityReport struct {
+	SentBytes      int64  `json:"sent_bytes"`
+	SentSHA256     string `json:"sent_sha256"`
+	ReceivedBytes  int64  `json:"received_bytes"`
+	ReceivedSHA256 string `json:"received_sha256"`
+}
+
+type integrityMessage struct {
+	Integrity *IntegrityReport `json:"integrity"`
+}
+
+// SendIntegrity sends the integrity report of sent and received. If mu
+// is set it's held while sending, as for CopyOptions.WriteMu, which must
+// also be what sent is fed under.
+func SendIntegrity(conn *websocket.Conn, mu *sync.Mutex, sent, received *StreamDigest, timeout time.Duration) error {
+	if mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	r := &IntegrityReport{}
+	r.SentBytes, r.SentSHA256 = sent.Sum()
+	r.ReceivedBytes, r.ReceivedSHA256 = received.Sum()
+	b, err := json.Marshal(&integrityMessage{Integrity: r})
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+// ReadIntegrity reads a text message as an integrity report. It returns
+// nil for anything else, such as an empty keepalive.
+func ReadIntegrity(r io.Reader) (*IntegrityReport, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxIntegrityMessage+1))
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	if len(b) > maxIntegrityMessage {
+		return nil, fmt.Errorf("text message over %d bytes", maxIntegrityMessage)
+	}
+	var m integrityMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parsing integrity report: %v", err)
+	}
+	return m.Integrity, nil
+}
+
+// IntegrityCheck is how the peer's report compared with this end's.
+type IntegrityCheck struct {
+	// Set if the data differed in either direction.
+	Err error
+	// False if data sent to the peer was still on the way, so that only
+	// the data received from it was checked.
+	Complete bool
+}
+
+// CheckIntegrity compares the peer's report with the digests of what
+// this end sent and received. Whatever the peer says it sent must have
+// been received by the time its report is.
+func CheckIntegrity(peer *IntegrityReport, sent, received *StreamDigest) *IntegrityCheck {
+	rn, rsum := received.Sum()
+	if peer.SentBytes != rn || peer.SentSHA256 != rsum {
+		return &IntegrityCheck{Err: fmt.Errorf("data from the peer differs: it sent %d bytes with SHA-256 %s, %d bytes with SHA-256 %s arrived", peer.SentBytes, peer.SentSHA256, rn, rsum)}
+	}
+	sn, ssum := sent.Sum()
+	switch {
+	case peer.ReceivedBytes > sn:
+		return &IntegrityCheck{Err: fmt.Errorf("data to the peer differs: %d bytes were sent, it received %d", sn, peer.ReceivedBytes)}
+	case peer.ReceivedBytes < sn:
+		return &IntegrityCheck{}
+	case peer.ReceivedSHA256 != ssum:
+		return &IntegrityCheck{Err: fmt.Errorf("data to the peer differs: %d bytes were sent with SHA-256 %s, it received them with SHA-256 %s", sn, ssum, peer.ReceivedSHA256)}
+	}
+	return &IntegrityCheck{Complete: true}
+}
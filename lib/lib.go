@@ -16,33 +16,200 @@ package lib
 import (
 	"context"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	Version = "0.01"
 )
 
+// VersionHeader is the response header in which the server sends its
+// Version when upgrading to a websocket.
+const VersionHeader = "X-Huproxy-Version"
+
+// ConnectionIDHeader is the response header in which the server sends the
+// id it gave the tunnel request, also in its logs, so that the two can be
+// matched up. It's sent with refusals too.
+const ConnectionIDHeader = "X-Huproxy-Connection-Id"
+
+// ProtocolHeader is the request header in which clients may say what
+// protocol they tunnel, such as "ssh", for servers that handle some
+// protocols specially.
+const ProtocolHeader = "X-Huproxy-Protocol"
+
+// Default size of the read buffer, which is also the max size of the
+// websocket messages sent.
+const DefaultBufferSize = 32 * 1024
+
+// CopyOptions tune how File2WSOptions turns the stream into messages.
+type CopyOptions struct {
+	// Read buffer size. Defaults to DefaultBufferSize.
+	BufferSize int
+
+	// If nonzero, data read is held for up to this long so that it can be
+	// sent as one message together with what's read next, up to
+	// BufferSize. This trades latency for fewer, larger messages.
+	CoalesceDelay time.Duration
+
+	// If nonzero, up to this many reads are queued while waiting for the
+	// websocket to accept earlier data, bounding the data buffered to
+	// QueueSize*BufferSize. Once the queue is full, reading blocks.
+	QueueSize int
+
+	// If set, called from the reading goroutine each time a read finds
+	// the queue full, meaning the websocket is the bottleneck.
+	OnQueueFull func(queued int)
+
+	// If set, held while sending each message, so that others can send
+	// messages on the websocket too.
+	WriteMu *sync.Mutex
+
+	// If set, reading the source is throttled to its rate.
+	Limiter *Limiter
+
+	// If set, fed with the data of each message sent, while holding
+	// WriteMu.
+	Digest *StreamDigest
+
+	// If set, stored 1 once a message with data was sent.
+	Flowed *int32
+}
+
+// write sends b as a binary message.
+func (opts *CopyOptions) write(dst *websocket.Conn, b []byte) error {
+	if opts.WriteMu != nil {
+		opts.WriteMu.Lock()
+		defer opts.WriteMu.Unlock()
+	}
+	if err := dst.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return &WriteError{Err: err}
+	}
+	if opts.Digest != nil {
+		opts.Digest.Write(b)
+	}
+	if opts.Flowed != nil && len(b) > 0 {
+		atomic.StoreInt32(opts.Flowed, 1)
+	}
+	return nil
+}
+
 // File2WS copies everything from the reader into the websocket,
-// stopping on error or context cancellation.
+// stopping on error or context cancellation. Failures to send are
+// returned as *WriteError.
 func File2WS(ctx context.Context, cancel func(), src io.Reader, dst *websocket.Conn) error {
+	return File2WSOptions(ctx, cancel, src, dst, CopyOptions{})
+}
+
+// File2WSOptions is like File2WS, with options.
+func File2WSOptions(ctx context.Context, cancel func(), src io.Reader, dst *websocket.Conn, opts CopyOptions) error {
 	defer cancel()
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if opts.Limiter != nil {
+		src = NewRateLimitedReader(ctx, src, opts.Limiter)
+	}
+	if opts.CoalesceDelay > 0 || opts.QueueSize > 0 {
+		return queued(ctx, src, dst, size, opts)
+	}
 	for {
 		if ctx.Err() != nil {
 			return nil
 		}
-		b := make([]byte, 32*1024)
+		b := make([]byte, size)
 		if n, err := src.Read(b); err != nil {
+			if err == ctx.Err() {
+				// Cancelled while throttled.
+				return nil
+			}
 			return err
 		} else {
 			b = b[:n]
 		}
 		//log.Printf("->ws %d bytes: %q", len(b), string(b))
-		if err := dst.WriteMessage(websocket.BinaryMessage, b); err != nil {
-			log.Warningf("Writing websockt message: %v", err)
+		if err := opts.write(dst, b); err != nil {
+			log.Warning(err)
 			return err
 		}
 	}
 }
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+// queued copies src to dst with reading and sending decoupled by a
+// bounded queue, optionally batching reads made within CoalesceDelay of
+// each other into one message.
+func queued(ctx context.Context, src io.Reader, dst *websocket.Conn, size int, opts CopyOptions) error {
+	delay := opts.CoalesceDelay
+	// With no queue the channel is unbuffered, so that a slow websocket
+	// still blocks reading.
+	reads := make(chan readResult, opts.QueueSize)
+	go func() {
+		for {
+			b := make([]byte, size)
+			n, err := src.Read(b)
+			if cap(reads) > 0 && len(reads) == cap(reads) && opts.OnQueueFull != nil {
+				opts.OnQueueFull(cap(reads))
+			}
+			select {
+			case reads <- readResult{b: b[:n], err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	flush := func() error {
+		timer.Stop()
+		if len(pending) == 0 {
+			return nil
+		}
+		err := opts.write(dst, pending)
+		if err != nil {
+			log.Warning(err)
+		}
+		pending = nil
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case r := <-reads:
+			wasEmpty := len(pending) == 0
+			pending = append(pending, r.b...)
+			if r.err != nil {
+				if err := flush(); err != nil {
+					return err
+				}
+				return r.err
+			}
+			if len(pending) >= size || delay <= 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			} else if wasEmpty && len(pending) > 0 {
+				timer.Reset(delay)
+			}
+		}
+	}
+}
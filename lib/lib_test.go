@@ -0,0 +1,270 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns both ends of a websocket over loopback.
+func wsPair(t testing.TB) (client, server *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	var up websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestFile2WSFlowed(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		in   string
+		opts CopyOptions
+		want int32
+	}{
+		{"no data", "", CopyOptions{}, 0},
+		{"data", "hello", CopyOptions{}, 1},
+		{"queued", "hello", CopyOptions{QueueSize: 2}, 1},
+		{"queued without data", "", CopyOptions{QueueSize: 2}, 0},
+	} {
+		client, server := wsPair(t)
+		var flowed int32
+		test.opts.Flowed = &flowed
+		go func() {
+			for {
+				if _, _, err := server.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		err := File2WSOptions(context.Background(), func() {}, strings.NewReader(test.in), client, test.opts)
+		if err != io.EOF {
+			t.Errorf("%s: File2WSOptions = %v, want EOF", test.desc, err)
+		}
+		if flowed != test.want {
+			t.Errorf("%s: Flowed = %d, want %d", test.desc, flowed, test.want)
+		}
+	}
+}
+
+func TestBridgeFlowed(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		in, back string
+		want     int32
+	}{
+		{"nothing", "", "", 0},
+		{"sent", "ping", "", 1},
+		{"received", "", "pong", 1},
+	} {
+		test := test
+		client, server := wsPair(t)
+		go func() {
+			if test.back != "" {
+				server.WriteMessage(websocket.BinaryMessage, []byte(test.back))
+			}
+			for {
+				if _, _, err := server.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		// The input ends once the peer's data, if any, arrived.
+		pr, pw := io.Pipe()
+		out := &notifyWriter{done: make(chan struct{})}
+		go func() {
+			if test.in != "" {
+				pw.Write([]byte(test.in))
+			}
+			if test.back != "" {
+				<-out.done
+			}
+			pw.Close()
+		}()
+		var flowed int32
+		res := RunClientBridge(context.Background(), client, pr, out, BridgeOptions{Flowed: &flowed, DrainTimeout: -1})
+		if res.Reason != EndInputEnded {
+			t.Errorf("%s: bridge ended with %v (%v), want %v", test.desc, res.Reason, res.Err, EndInputEnded)
+		}
+		if flowed != test.want {
+			t.Errorf("%s: Flowed = %d, want %d", test.desc, flowed, test.want)
+		}
+	}
+}
+
+// notifyWriter closes done on the first write.
+type notifyWriter struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.done) })
+	return len(b), nil
+}
+
+// patternReader gives n bytes of a repeating pattern as fast as it's read,
+// counting what was read.
+type patternReader struct {
+	n    int64
+	read int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	left := r.n - atomic.LoadInt64(&r.read)
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > left {
+		b = b[:left]
+	}
+	off := atomic.LoadInt64(&r.read)
+	for i := range b {
+		b[i] = byte((off + int64(i)) % 251)
+	}
+	atomic.AddInt64(&r.read, int64(len(b)))
+	return len(b), nil
+}
+
+// TestFile2WSBackpressure feeds a fast reader to a websocket whose peer
+// isn't reading, and checks reading stops rather than buffering it all,
+// then that it all arrives once the peer reads.
+func TestFile2WSBackpressure(t *testing.T) {
+	// Well over what loopback sockets buffer.
+	const total = 16 << 20
+	for _, test := range []struct {
+		desc     string
+		opts     CopyOptions
+		wantFull bool
+	}{
+		{"direct", CopyOptions{BufferSize: 4096}, false},
+		{"queued", CopyOptions{BufferSize: 4096, QueueSize: 4}, true},
+		{"coalesced", CopyOptions{BufferSize: 4096, CoalesceDelay: time.Millisecond}, false},
+		{"queued and coalesced", CopyOptions{BufferSize: 4096, QueueSize: 4, CoalesceDelay: time.Millisecond}, true},
+	} {
+		client, server := wsPair(t)
+		src := &patternReader{n: total}
+		var full int32
+		test.opts.OnQueueFull = func(queued int) {
+			if queued != test.opts.QueueSize {
+				t.Errorf("%s: OnQueueFull(%d), want %d", test.desc, queued, test.opts.QueueSize)
+			}
+			atomic.StoreInt32(&full, 1)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			errc <- File2WSOptions(context.Background(), func() {}, src, client, test.opts)
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		if read := atomic.LoadInt64(&src.read); read >= total {
+			t.Errorf("%s: read all %d bytes with the peer not reading", test.desc, read)
+		}
+		if got := atomic.LoadInt32(&full) == 1; got != test.wantFull {
+			t.Errorf("%s: queue reported full %v, want %v", test.desc, got, test.wantFull)
+		}
+
+		var got int64
+		for got < total {
+			_, r, err := server.NextReader()
+			if err != nil {
+				t.Fatalf("%s: after %d bytes: %v", test.desc, got, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range b {
+				if want := byte((got + int64(i)) % 251); b[i] != want {
+					t.Fatalf("%s: byte %d is %d, want %d", test.desc, got+int64(i), b[i], want)
+				}
+			}
+			got += int64(len(b))
+		}
+		if err := <-errc; err != io.EOF {
+			t.Errorf("%s: File2WSOptions = %v, want EOF", test.desc, err)
+		}
+	}
+}
+
+// BenchmarkFile2WS measures the throughput and allocations of copying a
+// stream to a websocket with various read buffer sizes, with and without
+// a queue.
+func BenchmarkFile2WS(b *testing.B) {
+	const perOp = 1 << 20
+	for _, size := range []int{4 << 10, 16 << 10, DefaultBufferSize, 128 << 10, 512 << 10} {
+		for _, queue := range []int{0, 4} {
+			size, queue := size, queue
+			b.Run(fmt.Sprintf("buffer=%dk/queue=%d", size>>10, queue), func(b *testing.B) {
+				client, server := wsPair(b)
+				want := int64(b.N) * perOp
+				received := make(chan int64, 1)
+				go func() {
+					var n int64
+					for n < want {
+						_, r, err := server.NextReader()
+						if err != nil {
+							break
+						}
+						m, _ := io.Copy(ioutil.Discard, r)
+						n += m
+					}
+					received <- n
+				}()
+				opts := CopyOptions{BufferSize: size, QueueSize: queue}
+				b.SetBytes(perOp)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					src := io.LimitReader(zeros{}, perOp)
+					if err := File2WSOptions(context.Background(), func() {}, src, client, opts); err != io.EOF {
+						b.Fatal(err)
+					}
+				}
+				// Until it all arrived.
+				if n := <-received; n != want {
+					b.Errorf("Got %d bytes, want %d", n, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes per second. It holds up to a
+// second's worth of tokens, or at least one, so a burst of that much
+// passes at once. Readers and writers sharing a Limiter share its rate,
+// for an aggregate limit; give each its own for a limit per connection.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter of rate tokens per second, starting full.
+func NewLimiter(rate float64) *Limiter {
+	return &Limiter{rate: rate, tokens: math.Max(rate, 1), last: time.Now()}
+}
+
+// SetRate changes the rate, for instance on a config reload.
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked()
+	l.rate = rate
+}
+
+// refillLocked adds the tokens accrued since the last call.
+func (l *Limiter) refillLocked() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if burst := math.Max(l.rate, 1); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+}
+
+// Allow takes a token if one is left, without waiting.
+func (l *Limiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// WaitN takes n tokens, blocking until they have accrued or ctx is done.
+// n may exceed the burst; the bucket then goes into debt, which later
+// callers wait off.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.refillLocked()
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 && l.rate > 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d == 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+// NewRateLimitedReader returns a Reader passing on what's read from r no
+// faster than l allows. Waiting for l ends when ctx is done, with what
+// was read and ctx's error.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *Limiter
+}
+
+// NewRateLimitedWriter returns a Writer writing to w no faster than l
+// allows. Waiting for l ends when ctx is done, with ctx's error.
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, l *Limiter) io.Writer {
+	return &rateLimitedWriter{ctx: ctx, w: w, l: l}
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (int, error) {
+	if err := w.l.WaitN(w.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
@@ -0,0 +1,143 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	for _, test := range []struct {
+		rate float64
+		// Allowed at once, from a full bucket.
+		want int
+	}{
+		{0, 1},
+		{0.5, 1},
+		{1, 1},
+		{10, 10},
+		{100, 100},
+	} {
+		l := NewLimiter(test.rate)
+		got := 0
+		for l.Allow() && got < 1000 {
+			got++
+		}
+		if got != test.want {
+			t.Errorf("NewLimiter(%v) allowed %d at once, want %d", test.rate, got, test.want)
+		}
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	l := NewLimiter(1e-9)
+	l.Allow()
+	if l.Allow() {
+		t.Fatal("empty limiter allowed")
+	}
+	l.SetRate(1000)
+	time.Sleep(20 * time.Millisecond)
+	if !l.Allow() {
+		t.Error("limiter still empty after raising its rate")
+	}
+}
+
+// TestRateLimited checks reading and writing through a Limiter, alone
+// and together, takes about as long as the rate says, past the first
+// second's burst.
+func TestRateLimited(t *testing.T) {
+	const (
+		rate  = 200 << 10
+		size  = 300 << 10
+		chunk = 8 << 10
+	)
+	for _, test := range []struct {
+		desc   string
+		read   bool
+		write  bool
+		shared bool
+		want   time.Duration
+	}{
+		{"reader", true, false, false, 500 * time.Millisecond},
+		{"writer", false, true, false, 500 * time.Millisecond},
+		{"reader and writer limited apart", true, true, false, 500 * time.Millisecond},
+		// Each byte counts twice against the shared limiter.
+		{"reader and writer sharing", true, true, true, 2000 * time.Millisecond},
+	} {
+		ctx := context.Background()
+		var src io.Reader = io.LimitReader(zeros{}, size)
+		var dst io.Writer = ioutil.Discard
+		lr := NewLimiter(rate)
+		lw := NewLimiter(rate)
+		if test.shared {
+			lw = lr
+		}
+		if test.read {
+			src = NewRateLimitedReader(ctx, src, lr)
+		}
+		if test.write {
+			dst = NewRateLimitedWriter(ctx, dst, lw)
+		}
+		start := time.Now()
+		n, err := io.CopyBuffer(dst, struct{ io.Reader }{src}, make([]byte, chunk))
+		took := time.Since(start)
+		if n != size || err != nil {
+			t.Errorf("%s: copied %d, %v; want %d", test.desc, n, err, size)
+		}
+		if took < test.want*8/10 || took > test.want*3/2 {
+			t.Errorf("%s: took %v, want about %v", test.desc, took, test.want)
+		}
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestRateLimitedCancel(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		op   func(context.Context, *Limiter) (int, error)
+		want int
+	}{
+		{"reader", func(ctx context.Context, l *Limiter) (int, error) {
+			return NewRateLimitedReader(ctx, bytes.NewReader(make([]byte, 1000)), l).Read(make([]byte, 1000))
+		}, 1000},
+		{"writer", func(ctx context.Context, l *Limiter) (int, error) {
+			return NewRateLimitedWriter(ctx, ioutil.Discard, l).Write(make([]byte, 1000))
+		}, 0},
+	} {
+		l := NewLimiter(10)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		n, err := test.op(ctx, l)
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%s: took %v to give up after cancellation", test.desc, took)
+		}
+		if n != test.want || err != context.Canceled {
+			t.Errorf("%s: got %d, %v; want %d, %v", test.desc, n, err, test.want, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	maxPerDest     = flag.Int("max_per_dest", 0, "Max concurrent tunnels to a single host:port. 0 is unlimited.")
+	maxUpgradeRate = flag.Float64("max_upgrade_rate", 0, "Max new tunnels per second, across all clients, allowing bursts of up to a second's worth. Beyond that, clients get 503 and are told to retry in a second. 0 is unlimited.")
+	warmup         = flag.Duration("warmup", 0, "After starting, allow new tunnels at a tenth of -max_upgrade_rate, ramping up linearly to all of it over this long, at least 100ms. 0 disables.")
+
+	destLimits = newDestLimiter()
+
+	// Limiter for -max_upgrade_rate, nil if unlimited.
+	upgradeLimiter *huproxy.Limiter
+)
+
+// Share of -max_upgrade_rate allowed at the start of -warmup.
+const warmupStart = 0.1
+
+// How many times the rate is raised during -warmup.
+const warmupSteps = 100
+
+// setupUpgradeRate prepares -max_upgrade_rate and -warmup.
+func setupUpgradeRate() error {
+	if *maxUpgradeRate < 0 {
+		return fmt.Errorf("-max_upgrade_rate must not be negative")
+	}
+	if *warmup < 0 {
+		return fmt.Errorf("-warmup must not be negative")
+	}
+	if *warmup > 0 && *warmup < warmupSteps*time.Millisecond {
+		return fmt.Errorf("-warmup must be 0 or at least %v", warmupSteps*time.Millisecond)
+	}
+	if *warmup > 0 && *maxUpgradeRate == 0 {
+		return fmt.Errorf("-warmup ramps up to -max_upgrade_rate, which isn't set")
+	}
+	if *maxUpgradeRate == 0 {
+		return nil
+	}
+	if *warmup == 0 {
+		upgradeLimiter = huproxy.NewLimiter(*maxUpgradeRate)
+		return nil
+	}
+	upgradeLimiter = huproxy.NewLimiter(*maxUpgradeRate * warmupStart)
+	go warmUp(upgradeLimiter, time.Now())
+	return nil
+}
+
+// warmUp raises the rate of l linearly from warmupStart to all of
+// -max_upgrade_rate over -warmup.
+func warmUp(l *huproxy.Limiter, start time.Time) {
+	t := time.NewTicker(*warmup / warmupSteps)
+	defer t.Stop()
+	for range t.C {
+		done := float64(time.Since(start)) / float64(*warmup)
+		if done >= 1 {
+			break
+		}
+		l.SetRate(*maxUpgradeRate * (warmupStart + (1-warmupStart)*done))
+	}
+	l.SetRate(*maxUpgradeRate)
+	log.Infof("Warmup complete, allowing %g new tunnels per second", *maxUpgradeRate)
+}
+
+// allowUpgrade returns false if the tunnel would exceed -max_upgrade_rate.
+func allowUpgrade() bool {
+	return upgradeLimiter == nil || upgradeLimiter.Allow()
+}
+
+func init() {
+	expvar.Publish("per_dest_active", expvar.Func(destLimits.snapshot))
+}
+
+// normalizeDest returns a canonical host:port key for a destination, so
+// that e.g. "Example.COM." and "example.com" share a counter.
+func normalizeDest(host, port string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if n, err := strconv.Atoi(port); err == nil {
+		port = strconv.Itoa(n)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// destLimiter counts active tunnels per destination. Keys are removed
+// when their count drops to zero, so idle destinations cost nothing.
+type destLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newDestLimiter() *destLimiter {
+	return &destLimiter{active: make(map[string]int)}
+}
+
+// acquire reserves a slot for dest, returning false if max (if nonzero)
+// tunnels to it are already active.
+func (l *destLimiter) acquire(dest string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && l.active[dest] >= max {
+		return false
+	}
+	l.active[dest]++
+	return true
+}
+
+func (l *destLimiter) release(dest string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[dest] <= 1 {
+		delete(l.active, dest)
+		return
+	}
+	l.active[dest]--
+}
+
+func (l *destLimiter) snapshot() interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m := make(map[string]int, len(l.active))
+	for k, v := range l.active {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,57 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+func TestSetupUpgradeRate(t *testing.T) {
+	defer func(v float64) { *maxUpgradeRate = v }(*maxUpgradeRate)
+	defer func(v time.Duration) { *warmup = v }(*warmup)
+	defer func(v *huproxy.Limiter) { upgradeLimiter = v }(upgradeLimiter)
+	for _, test := range []struct {
+		rate    float64
+		warmup  time.Duration
+		limited bool
+		wantErr string
+	}{
+		{rate: 0, warmup: 0},
+		{rate: 10, warmup: 0, limited: true},
+		{rate: -1, wantErr: "-max_upgrade_rate must not be negative"},
+		{rate: 10, warmup: -time.Second, wantErr: "-warmup must not be negative"},
+		{rate: 0, warmup: time.Minute, wantErr: "-max_upgrade_rate, which isn't set"},
+		{rate: 10, warmup: 50 * time.Nanosecond, wantErr: "-warmup must be 0 or at least 100ms"},
+		{rate: 10, warmup: 99 * time.Millisecond, wantErr: "-warmup must be 0 or at least 100ms"},
+	} {
+		*maxUpgradeRate, *warmup, upgradeLimiter = test.rate, test.warmup, nil
+		err := setupUpgradeRate()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("rate %g, warmup %v: got error %v, want %q", test.rate, test.warmup, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("rate %g, warmup %v: %v", test.rate, test.warmup, err)
+		}
+		if got := upgradeLimiter != nil; got != test.limited {
+			t.Errorf("rate %g, warmup %v: got limiter %t, want %t", test.rate, test.warmup, got, test.limited)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	maintenance      = flag.Bool("maintenance", false, "Start in maintenance mode, refusing new tunnels with 503 while existing ones carry on. SIGUSR1 toggles it.")
+	maintenanceRetry = flag.Duration("maintenance_retry_after", time.Minute, "Retry-After sent to clients refused during maintenance.")
+	readyzURL        = flag.String("readyz_url", "/readyz", "Path answering 200 when accepting tunnels and 503 in maintenance mode. Empty disables.")
+
+	// 1 in maintenance mode.
+	inMaintenance int32
+)
+
+// setMaintenance enters or leaves maintenance mode.
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&inMaintenance, v) == v {
+		return
+	}
+	if on {
+		log.Warningf("Entering maintenance mode, refusing new tunnels")
+	} else {
+		log.Infof("Leaving maintenance mode, accepting tunnels")
+	}
+}
+
+func underMaintenance() bool {
+	return atomic.LoadInt32(&inMaintenance) != 0
+}
+
+// handleMaintenanceSignals toggles maintenance mode on each
+// maintenanceSignal, where the platform has one.
+func handleMaintenanceSignals() {
+	if maintenanceSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, maintenanceSignal)
+	go func() {
+		for range sigs {
+			setMaintenance(!underMaintenance())
+		}
+	}()
+}
+
+// refuseMaintenance answers a tunnel request made during maintenance.
+func refuseMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetry.Seconds())))
+	refuse(w, "server under maintenance, try again later", http.StatusServiceUnavailable)
+}
+
+// readyz tells load balancers whether to send new tunnels here.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if underMaintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("maintenance\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
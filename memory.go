@@ -0,0 +1,81 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+// Smallest -max_conn_memory accepted.
+const minConnMemory = 8 << 10
+
+// Largest message accepted from clients with -max_conn_memory, well above
+// the 256KiB of huproxyclient's -latency_mode=throughput.
+const maxClientMessage = 1 << 20
+
+var (
+	maxConnMemory = flag.String("max_conn_memory", "", "Bound the buffers of each tunnel to this many bytes, with K, M or G for powers of 1024, setting -ws_read_buffer, -ws_write_buffer and the copy buffers, and limiting websocket messages from clients. See the README for the memory math. Empty uses the separate flags.")
+
+	// Size of each direction's copy buffer, 0 for the default.
+	copyBufferSize int
+)
+
+// setupConnMemory derives the buffer sizes from -max_conn_memory, before
+// the upgrader is built: an eighth each for the websocket read and write
+// buffers, and the rest for the two copy buffers, up to the default size.
+func setupConnMemory() error {
+	if *maxConnMemory == "" {
+		return nil
+	}
+	m, err := parseBytes(*maxConnMemory)
+	if err != nil {
+		return fmt.Errorf("-max_conn_memory: %v", err)
+	}
+	if m < minConnMemory {
+		return fmt.Errorf("-max_conn_memory must be at least %d", minConnMemory)
+	}
+	if *wsCompression {
+		return fmt.Errorf("-ws_compression needs memory beyond -max_conn_memory for its compression state")
+	}
+	var conflict []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "ws_read_buffer" || f.Name == "ws_write_buffer" {
+			conflict = append(conflict, "-"+f.Name)
+		}
+	})
+	if len(conflict) > 0 {
+		return fmt.Errorf("-max_conn_memory sets %v; don't give them too", conflict)
+	}
+	*wsReadBuffer = int(m / 8)
+	*wsWriteBuffer = int(m / 8)
+	copyBufferSize = int(3 * m / 8)
+	if copyBufferSize > huproxy.DefaultBufferSize {
+		copyBufferSize = huproxy.DefaultBufferSize
+	}
+	return nil
+}
+
+// copyToBackend copies a message to the backend, with a buffer of
+// copyBufferSize if set.
+func copyToBackend(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	if buf == nil {
+		return io.Copy(dst, src)
+	}
+	// Hide any ReadFrom of dst, which would use a buffer of its own.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, buf)
+}
@@ -0,0 +1,133 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestSetupConnMemory(t *testing.T) {
+	defer func(m string, r, w, c int, z bool) {
+		*maxConnMemory, *wsReadBuffer, *wsWriteBuffer, copyBufferSize, *wsCompression = m, r, w, c, z
+	}(*maxConnMemory, *wsReadBuffer, *wsWriteBuffer, copyBufferSize, *wsCompression)
+	for _, test := range []struct {
+		in                string
+		compression       bool
+		read, write, copy int
+		wantErr           string
+	}{
+		{"", false, 1024, 1024, 0, ""},
+		{"8K", false, 1024, 1024, 3072, ""},
+		{"64KiB", false, 8192, 8192, 24576, ""},
+		// The copy buffers don't grow past the default.
+		{"1M", false, 131072, 131072, 32768, ""},
+		{"4K", false, 1024, 1024, 0, "at least"},
+		{"lots", false, 1024, 1024, 0, "-max_conn_memory"},
+		{"64K", true, 1024, 1024, 0, "-ws_compression"},
+	} {
+		*maxConnMemory, *wsCompression = test.in, test.compression
+		*wsReadBuffer, *wsWriteBuffer, copyBufferSize = 1024, 1024, 0
+		err := setupConnMemory()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("-max_conn_memory=%q: %v, want error containing %q", test.in, err, test.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("-max_conn_memory=%q: %v", test.in, err)
+		}
+		if *wsReadBuffer != test.read || *wsWriteBuffer != test.write || copyBufferSize != test.copy {
+			t.Errorf("-max_conn_memory=%q: buffers %d, %d, %d; want %d, %d, %d", test.in, *wsReadBuffer, *wsWriteBuffer, copyBufferSize, test.read, test.write, test.copy)
+		}
+	}
+}
+
+// TestOversizedMessage sends messages around maxClientMessage through a
+// tunnel with -max_conn_memory, checking those over it close the tunnel
+// once that much was streamed to the backend.
+func TestOversizedMessage(t *testing.T) {
+	defer func(c int) { copyBufferSize = c }(copyBufferSize)
+	copyBufferSize = 24576
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan int64)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				n, _ := io.Copy(ioutil.Discard, c)
+				c.Close()
+				received <- n
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{host}/{port}", handleProxy)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		size   int
+		wantOK bool
+	}{
+		{maxClientMessage / 2, true},
+		{maxClientMessage, true},
+		{maxClientMessage + 1, false},
+		{8 * maxClientMessage, false},
+	} {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/proxy/"+host+"/"+port, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteMessage(websocket.BinaryMessage, make([]byte, test.size))
+		if test.wantOK {
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = c.ReadMessage()
+		c.Close()
+		var ce *websocket.CloseError
+		if test.wantOK && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("%d bytes: client read %v, want a normal close", test.size, err)
+		}
+		if !test.wantOK && (!errors.As(err, &ce) || ce.Code == websocket.CloseNormalClosure) {
+			t.Errorf("%d bytes: client read %v, want the tunnel closed with an error", test.size, err)
+		}
+		n := <-received
+		if test.wantOK && n != int64(test.size) {
+			t.Errorf("%d bytes: backend got %d", test.size, n)
+		}
+		if !test.wantOK && n > maxClientMessage {
+			t.Errorf("%d bytes: backend got %d, want at most %d", test.size, n, maxClientMessage)
+		}
+	}
+}
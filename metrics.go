@@ -0,0 +1,127 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Metrics are exported with expvar, as JSON, on -metrics_url.
+
+var (
+	metricsURL = flag.String("metrics_url", "", "Path to serve expvar metrics on, after the -path_secret if any, and needing the -admin_auth credentials if set. Empty disables.")
+
+	metricActive   = expvar.NewInt("tunnels_active")
+	metricTotal    = expvar.NewInt("tunnels_total")
+	metricRejected = expvar.NewMap("tunnels_rejected")
+
+	// By route name, which only ever takes configured values. Bytes are
+	// counted when tunnels close.
+	metricRouteActive   = expvar.NewMap("route_tunnels_active")
+	metricRouteTotal    = expvar.NewMap("route_tunnels_total")
+	metricRouteBytesIn  = expvar.NewMap("route_bytes_in")
+	metricRouteBytesOut = expvar.NewMap("route_bytes_out")
+
+	// Goroutines started by bridge and not yet finished. Should drop back
+	// to 0 whenever tunnels_active does; if it doesn't, they leak.
+	metricBridgeGoroutines = expvar.NewInt("bridge_goroutines")
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("goroutines_per_tunnel", expvar.Func(goroutinesPerTunnel))
+}
+
+// Vars published by the expvar package itself, not served: cmdline holds
+// the flags, secrets included, and memstats is large and of little use.
+var hiddenVars = map[string]bool{"cmdline": true, "memstats": true}
+
+// setupMetrics adds -metrics_url to m, behind wrap as the tunnel routes,
+// and behind the admin credentials with -admin_auth.
+func setupMetrics(m *mux.Router, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	if *metricsURL == "" {
+		return
+	}
+	p := "/" + strings.TrimPrefix(*metricsURL, "/")
+	if *pathSecret != "" {
+		p = "/{secret}" + p
+	}
+	h := wrap(serveMetrics)
+	if *adminAuth != "" {
+		h = requireAdmin(h)
+	}
+	m.HandleFunc(p, h)
+}
+
+// serveMetrics writes huproxy's expvars as a JSON object, like
+// expvar.Handler but without hiddenVars.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenVars[kv.Key] {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		k, _ := json.Marshal(kv.Key)
+		fmt.Fprintf(w, "%s: %s", k, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// goroutinesPerTunnel is bridge goroutines over active tunnels, which
+// stays at 2, plus 1 with -text_keepalive and 1 for tunnels under a
+// -port_policy idle_timeout, unless something leaks.
+func goroutinesPerTunnel() interface{} {
+	n := metricActive.Value()
+	if n == 0 {
+		return 0
+	}
+	return float64(metricBridgeGoroutines.Value()) / float64(n)
+}
+
+// histogram counts durations into fixed buckets, exported as a map from
+// "le_<bound>" to the number of observations at most that long, plus
+// "count" and "sum_ms".
+type histogram struct {
+	bounds []time.Duration
+	m      *expvar.Map
+}
+
+func newHistogram(name string, bounds ...time.Duration) *histogram {
+	return &histogram{bounds: bounds, m: expvar.NewMap(name)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for _, b := range h.bounds {
+		if d <= b {
+			h.m.Add("le_"+b.String(), 1)
+		}
+	}
+	h.m.Add("count", 1)
+	h.m.AddFloat("sum_ms", float64(d)/float64(time.Millisecond))
+}
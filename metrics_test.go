@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	defer func(u, s, a, au, ap string) {
+		*metricsURL, *pathSecret, *adminAuth, adminUser, adminPassword = u, s, a, au, ap
+	}(*metricsURL, *pathSecret, *adminAuth, adminUser, adminPassword)
+	pathSecrets.Store([]string{"s3cret"})
+	*metricsURL = "/metrics"
+	adminUser, adminPassword = "root", "secret"
+
+	for _, test := range []struct {
+		desc       string
+		secret     string
+		admin      string
+		path       string
+		user, pass string
+		want       int
+	}{
+		{"open", "", "", "/metrics", "", "", http.StatusOK},
+		{"secret", "s3cret", "", "/s3cret/metrics", "", "", http.StatusOK},
+		{"no secret", "s3cret", "", "/metrics", "", "", http.StatusNotFound},
+		{"wrong secret", "s3cret", "", "/guess/metrics", "", "", http.StatusNotFound},
+		{"admin", "", "root:secret", "/metrics", "root", "secret", http.StatusOK},
+		{"no admin credentials", "", "root:secret", "/metrics", "", "", http.StatusUnauthorized},
+		{"secret and admin", "s3cret", "root:secret", "/s3cret/metrics", "root", "secret", http.StatusOK},
+		{"secret without admin", "s3cret", "root:secret", "/s3cret/metrics", "", "", http.StatusUnauthorized},
+	} {
+		*pathSecret, *adminAuth = test.secret, test.admin
+		m := mux.NewRouter()
+		m.NotFoundHandler = http.HandlerFunc(notFound)
+		wrap := func(h http.HandlerFunc) http.HandlerFunc { return h }
+		if test.secret != "" {
+			wrap = requireSecret
+		}
+		setupMetrics(m, wrap)
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.desc, w.Code, test.want)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var vars map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("%s: %v in %q", test.desc, err, w.Body)
+		}
+		for _, k := range []string{"cmdline", "memstats"} {
+			if _, ok := vars[k]; ok {
+				t.Errorf("%s: %s served", test.desc, k)
+			}
+		}
+		if _, ok := vars["tunnels_active"]; !ok {
+			t.Errorf("%s: tunnels_active not served", test.desc)
+		}
+	}
+}
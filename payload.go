@@ -0,0 +1,123 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest -debug_payload_sample allowed.
+const maxPayloadSample = 4096
+
+var (
+	payloadSample   = flag.Int("debug_payload_sample", 0, "Log, in hex, the first this many bytes sent in each direction of every tunnel. This logs passwords and other secrets going over tunnels; only for debugging, and only together with -allow_payload_logging. 0 disables.")
+	allowPayloadLog = flag.Bool("allow_payload_logging", false, "Required for -debug_payload_sample, acknowledging that tunnel contents will be logged.")
+)
+
+// checkPayloadSample validates the payload logging flags.
+func checkPayloadSample() error {
+	if *payloadSample == 0 {
+		return nil
+	}
+	if *payloadSample < 0 || *payloadSample > maxPayloadSample {
+		return fmt.Errorf("-debug_payload_sample must be between 0 and %d", maxPayloadSample)
+	}
+	if !*allowPayloadLog {
+		return fmt.Errorf("-debug_payload_sample logs tunnel contents, including secrets; also pass -allow_payload_logging to really do that")
+	}
+	log.Warningf("LOGGING THE FIRST %d BYTES OF EVERY TUNNEL IN EACH DIRECTION (-debug_payload_sample). Logs will contain passwords and other secrets.", *payloadSample)
+	return nil
+}
+
+// sampler keeps the start of one direction of a tunnel, logging it once
+// full or once flushed.
+type sampler struct {
+	entry *log.Entry
+	dir   string
+
+	mu     sync.Mutex
+	buf    []byte
+	logged bool
+}
+
+func (s *sampler) add(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logged {
+		return
+	}
+	if n := *payloadSample - len(s.buf); len(b) > n {
+		b = b[:n]
+	}
+	s.buf = append(s.buf, b...)
+	if len(s.buf) >= *payloadSample {
+		s.logLocked()
+	}
+}
+
+func (s *sampler) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.logged {
+		s.logLocked()
+	}
+}
+
+func (s *sampler) logLocked() {
+	s.logged = true
+	s.entry.WithFields(log.Fields{
+		"direction": s.dir,
+		"bytes":     len(s.buf),
+		"hex":       hex.EncodeToString(s.buf),
+	}).Warning("Payload sample")
+	s.buf = nil
+}
+
+// sampledConn samples what's written to the backend, i.e. sent by the
+// client, and what's read from it.
+type sampledConn struct {
+	net.Conn
+	sent, received *sampler
+}
+
+// samplePayload wraps the backend connection with -debug_payload_sample.
+// The returned func logs whatever was sampled if a sample isn't full yet.
+func samplePayload(entry *log.Entry, c net.Conn) (net.Conn, func()) {
+	sc := &sampledConn{
+		Conn:     c,
+		sent:     &sampler{entry: entry, dir: "client_to_backend"},
+		received: &sampler{entry: entry, dir: "backend_to_client"},
+	}
+	return sc, func() {
+		sc.sent.flush()
+		sc.received.flush()
+	}
+}
+
+func (c *sampledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.add(b[:n])
+	return n, err
+}
+
+func (c *sampledConn) Write(b []byte) (int, error) {
+	c.sent.add(b)
+	return c.Conn.Write(b)
+}
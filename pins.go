@@ -0,0 +1,84 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	pinnedCertsFile = flag.String("pinned_client_certs", "", "File of base64 (or hex) SHA-256 hashes of client certificate public keys (SPKI), one per line. If set, only client certificates with these keys may open tunnels.")
+
+	// Current map[string]bool of base64 pins.
+	pinnedCerts atomic.Value
+)
+
+// spkiPin returns the base64 SHA-256 of the certificate's public key, as
+// printed by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func spkiPin(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// loadPinnedCerts reads -pinned_client_certs. Blank lines and lines
+// starting with '#' are skipped.
+func loadPinnedCerts() error {
+	b, err := ioutil.ReadFile(*pinnedCertsFile)
+	if err != nil {
+		return err
+	}
+	pins := map[string]bool{}
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		h, err := hex.DecodeString(line)
+		if err != nil || len(h) != sha256.Size {
+			h, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("%s:%d: not a base64 or hex SHA-256 hash", *pinnedCertsFile, n+1)
+		}
+		pins[base64.StdEncoding.EncodeToString(h)] = true
+	}
+	pinnedCerts.Store(pins)
+	return nil
+}
+
+// checkPinned returns the pin of the client certificate r came with, and
+// whether it's allowed to open tunnels. Without -pinned_client_certs
+// anything is.
+func checkPinned(r *http.Request) (string, bool) {
+	pins, _ := pinnedCerts.Load().(map[string]bool)
+	if pins == nil {
+		return "", true
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	pin := spkiPin(r.TLS.PeerCertificates[0])
+	return pin, pins[pin]
+}
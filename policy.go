@@ -0,0 +1,280 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity used for policy entries that apply to anyone without an entry
+// of their own.
+const wildcardIdentity = "*"
+
+var (
+	policyFile     = flag.String("policy", "", "File mapping identities to the destinations they may reach. Empty allows everything.")
+	requireACL     = flag.Bool("require_acl", false, "Refuse to start without a -policy holding at least one rule, instead of allowing every destination. Reloads leaving no rules are refused too.")
+	enforceACL     = flag.Bool("enforce_acl_on_reload", false, "When a reload changes -policy, or a vhost's or port's policy, close open tunnels the new policy no longer allows. By default only new tunnels are checked.")
+	trustBasicAuth = flag.Bool("trust_basic_auth_identity", false, "Take the identity of clients without a verified client certificate from their Basic Auth user name. huproxy doesn't check the password, so this is only safe behind a web server that does, and that huproxy can't be reached around.")
+	realIPHeader   = flag.String("real_ip_header", "", "Header holding the client's address, as set by the web server in front, e.g. X-Real-IP, for -policy from= rules. Of a list, as in X-Forwarded-For, the last address is used. Empty uses the connection's address.")
+
+	// Current *policy, nil if there is none.
+	aclPolicy atomic.Value
+
+	metricPolicyClosed = expvar.NewInt("tunnels_closed_by_policy")
+)
+
+// destPattern matches host:port destinations, with path.Match globs
+// applied to host and port separately.
+type destPattern struct {
+	host string
+	port string
+}
+
+func (p destPattern) match(host, port string) bool {
+	h, _ := path.Match(p.host, host)
+	o, _ := path.Match(p.port, port)
+	return h && o
+}
+
+// policyRule is one line of the policy file.
+type policyRule struct {
+	// Source networks the rule applies to; empty for anywhere.
+	from  []*net.IPNet
+	dests []destPattern
+}
+
+func (r *policyRule) fromOK(ip net.IP) bool {
+	if len(r.from) == 0 {
+		return true
+	}
+	for _, n := range r.from {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// policy maps identities to allowed destinations.
+//
+// The file has one identity per line, followed optionally by the source
+// networks the line applies to, and its destination patterns:
+//
+//	# identity  [from=cidr,...]  destinations...
+//	alice       from=192.0.2.0/24 *.alice.example.com:22
+//	alice       10.0.0.5:*
+//	*           bastion.example.com:22
+//
+// Identities without a line of their own, including unauthenticated
+// clients, get the "*" lines, if any. An identity may have several
+// lines; a tunnel is allowed if any of them matches both its source and
+// its destination.
+type policy struct {
+	rules map[string][]policyRule
+}
+
+func loadPolicy(fn string) (*policy, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &policy{rules: make(map[string][]policyRule)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var r policyRule
+		dests := fields[1:]
+		if len(dests) > 0 && strings.HasPrefix(dests[0], "from=") {
+			for _, c := range strings.Split(strings.TrimPrefix(dests[0], "from="), ",") {
+				_, ipnet, err := net.ParseCIDR(c)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: bad source network %q: %v", fn, n, c, err)
+				}
+				r.from = append(r.from, ipnet)
+			}
+			dests = dests[1:]
+		}
+		if len(dests) == 0 {
+			return nil, fmt.Errorf("%s:%d: identity %q has no destinations", fn, n, fields[0])
+		}
+		for _, d := range dests {
+			host, port, err := net.SplitHostPort(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad destination %q: %v", fn, n, d, err)
+			}
+			host = strings.ToLower(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad host pattern %q: %v", fn, n, host, err)
+			}
+			if _, err := path.Match(port, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad port pattern %q: %v", fn, n, port, err)
+			}
+			r.dests = append(r.dests, destPattern{host: host, port: port})
+		}
+		p.rules[fields[0]] = append(p.rules[fields[0]], r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkRequireACL returns why p, loaded from -policy, doesn't do for
+// -require_acl, if it doesn't. p is nil without -policy.
+func checkRequireACL(p *policy) error {
+	if !*requireACL {
+		return nil
+	}
+	if p == nil {
+		return fmt.Errorf("-require_acl is set but there's no -policy, which would allow every destination")
+	}
+	if len(p.rules) == 0 {
+		return fmt.Errorf("-require_acl is set but -policy %q has no rules", *policyFile)
+	}
+	return nil
+}
+
+// allowed returns true if identity may reach dest, a normalized
+// host:port, from the address src.
+func (p *policy) allowed(identity string, src net.IP, dest string) bool {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return false
+	}
+	rules, found := p.rules[identity]
+	if !found || identity == "" {
+		rules = p.rules[wildcardIdentity]
+	}
+	for _, r := range rules {
+		if !r.fromOK(src) {
+			continue
+		}
+		for _, d := range r.dests {
+			if d.match(host, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sourceIP returns the client's address, from -real_ip_header if set, or
+// nil if it can't be parsed.
+func sourceIP(r *http.Request) net.IP {
+	if *realIPHeader != "" {
+		vs := r.Header.Values(*realIPHeader)
+		if len(vs) == 0 {
+			return nil
+		}
+		v := vs[len(vs)-1]
+		if i := strings.LastIndex(v, ","); i >= 0 {
+			v = v[i+1:]
+		}
+		return net.ParseIP(strings.TrimSpace(v))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// clientAddr returns sourceIP, or if there's none the host of
+// r.RemoteAddr, to tell clients without an identity apart.
+func clientAddr(r *http.Request) string {
+	if ip := sourceIP(r); ip != nil {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// enforcePolicy closes, with -enforce_acl_on_reload, the open tunnels
+// that the policy now in force doesn't allow.
+func enforcePolicy() {
+	if !*enforceACL {
+		return
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, t := range registry {
+		if !tunnelAllowed(t.vh, t.pp, t.identity, t.src, t.dest) {
+			log.WithFields(log.Fields{
+				"conn_id":  t.id,
+				"identity": t.identity,
+				"dest":     t.dest,
+			}).Warning("Closing tunnel no longer allowed by policy")
+			metricPolicyClosed.Add(1)
+			t.terminate("policy changed")
+		}
+	}
+}
+
+// currentPolicy returns the policy in force, or nil if all destinations
+// are allowed.
+func currentPolicy() *policy {
+	p, _ := aclPolicy.Load().(*policy)
+	return p
+}
+
+// identity returns who is opening the tunnel: the verified client
+// certificate's common name if any, else, with -trust_basic_auth_identity,
+// the Basic Auth user name.
+//
+// The Basic Auth password is not checked by huproxy; it's the job of the
+// web server in front of it. Without the flag anyone could claim any
+// user name, so it's ignored.
+func identity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if !*trustBasicAuth {
+		return ""
+	}
+	if u, _, ok := r.BasicAuth(); ok {
+		return u
+	}
+	return ""
+}
+
+// askForIdentity adds to a 401 answer the challenge for the ways a client
+// can prove its identity, if there's one to ask for.
+func askForIdentity(w http.ResponseWriter, realm string) {
+	if *trustBasicAuth {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    int // identities
+		wantErr string
+	}{
+		{"", 0, ""},
+		{"# comment only\n\n", 0, ""},
+		{"alice a.example.com:22 # trailing comment\nalice 10.0.0.5:*\nbob b.example.com:22\n", 2, ""},
+		{"* from=192.0.2.0/24,2001:db8::/32 bastion:22\n", 1, ""},
+		{"alice\n", 0, ":1: identity \"alice\" has no destinations"},
+		{"alice from=192.0.2.0/24\n", 0, "no destinations"},
+		{"alice ok:22\nbob from=192.0.2.1 b:22\n", 0, ":2: bad source network"},
+		{"alice a.example.com\n", 0, "bad destination"},
+		{`alice a\:22`, 0, "bad host pattern"},
+		{`alice a:2\`, 0, "bad port pattern"},
+	} {
+		p, err := loadPolicy(writeTemp(t, "policy", test.in))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("loadPolicy(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadPolicy(%q): %v", test.in, err)
+			continue
+		}
+		if len(p.rules) != test.want {
+			t.Errorf("loadPolicy(%q) has %d identities, want %d", test.in, len(p.rules), test.want)
+		}
+	}
+	if _, err := loadPolicy(writeTemp(t, "x", "") + ".missing"); err == nil {
+		t.Error("loadPolicy of a missing file succeeded")
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := loadPolicy(writeTemp(t, "policy", `
+alice  *.alice.example.com:22 10.0.0.5:*
+bob    from=192.0.2.0/24 bob.example.com:2?
+*      bastion.example.com:22
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, outside := net.ParseIP("192.0.2.7"), net.ParseIP("198.51.100.1")
+	for _, test := range []struct {
+		identity string
+		src      net.IP
+		dest     string
+		want     bool
+	}{
+		{"alice", outside, "db.alice.example.com:22", true},
+		{"alice", outside, "db.alice.example.com:23", false},
+		{"alice", outside, "10.0.0.5:443", true},
+		{"alice", outside, "bob.example.com:22", false},
+		// Identities with lines of their own don't get the "*" ones.
+		{"alice", outside, "bastion.example.com:22", false},
+		{"bob", inside, "bob.example.com:22", true},
+		{"bob", inside, "bob.example.com:222", false},
+		{"bob", inside, "db.alice.example.com:22", false},
+		{"bob", outside, "bob.example.com:22", false},
+		{"bob", nil, "bob.example.com:22", false},
+		{"carol", outside, "bastion.example.com:22", true},
+		{"carol", outside, "bob.example.com:22", false},
+		{"", nil, "bastion.example.com:22", true},
+		{"", nil, "10.0.0.5:22", false},
+		{"alice", outside, "not a destination", false},
+	} {
+		if got := p.allowed(test.identity, test.src, test.dest); got != test.want {
+			t.Errorf("allowed(%q, %v, %q) = %v, want %v", test.identity, test.src, test.dest, got, test.want)
+		}
+	}
+
+	// Without "*" lines, only identities with lines can reach anything.
+	p, err = loadPolicy(writeTemp(t, "policy", "alice a:22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.allowed("", nil, "a:22") || p.allowed("bob", nil, "a:22") {
+		t.Error("identities without lines were allowed without a \"*\" line")
+	}
+}
+
+// TestPolicyFrom checks lines with from= need both the identity and the
+// source to match.
+func TestPolicyFrom(t *testing.T) {
+	p, err := loadPolicy(writeTemp(t, "policy", `
+alice from=192.0.2.0/24,2001:db8::/32 office.example.com:22
+alice home.example.com:22
+*     from=198.51.100.0/24 lobby.example.com:80
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	office, office6, away := net.ParseIP("192.0.2.7"), net.ParseIP("2001:db8::7"), net.ParseIP("203.0.113.1")
+	lobby := net.ParseIP("198.51.100.9")
+	for _, test := range []struct {
+		desc     string
+		identity string
+		src      net.IP
+		dest     string
+		want     bool
+	}{
+		{"both match", "alice", office, "office.example.com:22", true},
+		{"both match over IPv6", "alice", office6, "office.example.com:22", true},
+		{"wrong source", "alice", away, "office.example.com:22", false},
+		{"no source", "alice", nil, "office.example.com:22", false},
+		{"wrong identity", "bob", office, "office.example.com:22", false},
+		{"wrong destination", "alice", office, "lobby.example.com:80", false},
+		{"other line without from=", "alice", away, "home.example.com:22", true},
+		{"wildcard from the lobby", "bob", lobby, "lobby.example.com:80", true},
+		{"wildcard from elsewhere", "bob", office, "lobby.example.com:80", false},
+		{"anonymous from the lobby", "", lobby, "lobby.example.com:80", true},
+	} {
+		if got := p.allowed(test.identity, test.src, test.dest); got != test.want {
+			t.Errorf("%s: allowed(%q, %v, %q) = %v, want %v", test.desc, test.identity, test.src, test.dest, got, test.want)
+		}
+	}
+}
+
+// TestHandleProxyPolicy checks tunnels of two identities, each allowed a
+// backend of its own, are refused to the other's.
+func TestHandleProxyPolicy(t *testing.T) {
+	defer func(v bool) { *trustBasicAuth = v }(*trustBasicAuth)
+	defer aclPolicy.Store(currentPolicy())
+	*trustBasicAuth = true
+
+	var ports []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		ports = append(ports, port)
+	}
+	p, err := loadPolicy(writeTemp(t, "policy", fmt.Sprintf("alice 127.0.0.1:%s\nbob 127.0.0.1:%s\n", ports[0], ports[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclPolicy.Store(p)
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{host}/{port}", handleProxy)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		user string
+		port string
+		want int
+	}{
+		{"alice", ports[0], http.StatusSwitchingProtocols},
+		{"alice", ports[1], http.StatusForbidden},
+		{"bob", ports[0], http.StatusForbidden},
+		{"bob", ports[1], http.StatusSwitchingProtocols},
+		{"", ports[0], http.StatusForbidden},
+		{"carol", ports[1], http.StatusForbidden},
+	} {
+		h := http.Header{}
+		if test.user != "" {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.user, "checked in front")
+			h.Set("Authorization", r.Header.Get("Authorization"))
+		}
+		c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/proxy/127.0.0.1/"+test.port, h)
+		if resp == nil {
+			t.Fatalf("%q to %s: %v", test.user, test.port, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("%q to %s: status %d, want %d", test.user, test.port, resp.StatusCode, test.want)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+func TestCheckRequireACL(t *testing.T) {
+	defer func(v bool) { *requireACL = v }(*requireACL)
+	rules := &policy{rules: map[string][]policyRule{"alice": {{}}}}
+	for _, test := range []struct {
+		require bool
+		p       *policy
+		wantErr bool
+	}{
+		{false, nil, false},
+		{false, &policy{}, false},
+		{true, nil, true},
+		{true, &policy{}, true},
+		{true, rules, false},
+	} {
+		*requireACL = test.require
+		if err := checkRequireACL(test.p); (err != nil) != test.wantErr {
+			t.Errorf("checkRequireACL(%v) with -require_acl=%v: %v, want error %v", test.p, test.require, err, test.wantErr)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	defer func(v bool) { *trustBasicAuth = v }(*trustBasicAuth)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "carol"}}}}}
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}
+	for _, test := range []struct {
+		desc      string
+		trust     bool
+		tls       *tls.ConnectionState
+		basicUser string
+		want      string
+	}{
+		{"nothing", false, nil, "", ""},
+		{"untrusted basic auth", false, nil, "alice", ""},
+		{"trusted basic auth", true, nil, "alice", "alice"},
+		{"client cert", false, verified, "", "carol"},
+		{"client cert over basic auth", true, verified, "alice", "carol"},
+		{"unverified client cert", false, unverified, "", ""},
+		{"unverified client cert and basic auth", true, unverified, "alice", "alice"},
+	} {
+		*trustBasicAuth = test.trust
+		r := httptest.NewRequest("GET", "/proxy/h/22", nil)
+		r.TLS = test.tls
+		if test.basicUser != "" {
+			r.SetBasicAuth(test.basicUser, "any password")
+		}
+		if got := identity(r); got != test.want {
+			t.Errorf("%s: identity = %q, want %q", test.desc, got, test.want)
+		}
+
+		w := httptest.NewRecorder()
+		askForIdentity(w, "huproxy")
+		if got := w.Header().Get("WWW-Authenticate") != ""; got != test.trust {
+			t.Errorf("%s: askForIdentity challenged %v, want %v", test.desc, got, test.trust)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	defer func(v string) { *realIPHeader = v }(*realIPHeader)
+	for _, test := range []struct {
+		header     string
+		values     []string
+		remoteAddr string
+		wantIP     string // "" for nil
+		want       string
+	}{
+		{"", nil, "192.0.2.1:1234", "192.0.2.1", "192.0.2.1"},
+		{"", nil, "[2001:db8::1]:1234", "2001:db8::1", "2001:db8::1"},
+		{"", nil, "pipe", "", "pipe"},
+		{"X-Real-IP", []string{"198.51.100.1"}, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"X-Forwarded-For", []string{"203.0.113.9, 198.51.100.1"}, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"X-Forwarded-For", []string{"203.0.113.9", "198.51.100.2"}, "192.0.2.1:1234", "198.51.100.2", "198.51.100.2"},
+		// Without a usable header, clients are told apart by connection.
+		{"X-Real-IP", nil, "192.0.2.1:1234", "", "192.0.2.1"},
+		{"X-Real-IP", []string{"garbage"}, "192.0.2.1:1234", "", "192.0.2.1"},
+	} {
+		*realIPHeader = test.header
+		r := httptest.NewRequest("GET", "/proxy/h/22", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, v := range test.values {
+			r.Header.Add(test.header, v)
+		}
+		ip := sourceIP(r)
+		if (ip == nil && test.wantIP != "") || (ip != nil && ip.String() != test.wantIP) {
+			t.Errorf("sourceIP(%q %v, %q) = %v, want %q", test.header, test.values, test.remoteAddr, ip, test.wantIP)
+		}
+		if got := clientAddr(r); got != test.want {
+			t.Errorf("clientAddr(%q %v, %q) = %q, want %q", test.header, test.values, test.remoteAddr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+func init() {
+	flag.Var(&portPolicyFlags, "port_policy", "Apply policy to tunnels to some ports, as PORTS=[policy=file][,require_identity][,require_cert][,jwt=keyfile[,jwt_issuer=iss]][,rate=N][,idle_timeout=D], PORTS being a port or a range like 8000-8999. May be repeated; the first match applies. See the README.")
+}
+
+// Shortest idle_timeout, which is checked for at a tenth of it.
+const minIdleTimeout = time.Second
+
+var (
+	portPolicyFlags listFlag
+
+	// Configured -port_policy flags, in flag order.
+	portPolicies []*portPolicy
+)
+
+// portPolicy is the configuration of one -port_policy.
+type portPolicy struct {
+	name     string
+	min, max int
+
+	// Applies on top of -policy, or the vhost's, if set.
+	policyFile      string
+	requireIdentity bool
+	requireCert     bool
+	// Key to verify bearer tokens with, if they're required.
+	jwtFile   string
+	jwtIssuer string
+	// Limits new tunnels per second, nil if unlimited.
+	limiter     *huproxy.Limiter
+	idleTimeout time.Duration
+
+	// Current *policy, from policyFile.
+	policy atomic.Value
+	// Current *jwtVerifier, from jwtFile.
+	jwt atomic.Value
+}
+
+// parsePortRange parses a port or an inclusive range of them.
+func parsePortRange(s string) (int, int, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err := strconv.Atoi(lo)
+	if err != nil || min < 1 || min > 65535 {
+		return 0, 0, fmt.Errorf("bad port %q", lo)
+	}
+	max, err := strconv.Atoi(hi)
+	if err != nil || max < min || max > 65535 {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return min, max, nil
+}
+
+// parsePortPolicy parses a -port_policy flag.
+func parsePortPolicy(s string) (*portPolicy, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("want PORTS=options, got %q", s)
+	}
+	pp := &portPolicy{name: s[:i]}
+	var err error
+	if pp.min, pp.max, err = parsePortRange(pp.name); err != nil {
+		return nil, err
+	}
+	for _, o := range strings.Split(s[i+1:], ",") {
+		k, v := o, ""
+		if j := strings.Index(o, "="); j >= 0 {
+			k, v = o[:j], o[j+1:]
+		}
+		switch k {
+		case "":
+		case "policy":
+			pp.policyFile = v
+		case "require_identity":
+			pp.requireIdentity = true
+		case "require_cert":
+			pp.requireCert = true
+		case "jwt":
+			pp.jwtFile = v
+		case "jwt_issuer":
+			pp.jwtIssuer = v
+		case "rate":
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || r <= 0 {
+				return nil, fmt.Errorf("port %s: bad rate %q", pp.name, v)
+			}
+			pp.limiter = huproxy.NewLimiter(r)
+		case "idle_timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("port %s: bad idle_timeout %q", pp.name, v)
+			}
+			if d < minIdleTimeout {
+				return nil, fmt.Errorf("port %s: idle_timeout %v is under %v", pp.name, d, minIdleTimeout)
+			}
+			pp.idleTimeout = d
+		default:
+			return nil, fmt.Errorf("port %s: unknown option %q", pp.name, o)
+		}
+	}
+	if pp.jwtIssuer != "" && pp.jwtFile == "" {
+		return nil, fmt.Errorf("port %s: jwt_issuer needs jwt", pp.name)
+	}
+	return pp, nil
+}
+
+// load (re)reads the policy file and token key of the -port_policy, if it
+// has them.
+func (pp *portPolicy) load() error {
+	if pp.policyFile != "" {
+		p, err := loadPolicy(pp.policyFile)
+		if err != nil {
+			return err
+		}
+		if *requireACL && len(p.rules) == 0 {
+			return fmt.Errorf("-require_acl is set but the policy %q of port %s has no rules", pp.policyFile, pp.name)
+		}
+		pp.policy.Store(p)
+	}
+	if pp.jwtFile != "" {
+		v, err := loadJWTKey(pp.jwtFile)
+		if err != nil {
+			return err
+		}
+		v.issuer = pp.jwtIssuer
+		pp.jwt.Store(v)
+	}
+	return nil
+}
+
+// verifier returns the token verifier of the -port_policy, nil if it
+// doesn't require tokens.
+func (pp *portPolicy) verifier() *jwtVerifier {
+	if pp == nil || pp.jwtFile == "" {
+		return nil
+	}
+	return pp.jwt.Load().(*jwtVerifier)
+}
+
+// setupPortPolicies parses and loads the -port_policy flags.
+func setupPortPolicies() error {
+	for _, s := range portPolicyFlags {
+		pp, err := parsePortPolicy(s)
+		if err != nil {
+			return err
+		}
+		if err := pp.load(); err != nil {
+			return fmt.Errorf("port %s: %v", pp.name, err)
+		}
+		portPolicies = append(portPolicies, pp)
+		if pp.policyFile != "" || pp.jwtFile != "" {
+			onReload("policy of port "+pp.name, func() error {
+				if err := pp.load(); err != nil {
+					return err
+				}
+				enforcePolicy()
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// portPolicyFor returns the first -port_policy covering port, nil if
+// none or port isn't a number, as for unix routes.
+func portPolicyFor(port string) *portPolicy {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+	for _, pp := range portPolicies {
+		if n >= pp.min && n <= pp.max {
+			return pp
+		}
+	}
+	return nil
+}
+
+// tunnelAllowed reports whether a tunnel on vhost vh to a port under pp,
+// either of which may be nil, is allowed both by the policy of the vhost,
+// or -policy, and by that of the port.
+func tunnelAllowed(vh *vhost, pp *portPolicy, who string, src net.IP, dest string) bool {
+	if p := vh.currentPolicy(); p != nil && !p.allowed(who, src, dest) {
+		return false
+	}
+	if pp != nil && pp.policyFile != "" {
+		return pp.policy.Load().(*policy).allowed(who, src, dest)
+	}
+	return true
+}
+
+// watchIdle calls expire once no data went either way in a tunnel for
+// timeout, unless done is closed first.
+func watchIdle(done <-chan struct{}, st *tunnelStats, timeout time.Duration, expire func()) {
+	t := time.NewTicker(timeout / 10)
+	defer t.Stop()
+	last, since := int64(-1), time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			if n := atomic.LoadInt64(&st.in) + atomic.LoadInt64(&st.out); n != last {
+				last, since = n, now
+			} else if now.Sub(since) >= timeout {
+				expire()
+				return
+			}
+		}
+	}
+}
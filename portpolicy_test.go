@@ -0,0 +1,295 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTemp writes content to a file named name in a temporary directory
+// of the test, and returns its path.
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestParsePortPolicy(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		min, max int
+		check    func(*portPolicy) bool
+		wantErr  string
+	}{
+		{in: "22=require_cert,idle_timeout=12h", min: 22, max: 22,
+			check: func(pp *portPolicy) bool { return pp.requireCert && pp.idleTimeout == 12*time.Hour }},
+		{in: "8000-8999=require_identity,rate=5", min: 8000, max: 8999,
+			check: func(pp *portPolicy) bool { return pp.requireIdentity && pp.limiter != nil }},
+		{in: "5432=policy=db.policy,jwt=k.pem,jwt_issuer=idp", min: 5432, max: 5432,
+			check: func(pp *portPolicy) bool {
+				return pp.policyFile == "db.policy" && pp.jwtFile == "k.pem" && pp.jwtIssuer == "idp"
+			}},
+		{in: "22=", min: 22, max: 22},
+		{in: "require_cert", wantErr: "want PORTS=options"},
+		{in: "0=require_cert", wantErr: "bad port"},
+		{in: "99-10=require_cert", wantErr: "bad port range"},
+		{in: "22-70000=require_cert", wantErr: "bad port range"},
+		{in: "22=rate=0", wantErr: "bad rate"},
+		{in: "22=idle_timeout=soon", wantErr: "bad idle_timeout"},
+		{in: "22=idle_timeout=5ns", wantErr: "idle_timeout 5ns is under 1s"},
+		{in: "22=idle_timeout=1s", min: 22, max: 22,
+			check: func(pp *portPolicy) bool { return pp.idleTimeout == time.Second }},
+		{in: "22=jwt_issuer=idp", wantErr: "jwt_issuer needs jwt"},
+		{in: "22=require_jwt", wantErr: "unknown option"},
+	} {
+		pp, err := parsePortPolicy(test.in)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parsePortPolicy(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortPolicy(%q): %v", test.in, err)
+			continue
+		}
+		if pp.min != test.min || pp.max != test.max {
+			t.Errorf("parsePortPolicy(%q) covers %d-%d, want %d-%d", test.in, pp.min, pp.max, test.min, test.max)
+		}
+		if test.check != nil && !test.check(pp) {
+			t.Errorf("parsePortPolicy(%q) = %+v, options not as given", test.in, pp)
+		}
+	}
+}
+
+func TestPortPolicyFor(t *testing.T) {
+	defer func(old []*portPolicy) { portPolicies = old }(portPolicies)
+	ssh, _ := parsePortPolicy("22=require_cert")
+	high, _ := parsePortPolicy("8000-8999=rate=5")
+	shadowed, _ := parsePortPolicy("8080=require_identity")
+	portPolicies = []*portPolicy{ssh, high, shadowed}
+
+	for _, test := range []struct {
+		port string
+		want *portPolicy
+	}{
+		{"22", ssh},
+		{"8000", high},
+		{"8080", high},
+		{"8999", high},
+		{"9000", nil},
+		{"5432", nil},
+		{"/run/app.sock", nil},
+	} {
+		if got := portPolicyFor(test.port); got != test.want {
+			t.Errorf("portPolicyFor(%q) = %v, want %v", test.port, got, test.want)
+		}
+	}
+}
+
+func TestTunnelAllowed(t *testing.T) {
+	defer aclPolicy.Store(currentPolicy())
+	global, err := loadPolicy(writeTemp(t, "global", "* *:22 *:5432\nalice db.example.com:5432\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclPolicy.Store(global)
+
+	vh := &vhost{name: "ops", policyFile: "ops"}
+	vp, err := loadPolicy(writeTemp(t, "ops", "* ops.example.com:*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh.policy.Store(vp)
+
+	db, _ := parsePortPolicy("5432=policy=db")
+	dp, err := loadPolicy(writeTemp(t, "db", "alice *:5432\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.policy.Store(dp)
+	ssh, _ := parsePortPolicy("22=require_cert")
+
+	for _, test := range []struct {
+		desc string
+		vh   *vhost
+		pp   *portPolicy
+		who  string
+		dest string
+		want bool
+	}{
+		{"global only", nil, nil, "bob", "web.example.com:22", true},
+		{"global refuses", nil, nil, "bob", "web.example.com:80", false},
+		{"port policy without file", nil, ssh, "bob", "web.example.com:22", true},
+		{"both allow", nil, db, "alice", "db.example.com:5432", true},
+		{"port policy refuses", nil, db, "bob", "db.example.com:5432", false},
+		{"port policy can't widen global", nil, db, "alice", "db.example.com:80", false},
+		{"vhost allows", vh, nil, "bob", "ops.example.com:80", true},
+		{"vhost refuses", vh, nil, "bob", "web.example.com:22", false},
+		{"port policy can't widen vhost", vh, db, "alice", "db.example.com:5432", false},
+		{"vhost and port policy allow", vh, db, "alice", "ops.example.com:5432", true},
+	} {
+		if got := tunnelAllowed(test.vh, test.pp, test.who, net.ParseIP("192.0.2.1"), test.dest); got != test.want {
+			t.Errorf("%s: tunnelAllowed(%q, %q) = %v, want %v", test.desc, test.who, test.dest, got, test.want)
+		}
+	}
+}
+
+// makeJWT returns a token of header and claims, signed by sign.
+func makeJWT(t *testing.T, header, claims map[string]interface{}, sign func(string) []byte) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	s := enc(header) + "." + enc(claims)
+	return s + "." + base64.RawURLEncoding.EncodeToString(sign(s))
+}
+
+func TestJWTVerify(t *testing.T) {
+	secret := strings.Repeat("s", 32)
+	hs, err := loadJWTKey(writeTemp(t, "secret", secret+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsIss := *hs
+	hsIss.issuer = "idp"
+	hmacSign := func(key string) func(string) []byte {
+		return func(s string) []byte {
+			m := hmac.New(sha256.New, []byte(key))
+			m.Write([]byte(s))
+			return m.Sum(nil)
+		}
+	}
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&ecPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := loadJWTKey(writeTemp(t, "ec.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSign := func(s string) []byte {
+		sum := sha256.Sum256([]byte(s))
+		r, ss, err := ecdsa.Sign(rand.Reader, ecPriv, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+		return sig
+	}
+
+	now := time.Unix(1700000000, 0)
+	valid := map[string]interface{}{"exp": now.Add(time.Minute).Unix(), "iss": "idp"}
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	es256 := map[string]interface{}{"alg": "ES256", "typ": "JWT"}
+
+	for _, test := range []struct {
+		desc    string
+		v       *jwtVerifier
+		token   string
+		wantErr string
+	}{
+		{"hs256", hs, makeJWT(t, hs256, valid, hmacSign(secret)), ""},
+		{"hs256 with issuer", &hsIss, makeJWT(t, hs256, valid, hmacSign(secret)), ""},
+		{"es256", es, makeJWT(t, es256, valid, ecSign), ""},
+		{"wrong secret", hs, makeJWT(t, hs256, valid, hmacSign(strings.Repeat("x", 32))), "bad signature"},
+		{"wrong ec key", es, makeJWT(t, es256, valid, func(s string) []byte { return make([]byte, 64) }), "bad signature"},
+		{"alg none", hs, makeJWT(t, map[string]interface{}{"alg": "none"}, valid, func(string) []byte { return nil }), "unexpected algorithm"},
+		{"alg for another key", es, makeJWT(t, hs256, valid, hmacSign(secret)), "unexpected algorithm"},
+		{"expired", hs, makeJWT(t, hs256, map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}, hmacSign(secret)), "expired"},
+		{"expired within leeway", hs, makeJWT(t, hs256, map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}, hmacSign(secret)), ""},
+		{"no expiry", hs, makeJWT(t, hs256, map[string]interface{}{"iss": "idp"}, hmacSign(secret)), "no expiry"},
+		{"not yet valid", hs, makeJWT(t, hs256, map[string]interface{}{"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(time.Minute).Unix()}, hmacSign(secret)), "not yet valid"},
+		{"wrong issuer", &hsIss, makeJWT(t, hs256, map[string]interface{}{"exp": now.Add(time.Minute).Unix(), "iss": "other"}, hmacSign(secret)), "issuer"},
+		{"malformed", hs, "abc.def", "malformed"},
+		{"bad header", hs, "!!.e30.", "bad header"},
+	} {
+		err := test.v.verify(test.token, now)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: verify: %v", test.desc, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: verify = %v, want error containing %q", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestLoadJWTKey(t *testing.T) {
+	rsaLike := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("x")})
+	for _, test := range []struct {
+		desc, content, wantErr string
+	}{
+		{"short secret", "tooshort\n", "shorter than 32 bytes"},
+		{"private key", string(rsaLike), "want a PUBLIC KEY or CERTIFICATE"},
+		{"garbage public key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")})), "asn1"},
+	} {
+		_, err := loadJWTKey(writeTemp(t, "key", test.content))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: loadJWTKey = %v, want error containing %q", test.desc, err, test.wantErr)
+		}
+	}
+	if _, err := loadJWTKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadJWTKey of a missing file succeeded")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for _, test := range []struct {
+		header, want string
+	}{
+		{"Bearer abc.def.ghi", "abc.def.ghi"},
+		{"bearer  abc ", "abc"},
+		{"Basic dXNlcjpwYXNz", ""},
+		{"Bearer", ""},
+		{"", ""},
+	} {
+		r := &http.Request{Header: http.Header{}}
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := bearerToken(r); got != test.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+var (
+	protocolRoutes = flag.String("protocol_routes", "", "Comma separated protocol=route pairs: tunnels on -url whose client sends that -protocol hint are dialed the way that tcp or tls -route says, e.g. https=web. Empty ignores the hints.")
+
+	// -protocol_routes by protocol, nil without it.
+	routeByProtocol map[string]*backendRoute
+)
+
+// setupProtocolRoutes parses -protocol_routes, after the -route flags.
+func setupProtocolRoutes() error {
+	if *protocolRoutes == "" {
+		return nil
+	}
+	routeByProtocol = make(map[string]*backendRoute)
+	for _, pair := range strings.Split(*protocolRoutes, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("-protocol_routes: want protocol=route, got %q", pair)
+		}
+		proto, name := strings.ToLower(pair[:i]), pair[i+1:]
+		rt := backendRoutes[name]
+		if rt == nil {
+			return fmt.Errorf("-protocol_routes: no -route named %q", name)
+		}
+		if rt.socket != "" {
+			return fmt.Errorf("-protocol_routes: route %q dials a Unix socket, not the requested host", name)
+		}
+		routeByProtocol[proto] = rt
+	}
+	return nil
+}
+
+// requestProtocol returns the client's protocol hint, or "" if there's
+// none or -protocol_routes isn't set.
+func requestProtocol(r *http.Request) string {
+	if routeByProtocol == nil {
+		return ""
+	}
+	p := strings.ToLower(r.Header.Get(huproxy.ProtocolHeader))
+	if len(p) > 32 {
+		return ""
+	}
+	for _, c := range p {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return p
+}
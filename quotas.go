@@ -0,0 +1,284 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	huproxy "github.com/google/huproxy/lib"
+)
+
+// Metrics key for identities without a line of their own in -quotas.
+const otherIdentities = "other"
+
+var (
+	quotasFile = flag.String("quotas", "", "File of per-identity limits on concurrent tunnels and bandwidth. See the README for the format.")
+
+	// Current *quotas, nil if there are none.
+	identityQuotas atomic.Value
+
+	identityLimits = newDestLimiter()
+	identityRates  = newRateLimiters()
+	// The same for clients without an identity, by address.
+	anonLimits = newDestLimiter()
+	anonRates  = newRateLimiters()
+
+	metricIdentityActive = expvar.NewMap("identity_tunnels_active")
+	metricIdentityBytes  = expvar.NewMap("identity_bytes")
+)
+
+// quota limits what one identity can use at once, across its tunnels.
+// Zero is unlimited.
+type quota struct {
+	tunnels int
+	// Bytes per second, both directions together.
+	bandwidth int64
+}
+
+// quotas maps identities to their quota. The file has one identity per
+// line:
+//
+//	# identity  tunnels  bandwidth (bytes/s, with K, M or G)
+//	alice       5        10M
+//	*           2        1M
+//
+// Identities without a line of their own get the limits of the "*" line,
+// if any, each separately, as do clients without an identity, each
+// client address separately.
+type quotas struct {
+	byIdentity map[string]quota
+}
+
+func loadQuotas(fn string) (*quotas, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	q := &quotas{byIdentity: make(map[string]quota)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want \"identity tunnels bandwidth\", got %q", fn, n, line)
+		}
+		t, err := strconv.Atoi(fields[1])
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("%s:%d: bad tunnel count %q", fn, n, fields[1])
+		}
+		b, err := parseBytes(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, n, err)
+		}
+		q.byIdentity[fields[0]] = quota{tunnels: t, bandwidth: b}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Suffixes of byte counts, as powers of 1024.
+var byteUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+}
+
+// parseBytes parses a number of bytes, or bytes per second, with an
+// optional K, M or G suffix, or KiB, MiB or GiB, for powers of 1024.
+func parseBytes(s string) (int64, error) {
+	num, mult := s, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("bad byte count %q", s)
+	}
+	return n * mult, nil
+}
+
+// forIdentity returns the quota of identity, and the key to report its
+// metrics under, which is only ever a configured identity or "other".
+func (q *quotas) forIdentity(identity string) (quota, string, bool) {
+	if qt, ok := q.byIdentity[identity]; ok && identity != wildcardIdentity {
+		return qt, identity, true
+	}
+	qt, ok := q.byIdentity[wildcardIdentity]
+	return qt, otherIdentities, ok
+}
+
+func currentQuotas() *quotas {
+	q, _ := identityQuotas.Load().(*quotas)
+	return q
+}
+
+// sharedLimiter is the Limiter shared by the tunnels of one identity.
+type sharedLimiter struct {
+	l    *huproxy.Limiter
+	refs int
+}
+
+// rateLimiters hands out the Limiter of each identity, creating it on
+// first use and dropping it once no tunnel uses it.
+type rateLimiters struct {
+	mu sync.Mutex
+	m  map[string]*sharedLimiter
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{m: make(map[string]*sharedLimiter)}
+}
+
+// get returns the limiter of identity, for rate bytes per second. The
+// rate of a limiter already in use is updated, so that reloads apply.
+func (r *rateLimiters) get(identity string, rate int64) *huproxy.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.m[identity]
+	if !ok {
+		s = &sharedLimiter{l: huproxy.NewLimiter(float64(rate))}
+		r.m[identity] = s
+	} else {
+		s.l.SetRate(float64(rate))
+	}
+	s.refs++
+	return s.l
+}
+
+func (r *rateLimiters) release(identity string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.m[identity]; s != nil {
+		if s.refs--; s.refs <= 0 {
+			delete(r.m, identity)
+		}
+	}
+}
+
+// throttledConn holds up reads from and writes to the backend to the
+// rate of its limiter.
+type throttledConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *throttledConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *throttledConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// loadIdentityQuotas (re)reads -quotas.
+func loadIdentityQuotas() error {
+	q, err := loadQuotas(*quotasFile)
+	if err != nil {
+		return err
+	}
+	identityQuotas.Store(q)
+	return nil
+}
+
+// quotaUse is one tunnel's share of its identity's quota.
+type quotaUse struct {
+	// Who the tunnel counts against, the identity or, for clients
+	// without one, their address, in limits and rates.
+	bucket string
+	limits *destLimiter
+	rates  *rateLimiters
+	key    string
+	l      *huproxy.Limiter
+}
+
+// acquireQuota reserves a tunnel for who, from the client address addr,
+// under -quotas, returning false if who already has as many as allowed.
+// Clients without an identity are counted by address. A nil *quotaUse,
+// for identities without a quota, does nothing.
+func acquireQuota(who, addr string) (*quotaUse, bool) {
+	q := currentQuotas()
+	if q == nil {
+		return nil, true
+	}
+	qt, key, ok := q.forIdentity(who)
+	if !ok {
+		return nil, true
+	}
+	u := &quotaUse{bucket: who, limits: identityLimits, rates: identityRates, key: key}
+	if who == "" {
+		u.bucket, u.limits, u.rates = addr, anonLimits, anonRates
+	}
+	if !u.limits.acquire(u.bucket, qt.tunnels) {
+		return nil, false
+	}
+	if qt.bandwidth > 0 {
+		u.l = u.rates.get(u.bucket, qt.bandwidth)
+	}
+	metricIdentityActive.Add(key, 1)
+	return u, true
+}
+
+// wrap throttles c to the identity's bandwidth, until ctx is done.
+func (u *quotaUse) wrap(ctx context.Context, c net.Conn) net.Conn {
+	if u == nil || u.l == nil {
+		return c
+	}
+	return &throttledConn{
+		Conn: c,
+		r:    huproxy.NewRateLimitedReader(ctx, c, u.l),
+		w:    huproxy.NewRateLimitedWriter(ctx, c, u.l),
+	}
+}
+
+// count adds bytes carried by the tunnel to the identity's metrics.
+func (u *quotaUse) count(bytes int64) {
+	if u != nil {
+		metricIdentityBytes.Add(u.key, bytes)
+	}
+}
+
+// release gives back the tunnel.
+func (u *quotaUse) release() {
+	if u == nil {
+		return
+	}
+	u.limits.release(u.bucket)
+	if u.l != nil {
+		u.rates.release(u.bucket)
+	}
+	metricIdentityActive.Add(u.key, -1)
+}
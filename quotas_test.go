@@ -0,0 +1,205 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1500", 1500, false},
+		{"64K", 64 << 10, false},
+		{"64KiB", 64 << 10, false},
+		{"10M", 10 << 20, false},
+		{"10MiB", 10 << 20, false},
+		{"2G", 2 << 30, false},
+		{"2GiB", 2 << 30, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"-1K", 0, true},
+		{"1.5M", 0, true},
+		{"10k", 0, true},
+		{"10KB", 0, true},
+		{"9999999999999G", 0, true},
+	} {
+		got, err := parseBytes(test.in)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseBytes(%q) = %d, %v; want %d, error %v", test.in, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestLoadQuotas(t *testing.T) {
+	for _, test := range []struct {
+		desc, content string
+		want          map[string]quota
+		wantErr       string
+	}{
+		{"quotas", "# comment\nalice 5 10M\n\nbob 0 1K # no tunnel limit\n* 2 0\n", map[string]quota{
+			"alice": {5, 10 << 20},
+			"bob":   {0, 1 << 10},
+			"*":     {2, 0},
+		}, ""},
+		{"missing field", "alice 5\n", nil, "want \"identity tunnels bandwidth\""},
+		{"bad tunnels", "alice many 1M\n", nil, "bad tunnel count"},
+		{"bad bandwidth", "alice 5 fast\n", nil, "bad byte count"},
+	} {
+		q, err := loadQuotas(writeTemp(t, "quotas", test.content))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: loadQuotas = %v, want error containing %q", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadQuotas: %v", test.desc, err)
+			continue
+		}
+		if len(q.byIdentity) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, q.byIdentity, test.want)
+		}
+		for who, qt := range test.want {
+			if q.byIdentity[who] != qt {
+				t.Errorf("%s: quota of %q = %+v, want %+v", test.desc, who, q.byIdentity[who], qt)
+			}
+		}
+	}
+}
+
+func TestForIdentity(t *testing.T) {
+	q := &quotas{byIdentity: map[string]quota{"alice": {5, 0}, "*": {2, 0}}}
+	noWildcard := &quotas{byIdentity: map[string]quota{"alice": {5, 0}}}
+	for _, test := range []struct {
+		q       *quotas
+		who     string
+		want    quota
+		wantKey string
+		wantOK  bool
+	}{
+		{q, "alice", quota{5, 0}, "alice", true},
+		{q, "bob", quota{2, 0}, otherIdentities, true},
+		{q, "", quota{2, 0}, otherIdentities, true},
+		{q, "*", quota{2, 0}, otherIdentities, true},
+		{noWildcard, "alice", quota{5, 0}, "alice", true},
+		{noWildcard, "bob", quota{}, otherIdentities, false},
+	} {
+		qt, key, ok := test.q.forIdentity(test.who)
+		if qt != test.want || key != test.wantKey || ok != test.wantOK {
+			t.Errorf("forIdentity(%q) = %+v, %q, %v; want %+v, %q, %v", test.who, qt, key, ok, test.want, test.wantKey, test.wantOK)
+		}
+	}
+}
+
+func TestAcquireQuota(t *testing.T) {
+	defer identityQuotas.Store(currentQuotas())
+	identityQuotas.Store(&quotas{byIdentity: map[string]quota{"alice": {2, 1 << 20}, "*": {1, 0}}})
+
+	type try struct {
+		who, addr string
+		want      bool
+	}
+	for _, test := range []struct {
+		desc  string
+		tries []try
+	}{
+		{"identity limit", []try{
+			{"alice", "192.0.2.1", true},
+			{"alice", "192.0.2.2", true},
+			{"alice", "192.0.2.3", false},
+		}},
+		{"wildcard per identity", []try{
+			{"bob", "192.0.2.1", true},
+			{"carol", "192.0.2.1", true},
+			{"bob", "192.0.2.2", false},
+		}},
+		{"anonymous per address", []try{
+			{"", "192.0.2.1", true},
+			{"", "192.0.2.2", true},
+			{"", "192.0.2.1", false},
+		}},
+		{"anonymous apart from identities", []try{
+			{"192.0.2.1", "192.0.2.9", true},
+			{"", "192.0.2.1", true},
+		}},
+	} {
+		var held []*quotaUse
+		for i, tr := range test.tries {
+			u, ok := acquireQuota(tr.who, tr.addr)
+			if ok != tr.want {
+				t.Errorf("%s: try %d by %q from %s = %v, want %v", test.desc, i, tr.who, tr.addr, ok, tr.want)
+			}
+			if ok {
+				held = append(held, u)
+			}
+		}
+		for _, u := range held {
+			u.release()
+		}
+		if len(identityLimits.active) != 0 || len(anonLimits.active) != 0 || len(identityRates.m) != 0 || len(anonRates.m) != 0 {
+			t.Errorf("%s: quotas still held after release: %v %v %v %v", test.desc, identityLimits.active, anonLimits.active, identityRates.m, anonRates.m)
+		}
+	}
+}
+
+func TestRateLimitersShared(t *testing.T) {
+	r := newRateLimiters()
+	a := r.get("alice", 100)
+	if b := r.get("alice", 200); b != a {
+		t.Error("tunnels of one identity got different limiters")
+	}
+	if r.get("bob", 100) == a {
+		t.Error("two identities share a limiter")
+	}
+	r.release("alice")
+	if r.m["alice"] == nil {
+		t.Error("limiter dropped while still in use")
+	}
+	r.release("alice")
+	r.release("bob")
+	if len(r.m) != 0 {
+		t.Errorf("limiters left after release: %v", r.m)
+	}
+}
+
+func TestDestLimiter(t *testing.T) {
+	l := newDestLimiter()
+	for _, test := range []struct {
+		dest string
+		max  int
+		want bool
+	}{
+		{"a:1", 2, true},
+		{"a:1", 2, true},
+		{"a:1", 2, false},
+		{"b:1", 2, true},
+		{"a:1", 0, true},
+	} {
+		if got := l.acquire(test.dest, test.max); got != test.want {
+			t.Errorf("acquire(%q, %d) with %d active = %v, want %v", test.dest, test.max, l.active[test.dest], got, test.want)
+		}
+	}
+	for _, d := range []string{"a:1", "a:1", "a:1", "b:1"} {
+		l.release(d)
+	}
+	if len(l.active) != 0 {
+		t.Errorf("slots left after release: %v", l.active)
+	}
+}
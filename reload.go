@@ -0,0 +1,62 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var reloaders struct {
+	sync.Mutex
+	names []string
+	funcs []func() error
+}
+
+// onReload registers fn to be called on SIGHUP. On error the old
+// configuration stays in force.
+func onReload(name string, fn func() error) {
+	reloaders.Lock()
+	defer reloaders.Unlock()
+	reloaders.names = append(reloaders.names, name)
+	reloaders.funcs = append(reloaders.funcs, fn)
+}
+
+// reload calls all registered reload functions.
+func reload() {
+	reloaders.Lock()
+	defer reloaders.Unlock()
+	for i, fn := range reloaders.funcs {
+		if err := fn(); err != nil {
+			log.Errorf("Reloading %s, keeping old one: %v", reloaders.names[i], err)
+			continue
+		}
+		log.Infof("Reloaded %s", reloaders.names[i])
+	}
+}
+
+// handleReloads reloads configuration on each SIGHUP.
+func handleReloads() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			reload()
+		}
+	}()
+}
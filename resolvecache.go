@@ -0,0 +1,80 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+// Max names in the resolve cache.
+const resolveCacheSize = 1024
+
+var (
+	resolveCacheTTL = flag.Duration("resolve_cache_ttl", 0, "Cache backend name lookups this long, saving the DNS round trip for e.g. repeated short tunnels to the same host. Failed lookups aren't cached. 0 disables.")
+
+	resolveCache = &addrCache{m: make(map[string]cachedAddrs)}
+
+	metricResolveCache = expvar.NewMap("resolve_cache")
+)
+
+type cachedAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// addrCache maps backend names to their addresses.
+type addrCache struct {
+	mu sync.Mutex
+	m  map[string]cachedAddrs
+}
+
+// get returns the unexpired addresses of host, if cached.
+func (c *addrCache) get(host string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[host]
+	if !ok {
+		metricResolveCache.Add("miss", 1)
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.m, host)
+		metricResolveCache.Add("miss", 1)
+		return nil, false
+	}
+	metricResolveCache.Add("hit", 1)
+	return e.addrs, true
+}
+
+// put caches addrs for host for -resolve_cache_ttl. When the cache is
+// full, expired names are dropped, and if that's not enough, all of them.
+func (c *addrCache) put(host string, addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.m) >= resolveCacheSize {
+		for h, e := range c.m {
+			if now.After(e.expires) {
+				delete(c.m, h)
+			}
+		}
+		if len(c.m) >= resolveCacheSize {
+			c.m = make(map[string]cachedAddrs)
+		}
+	}
+	c.m[host] = cachedAddrs{addrs: addrs, expires: now.Add(*resolveCacheTTL)}
+}
@@ -0,0 +1,44 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"net"
+	"os"
+)
+
+var reusePort = flag.Bool("reuseport", false, "Listen with SO_REUSEPORT, so that several huproxy processes can share the port. Linux and BSDs only.")
+
+func init() {
+	// Several processes sharing a port are told apart by this, when
+	// aggregating their metrics.
+	expvar.Publish("pid", expvar.Func(func() interface{} {
+		return os.Getpid()
+	}))
+}
+
+// listenTCP opens the server's listener, honoring -reuseport.
+func listenTCP(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if *reusePort {
+		if err := checkReusePort(); err != nil {
+			return nil, err
+		}
+		lc.Control = setReusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
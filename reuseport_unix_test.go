@@ -0,0 +1,43 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+package main
+
+import "testing"
+
+func TestListenTCPReusePort(t *testing.T) {
+	defer func(v bool) { *reusePort = v }(*reusePort)
+	for _, test := range []struct {
+		reuse       bool
+		wantSharing bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		*reusePort = test.reuse
+		l1, err := listenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l2, err := listenTCP(l1.Addr().String())
+		if got := err == nil; got != test.wantSharing {
+			t.Errorf("-reuseport=%v: second listener on %v: %v, want sharing %v", test.reuse, l1.Addr(), err, test.wantSharing)
+		}
+		if l2 != nil {
+			l2.Close()
+		}
+		l1.Close()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long a reverse lookup for the logs may take.
+	reverseDNSTimeout = 2 * time.Second
+	// How long names, or their absence, are cached.
+	reverseDNSTTL = 10 * time.Minute
+	// Max cached names. The cache starts afresh once it's full.
+	reverseDNSCacheSize = 4096
+)
+
+var (
+	reverseDNSLog = flag.Bool("reverse_dns_log", false, "Log the reverse DNS name of destinations given as IP addresses, as dest_name. Looked up in the background and cached, so the first tunnel to an address may be logged without it.")
+
+	reverseNames = &reverseCache{m: make(map[string]reverseName)}
+)
+
+type reverseName struct {
+	name    string
+	expires time.Time
+	// Set while the lookup is in flight.
+	pending bool
+}
+
+// reverseCache caches reverse lookups of destination addresses.
+type reverseCache struct {
+	mu sync.Mutex
+	m  map[string]reverseName
+}
+
+// lookup returns the cached name of ip, if any. Otherwise it starts
+// looking it up for later calls, without waiting.
+func (c *reverseCache) lookup(ip string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.m[ip]; ok && (n.pending || time.Now().Before(n.expires)) {
+		return n.name
+	}
+	if len(c.m) >= reverseDNSCacheSize {
+		c.m = make(map[string]reverseName)
+	}
+	c.m[ip] = reverseName{pending: true}
+	go c.resolve(ip)
+	return ""
+}
+
+func (c *reverseCache) resolve(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+	defer cancel()
+	var name string
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[ip] = reverseName{name: name, expires: time.Now().Add(reverseDNSTTL)}
+}
+
+// withDestName adds the reverse DNS name of host to entry under
+// -reverse_dns_log, if host is an IP address with a known name.
+func withDestName(entry *log.Entry, host string) *log.Entry {
+	if !*reverseDNSLog {
+		return entry
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return entry
+	}
+	if name := reverseNames.lookup(ip.String()); name != "" {
+		return entry.WithField("dest_name", name)
+	}
+	return entry
+}
@@ -0,0 +1,132 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func init() {
+	flag.Var(&routeFlags, "route", "Extra tunnel route with its own way of reaching backends, as name=tcp, name=tls[,sni=NAME][,cacert=FILE][,insecure] or name=unix:/path/to/socket. See the README. May be repeated.")
+}
+
+var (
+	routeFlags listFlag
+
+	// Configured -route routes by name.
+	backendRoutes = make(map[string]*backendRoute)
+
+	validRouteName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// backendRoute is a -route: a path of its own, with a way of dialing
+// backends that overrides -dial_tls.
+type backendRoute struct {
+	name string
+	// TLS config for tls routes, nil for plain TCP.
+	tls *tls.Config
+	// Socket of unix routes, which have no host or port in the path.
+	socket string
+}
+
+// parseRoute parses a -route flag.
+func parseRoute(s string) (*backendRoute, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("want name=tcp, name=tls[,options] or name=unix:/path, got %q", s)
+	}
+	rt := &backendRoute{name: s[:i]}
+	if !validRouteName.MatchString(rt.name) {
+		return nil, fmt.Errorf("route name %q must be letters, digits, '-' and '_'", rt.name)
+	}
+	if rt.name == *url {
+		return nil, fmt.Errorf("route %q is already the -url path", rt.name)
+	}
+	opts := strings.Split(s[i+1:], ",")
+	switch kind := opts[0]; {
+	case kind == "tcp":
+		if len(opts) > 1 {
+			return nil, fmt.Errorf("route %q: tcp takes no options", rt.name)
+		}
+	case kind == "tls":
+		rt.tls = &tls.Config{}
+		for _, o := range opts[1:] {
+			switch {
+			case strings.HasPrefix(o, "sni="):
+				rt.tls.ServerName = strings.TrimPrefix(o, "sni=")
+			case strings.HasPrefix(o, "cacert="):
+				fn := strings.TrimPrefix(o, "cacert=")
+				b, err := ioutil.ReadFile(fn)
+				if err != nil {
+					return nil, fmt.Errorf("route %q: %v", rt.name, err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(b) {
+					return nil, fmt.Errorf("route %q: no certificates found in %q", rt.name, fn)
+				}
+				rt.tls.RootCAs = pool
+			case o == "insecure":
+				rt.tls.InsecureSkipVerify = true
+			default:
+				return nil, fmt.Errorf("route %q: unknown tls option %q", rt.name, o)
+			}
+		}
+	case strings.HasPrefix(kind, "unix:"):
+		rt.socket = strings.TrimPrefix(kind, "unix:")
+		if rt.socket == "" || len(opts) > 1 {
+			return nil, fmt.Errorf("route %q: want unix:/path/to/socket, got %q", rt.name, s[i+1:])
+		}
+	default:
+		return nil, fmt.Errorf("route %q: unknown dial type %q, want tcp, tls or unix:/path", rt.name, kind)
+	}
+	return rt, nil
+}
+
+// setupRoutes adds the -route routes to m, passing their requests through
+// wrap.
+func setupRoutes(m *mux.Router, wrap func(http.HandlerFunc) http.HandlerFunc) error {
+	for _, s := range routeFlags {
+		rt, err := parseRoute(s)
+		if err != nil {
+			return err
+		}
+		if backendRoutes[rt.name] != nil {
+			return fmt.Errorf("route %q given twice", rt.name)
+		}
+		backendRoutes[rt.name] = rt
+		p := fmt.Sprintf("/%s/{host}/{port}", rt.name)
+		if rt.socket != "" {
+			p = "/" + rt.name
+		}
+		if *pathSecret != "" {
+			p = "/{secret}" + p
+		}
+		m.HandleFunc(p, wrap(handleProxy)).Name(rt.name)
+	}
+	return nil
+}
+
+// requestRoute returns the -route r came in on, nil for the -url one.
+func requestRoute(r *http.Request) *backendRoute {
+	return backendRoutes[routeName(r)]
+}
@@ -0,0 +1,181 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// testCert returns the certificate of httptest TLS servers, valid for
+// 127.0.0.1, and a -route cacert= file holding it.
+func testCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	ca := writeTemp(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	return srv.TLS.Certificates[0], ca
+}
+
+func TestParseRoute(t *testing.T) {
+	_, ca := testCert(t)
+	notPEM := writeTemp(t, "not.pem", "not a certificate")
+	for _, test := range []struct {
+		in      string
+		check   func(*backendRoute) bool
+		wantErr string
+	}{
+		{"ssh=tcp", func(rt *backendRoute) bool { return rt.name == "ssh" && rt.tls == nil && rt.socket == "" }, ""},
+		{"web=tls", func(rt *backendRoute) bool { return rt.tls != nil && rt.tls.RootCAs == nil }, ""},
+		{"web=tls,sni=internal.example.com,cacert=" + ca, func(rt *backendRoute) bool {
+			return rt.tls.ServerName == "internal.example.com" && rt.tls.RootCAs != nil
+		}, ""},
+		{"web=tls,insecure", func(rt *backendRoute) bool { return rt.tls.InsecureSkipVerify }, ""},
+		{"sock=unix:/run/app.sock", func(rt *backendRoute) bool { return rt.socket == "/run/app.sock" && rt.tls == nil }, ""},
+		{"ssh", nil, "want name="},
+		{"=tcp", nil, "want name="},
+		{"a/b=tcp", nil, "must be letters"},
+		{"proxy=tcp", nil, "already the -url path"},
+		{"ssh=tcp,insecure", nil, "tcp takes no options"},
+		{"ssh=udp", nil, "unknown dial type"},
+		{"web=tls,verify", nil, "unknown tls option"},
+		{"web=tls,cacert=" + ca + ".missing", nil, "no such file"},
+		{"web=tls,cacert=" + notPEM, nil, "no certificates found"},
+		{"sock=unix:", nil, "want unix:/path"},
+		{"sock=unix:/run/app.sock,insecure", nil, "want unix:/path"},
+	} {
+		rt, err := parseRoute(test.in)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseRoute(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRoute(%q): %v", test.in, err)
+		} else if !test.check(rt) {
+			t.Errorf("parseRoute(%q) = %+v", test.in, rt)
+		}
+	}
+}
+
+// echo serves connections on l by echoing them.
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// TestRoutes tunnels through a route of each dial type to an echo server
+// it can reach.
+func TestRoutes(t *testing.T) {
+	defer func(f listFlag, r map[string]*backendRoute) { routeFlags, backendRoutes = f, r }(routeFlags, backendRoutes)
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	go echo(plain)
+
+	cert, ca := testCert(t)
+	secure, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+	go echo(secure)
+
+	sock := filepath.Join(t.TempDir(), "echo.sock")
+	local, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go echo(local)
+
+	routeFlags = listFlag{"plain=tcp", "secure=tls,cacert=" + ca, "local=unix:" + sock}
+	backendRoutes = make(map[string]*backendRoute)
+	m := mux.NewRouter()
+	if err := setupRoutes(m, func(h http.HandlerFunc) http.HandlerFunc { return h }); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	base := "ws" + strings.TrimPrefix(srv.URL, "http")
+	path := func(l net.Listener) string {
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		return host + "/" + port
+	}
+	for _, test := range []struct {
+		desc   string
+		path   string
+		wantOK bool
+	}{
+		{"tcp", "/plain/" + path(plain), true},
+		{"tls", "/secure/" + path(secure), true},
+		{"unix", "/local", true},
+		// A plain backend doesn't do for a tls route, nor the other way
+		// round.
+		{"tls to plain", "/secure/" + path(plain), false},
+		{"tcp to tls", "/plain/" + path(secure), false},
+	} {
+		c, _, err := websocket.DefaultDialer.Dial(base+test.path, nil)
+		if err != nil {
+			if test.wantOK {
+				t.Errorf("%s: %v", test.desc, err)
+			}
+			continue
+		}
+		// A TLS backend given plain data waits for the rest of the record.
+		c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		got := ""
+		if err := c.WriteMessage(websocket.BinaryMessage, []byte("ping")); err == nil {
+			for len(got) < 4 {
+				_, b, err := c.ReadMessage()
+				if err != nil {
+					break
+				}
+				got += string(b)
+			}
+		}
+		c.Close()
+		if (got == "ping") != test.wantOK {
+			t.Errorf("%s: echoed %q, want working %v", test.desc, got, test.wantOK)
+		}
+	}
+
+	if err := setupRoutes(mux.NewRouter(), func(h http.HandlerFunc) http.HandlerFunc { return h }); err == nil || !strings.Contains(err.Error(), "given twice") {
+		t.Errorf("setting up the routes again: %v, want them given twice", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	pathSecret = flag.String("path_secret", "", "Comma separated secrets, or @<filename> with one per line. If set, tunnels are only served under /<secret>/<url>/...")
+
+	// Current []string of valid secrets.
+	pathSecrets atomic.Value
+)
+
+// loadPathSecrets parses -path_secret.
+func loadPathSecrets() error {
+	var list []string
+	if strings.HasPrefix(*pathSecret, "@") {
+		b, err := ioutil.ReadFile((*pathSecret)[1:])
+		if err != nil {
+			return err
+		}
+		list = strings.Split(string(b), "\n")
+	} else {
+		list = strings.Split(*pathSecret, ",")
+	}
+	var secrets []string
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("no secrets in -path_secret")
+	}
+	pathSecrets.Store(secrets)
+	return nil
+}
+
+// validSecret compares s against every valid secret in constant time.
+func validSecret(s string) bool {
+	ok := 0
+	for _, want := range pathSecrets.Load().([]string) {
+		ok |= subtle.ConstantTimeCompare([]byte(s), []byte(want))
+	}
+	return ok == 1
+}
+
+// requireSecret wraps h to answer 404, as for any unknown path, unless
+// the {secret} path element is valid.
+func requireSecret(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validSecret(mux.Vars(r)["secret"]) {
+			metricRejected.Add("path_secret", 1)
+			notFound(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Longest -close_on_backend_byte sequence.
+const maxSentinel = 64
+
+var (
+	closeOnBackend = flag.String("close_on_backend_byte", "", "Hex byte sequence, e.g. 04 for EOT. If set, a tunnel is closed once its backend sends it, after passing it on to the client. This inspects everything backends send.")
+
+	// Parsed -close_on_backend_byte, nil if unset.
+	backendSentinel []byte
+)
+
+// errSentinel is returned by sentinelReader after the sentinel.
+var errSentinel = errors.New("backend sent -close_on_backend_byte sequence")
+
+func parseSentinel() error {
+	if *closeOnBackend == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(*closeOnBackend)
+	if err != nil {
+		return fmt.Errorf("-close_on_backend_byte: %v", err)
+	}
+	if len(b) == 0 || len(b) > maxSentinel {
+		return fmt.Errorf("-close_on_backend_byte must be 1 to %d bytes", maxSentinel)
+	}
+	backendSentinel = b
+	return nil
+}
+
+// sentinelReader passes on reads up to and including the first occurrence
+// of sentinel, then fails with errSentinel. The end of the previous read
+// is kept, so that a sentinel split across reads is still found.
+type sentinelReader struct {
+	r        io.Reader
+	sentinel []byte
+	tail     []byte
+	found    bool
+}
+
+func (s *sentinelReader) Read(b []byte) (int, error) {
+	if s.found {
+		return 0, errSentinel
+	}
+	n, err := s.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	buf := append(s.tail, b[:n]...)
+	if i := bytes.Index(buf, s.sentinel); i >= 0 {
+		s.found = true
+		// Where the sentinel ends in b.
+		return i + len(s.sentinel) - len(s.tail), nil
+	}
+	keep := len(s.sentinel) - 1
+	if len(buf) < keep {
+		keep = len(buf)
+	}
+	s.tail = append(s.tail[:0], buf[len(buf)-keep:]...)
+	return n, err
+}
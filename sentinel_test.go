@@ -0,0 +1,71 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// chunkReader returns one of its chunks per read.
+type chunkReader []string
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(*c) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*c)[0])
+	*c = (*c)[1:]
+	return n, nil
+}
+
+func TestSentinelReader(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		sentinel string
+		chunks   []string
+		want     []string
+		wantErr  error
+	}{
+		{"no sentinel", "\x04", []string{"abc", "def"}, []string{"abc", "def"}, io.EOF},
+		{"sentinel in a read", "\x04", []string{"ab\x04cd", "ef"}, []string{"ab\x04"}, errSentinel},
+		{"sentinel at the start", "END", []string{"ENDx"}, []string{"END"}, errSentinel},
+		{"split across two reads", "END", []string{"abEN", "Dcd"}, []string{"abEN", "D"}, errSentinel},
+		{"split across three reads", "END", []string{"abE", "N", "Dcd"}, []string{"abE", "N", "D"}, errSentinel},
+		{"partial match is data", "END", []string{"abEN", "Ocd"}, []string{"abEN", "Ocd"}, io.EOF},
+		{"partial match, then the sentinel", "END", []string{"abEN", "xEN", "D", "cd"}, []string{"abEN", "xEN", "D"}, errSentinel},
+		{"overlapping partial match", "EEND", []string{"xEE", "END"}, []string{"xEE", "END"}, errSentinel},
+		{"data before the sentinel kept", "END", []string{"E", "E", "ND"}, []string{"E", "E", "ND"}, errSentinel},
+	} {
+		chunks := chunkReader(test.chunks)
+		s := &sentinelReader{r: &chunks, sentinel: []byte(test.sentinel)}
+		var got []string
+		var err error
+		buf := make([]byte, 64)
+		for err == nil {
+			var n int
+			n, err = s.Read(buf)
+			if n > 0 {
+				got = append(got, string(buf[:n]))
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got reads %q, want %q", test.desc, got, test.want)
+		}
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+}
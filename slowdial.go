@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	slowDialThreshold = flag.Duration("slow_dial_threshold", time.Second, "Log tunnels taking longer than this to set up (resolve, connect and upgrade). 0 disables.")
+
+	metricSetupLatency = newHistogram("tunnel_setup_latency",
+		10*time.Millisecond, 50*time.Millisecond, 100*time.Millisecond,
+		500*time.Millisecond, time.Second, 5*time.Second, 10*time.Second)
+)
+
+// portClass groups ports for logging, to tell e.g. SSH from web
+// backends without logging every port number separately.
+func portClass(port string) string {
+	n, err := strconv.Atoi(port)
+	switch {
+	case err != nil:
+		return "named"
+	case n == 22:
+		return "ssh"
+	case n < 1024:
+		return "well-known"
+	case n < 49152:
+		return "registered"
+	default:
+		return "dynamic"
+	}
+}
+
+// noteSetup records how long it took from receiving the request to
+// either starting the tunnel or failing to, with timeout the connect
+// timeout that applied.
+func noteSetup(entry *log.Entry, port string, timeout, d time.Duration, result string) {
+	if result == "ok" {
+		metricSetupLatency.observe(d)
+	}
+	if *slowDialThreshold > 0 && d > *slowDialThreshold {
+		entry.WithFields(log.Fields{
+			"setup":        d.String(),
+			"dial_timeout": timeout.String(),
+			"port_class":   portClass(port),
+			"result":       result,
+		}).Warning("Slow tunnel setup")
+	}
+}
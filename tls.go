@@ -0,0 +1,221 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	tlsCert = flag.String("tls_cert", "", "Serve TLS with this PEM certificate, instead of plain HTTP.")
+	tlsKey  = flag.String("tls_key", "", "PEM key for -tls_cert.")
+	tlsCA   = flag.String("tls_client_ca", "", "With -tls_cert, require client certificates signed by a CA in this PEM file.")
+	tlsALPN = flag.String("tls_alpn", "", "Comma separated ALPN protocols to accept with -tls_cert, besides http/1.1. The one negotiated is logged.")
+
+	tlsMinVersion = flag.String("tls_min_version", "", "Lowest TLS version to accept with -tls_cert: 1.0, 1.1, 1.2 or 1.3. Empty leaves Go's default.")
+	tlsMaxVersion = flag.String("tls_max_version", "", "Highest TLS version to accept with -tls_cert: 1.0, 1.1, 1.2 or 1.3. Empty allows up to TLS 1.3.")
+	tlsCiphers    = flag.String("tls_cipher_suites", "", "Comma separated cipher suites to accept with -tls_cert for TLS 1.2 and below, by their Go names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites can't be limited. Empty leaves Go's default.")
+)
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a -tls_min_version or -tls_max_version, 0 if
+// empty.
+func parseTLSVersion(flagName, s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersionNames[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("-%s %q, want 1.0, 1.1, 1.2 or 1.3", flagName, s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses -tls_cipher_suites. Only the suites Go
+// considers secure are accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range tls.CipherSuites() {
+			if name != c.Name {
+				continue
+			}
+			if len(c.SupportedVersions) == 1 && c.SupportedVersions[0] == tls.VersionTLS13 {
+				return nil, fmt.Errorf("cipher suite %s is TLS 1.3's, which can't be limited", name)
+			}
+			found = true
+			ids = append(ids, c.ID)
+			break
+		}
+		if found {
+			continue
+		}
+		for _, c := range tls.InsecureCipherSuites() {
+			if name == c.Name {
+				return nil, fmt.Errorf("cipher suite %s is insecure", name)
+			}
+		}
+		return nil, fmt.Errorf("unknown cipher suite %q", name)
+	}
+	return ids, nil
+}
+
+// setTLSVersions applies -tls_min_version, -tls_max_version and
+// -tls_cipher_suites to c.
+func setTLSVersions(c *tls.Config) error {
+	min, err := parseTLSVersion("tls_min_version", *tlsMinVersion)
+	if err != nil {
+		return err
+	}
+	max, err := parseTLSVersion("tls_max_version", *tlsMaxVersion)
+	if err != nil {
+		return err
+	}
+	if min != 0 && max != 0 && min > max {
+		return fmt.Errorf("-tls_min_version %s is above -tls_max_version %s", *tlsMinVersion, *tlsMaxVersion)
+	}
+	suites, err := parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return err
+	}
+	if suites != nil && min == tls.VersionTLS13 {
+		return fmt.Errorf("-tls_cipher_suites has no effect with -tls_min_version 1.3")
+	}
+	c.MinVersion, c.MaxVersion, c.CipherSuites = min, max, suites
+	return nil
+}
+
+// setupServerTLS configures s for -tls_cert, if set.
+func setupServerTLS(s *http.Server) error {
+	if *pinnedCertsFile != "" && *tlsCA == "" {
+		return fmt.Errorf("-pinned_client_certs needs -tls_client_ca")
+	}
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsALPN != "" || *tlsCA != "" {
+			return fmt.Errorf("-tls_alpn and -tls_client_ca need -tls_cert")
+		}
+		if *tlsMinVersion != "" || *tlsMaxVersion != "" || *tlsCiphers != "" {
+			return fmt.Errorf("-tls_min_version, -tls_max_version and -tls_cipher_suites need -tls_cert")
+		}
+		return setupJA3(s)
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return fmt.Errorf("-tls_cert and -tls_key must be given together")
+	}
+	s.TLSConfig = &tls.Config{}
+	if err := setTLSVersions(s.TLSConfig); err != nil {
+		return err
+	}
+	if *tlsCA != "" {
+		b, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %q", *tlsCA)
+		}
+		s.TLSConfig.ClientCAs = pool
+		s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// net/http adds http/1.1 itself. Not adding HTTP/2, which can't carry
+	// the websocket upgrade, turns it off.
+	s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	for _, p := range strings.Split(*tlsALPN, ",") {
+		if p = strings.TrimSpace(p); p != "" && p != "http/1.1" {
+			s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, p)
+			s.TLSNextProto[p] = serveALPN
+		}
+	}
+	return setupJA3(s)
+}
+
+// serveALPN serves HTTP/1.1 on a connection that negotiated one of the
+// -tls_alpn protocols. net/http closes connections with protocols it has
+// no TLSNextProto handler for.
+func serveALPN(hs *http.Server, c *tls.Conn, h http.Handler) {
+	s := &http.Server{
+		Handler:           h,
+		ReadTimeout:       hs.ReadTimeout,
+		ReadHeaderTimeout: hs.ReadHeaderTimeout,
+		WriteTimeout:      hs.WriteTimeout,
+		MaxHeaderBytes:    hs.MaxHeaderBytes,
+		ErrorLog:          hs.ErrorLog,
+		ConnState:         hs.ConnState,
+	}
+	// Hidden from net/http as a *tls.Conn so that it doesn't look at the
+	// ALPN protocol again. h fills in r.TLS.
+	pc := &plainConn{Conn: c, closed: make(chan struct{})}
+	s.Serve(&oneConnListener{c: pc})
+	// hs closes c when we return, so wait until the request, or the
+	// tunnel it was upgraded to, is done with it.
+	<-pc.closed
+}
+
+// plainConn is a net.Conn that signals when it's closed.
+type plainConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *plainConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// oneConnListener returns a single connection from Accept.
+type oneConnListener struct {
+	c    net.Conn
+	done bool
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.done {
+		return nil, io.EOF
+	}
+	l.done = true
+	return l.c, nil
+}
+
+func (l *oneConnListener) Close() error   { return nil }
+func (l *oneConnListener) Addr() net.Addr { return l.c.LocalAddr() }
+
+// negotiatedALPN returns the ALPN protocol agreed on for r, if any.
+func negotiatedALPN(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return r.TLS.NegotiatedProtocol
+}
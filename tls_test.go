@@ -0,0 +1,127 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"TLS1.3", tls.VersionTLS13, false},
+		{"tls1.0", tls.VersionTLS10, false},
+		{"1.4", 0, true},
+		{"ssl3", 0, true},
+	} {
+		got, err := parseTLSVersion("tls_min_version", test.in)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseTLSVersion(%q) = %x, %v; want %x, error %v", test.in, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    []uint16
+		wantErr string
+	}{
+		{"", nil, ""},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, ""},
+		{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256", []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}, ""},
+		{"TLS_AES_128_GCM_SHA256", nil, "TLS 1.3's"},
+		{"TLS_RSA_WITH_RC4_128_SHA", nil, "insecure"},
+		{"TLS_MADE_UP", nil, "unknown cipher suite"},
+	} {
+		got, err := parseCipherSuites(test.in)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseCipherSuites(%q) = %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCipherSuites(%q) = %v, %v; want %v", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestSetTLSVersions(t *testing.T) {
+	defer func(min, max, ciphers string) { *tlsMinVersion, *tlsMaxVersion, *tlsCiphers = min, max, ciphers }(*tlsMinVersion, *tlsMaxVersion, *tlsCiphers)
+	for _, test := range []struct {
+		min, max, ciphers string
+		wantErr           bool
+	}{
+		{"", "", "", false},
+		{"1.2", "1.3", "", false},
+		{"1.3", "", "", false},
+		{"1.2", "", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", false},
+		{"1.3", "1.2", "", true},
+		{"1.3", "", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", true},
+		{"1.5", "", "", true},
+		{"", "2", "", true},
+		{"", "", "TLS_MADE_UP", true},
+	} {
+		*tlsMinVersion, *tlsMaxVersion, *tlsCiphers = test.min, test.max, test.ciphers
+		if err := setTLSVersions(&tls.Config{}); (err != nil) != test.wantErr {
+			t.Errorf("setTLSVersions(%q, %q, %q): %v, want error %v", test.min, test.max, test.ciphers, err, test.wantErr)
+		}
+	}
+}
+
+// TestTLSMinVersion checks clients below -tls_min_version are turned
+// away in the handshake.
+func TestTLSMinVersion(t *testing.T) {
+	defer func(min, max string) { *tlsMinVersion, *tlsMaxVersion = min, max }(*tlsMinVersion, *tlsMaxVersion)
+	for _, test := range []struct {
+		min, max      string
+		clientMax     uint16
+		wantHandshake bool
+	}{
+		{"1.2", "", tls.VersionTLS11, false},
+		{"1.2", "", tls.VersionTLS12, true},
+		{"1.2", "", tls.VersionTLS13, true},
+		{"1.3", "", tls.VersionTLS12, false},
+		{"1.2", "1.2", tls.VersionTLS13, true},
+	} {
+		*tlsMinVersion, *tlsMaxVersion = test.min, test.max
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		srv.TLS = &tls.Config{}
+		if err := setTLSVersions(srv.TLS); err != nil {
+			t.Fatal(err)
+		}
+		srv.StartTLS()
+		config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		config.MinVersion, config.MaxVersion = tls.VersionTLS10, test.clientMax
+		c, err := tls.Dial("tcp", srv.Listener.Addr().String(), config)
+		if (err == nil) != test.wantHandshake {
+			t.Errorf("min %s max %q, client up to %x: %v, want handshake %v", test.min, test.max, test.clientMax, err, test.wantHandshake)
+		}
+		if c != nil {
+			c.Close()
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+func init() {
+	flag.Var(&vhostFlags, "vhost", "Serve tunnels only for this Host, as name=[policy file][,require_identity], with its own -policy and, with require_identity, refusing clients without an identity. May be repeated; other Hosts get 404. Without a policy file, -policy applies.")
+}
+
+var (
+	vhostFlags listFlag
+
+	// Configured vhosts by lowercase name, nil without -vhost.
+	vhosts map[string]*vhost
+)
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, " ") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// vhost is the configuration of one -vhost.
+type vhost struct {
+	name            string
+	policyFile      string
+	requireIdentity bool
+
+	// Current *policy, from policyFile.
+	policy atomic.Value
+}
+
+// parseVhost parses a -vhost flag.
+func parseVhost(s string) (*vhost, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("want name=[policy file][,require_identity], got %q", s)
+	}
+	vh := &vhost{name: strings.ToLower(s[:i])}
+	opts := strings.Split(s[i+1:], ",")
+	vh.policyFile = opts[0]
+	for _, o := range opts[1:] {
+		switch o {
+		case "require_identity":
+			vh.requireIdentity = true
+		default:
+			return nil, fmt.Errorf("vhost %q: unknown option %q", vh.name, o)
+		}
+	}
+	return vh, nil
+}
+
+// load (re)reads the vhost's policy file, if it has one.
+func (vh *vhost) load() error {
+	if vh.policyFile == "" {
+		return nil
+	}
+	p, err := loadPolicy(vh.policyFile)
+	if err != nil {
+		return err
+	}
+	if *requireACL && len(p.rules) == 0 {
+		return fmt.Errorf("-require_acl is set but the policy %q of vhost %q has no rules", vh.policyFile, vh.name)
+	}
+	vh.policy.Store(p)
+	return nil
+}
+
+// currentPolicy returns the policy in force for the vhost.
+func (vh *vhost) currentPolicy() *policy {
+	if vh == nil || vh.policyFile == "" {
+		return currentPolicy()
+	}
+	return vh.policy.Load().(*policy)
+}
+
+// setupVhosts parses and loads the -vhost flags.
+func setupVhosts() error {
+	if len(vhostFlags) == 0 {
+		return nil
+	}
+	vhosts = make(map[string]*vhost)
+	for _, s := range vhostFlags {
+		vh, err := parseVhost(s)
+		if err != nil {
+			return err
+		}
+		if vhosts[vh.name] != nil {
+			return fmt.Errorf("vhost %q given twice", vh.name)
+		}
+		if err := vh.load(); err != nil {
+			return fmt.Errorf("vhost %q: %v", vh.name, err)
+		}
+		vhosts[vh.name] = vh
+		if vh.policyFile != "" {
+			onReload("policy of vhost "+vh.name, func() error {
+				if err := vh.load(); err != nil {
+					return err
+				}
+				enforcePolicy()
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// requestVhost returns the vhost selected by the request's Host, nil
+// without -vhost, and false for an unknown one.
+func requestVhost(r *http.Request) (*vhost, bool) {
+	if vhosts == nil {
+		return nil, true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	vh, ok := vhosts[strings.ToLower(host)]
+	return vh, ok
+}
@@ -0,0 +1,182 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestParseVhost(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    vhost
+		wantErr bool
+	}{
+		{"a.example.com=", vhost{name: "a.example.com"}, false},
+		{"A.Example.COM=/etc/a.policy", vhost{name: "a.example.com", policyFile: "/etc/a.policy"}, false},
+		{"b=,require_identity", vhost{name: "b", requireIdentity: true}, false},
+		{"b=/etc/b.policy,require_identity", vhost{name: "b", policyFile: "/etc/b.policy", requireIdentity: true}, false},
+		{"b", vhost{}, true},
+		{"=/etc/b.policy", vhost{}, true},
+		{"b=/etc/b.policy,require_cert", vhost{}, true},
+	} {
+		vh, err := parseVhost(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseVhost(%q): %v, want error %v", test.in, err, test.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if vh.name != test.want.name || vh.policyFile != test.want.policyFile || vh.requireIdentity != test.want.requireIdentity {
+			t.Errorf("parseVhost(%q) = %q %q %v, want %q %q %v", test.in, vh.name, vh.policyFile, vh.requireIdentity, test.want.name, test.want.policyFile, test.want.requireIdentity)
+		}
+	}
+}
+
+func TestSetupVhosts(t *testing.T) {
+	defer func(f listFlag, v map[string]*vhost) { vhostFlags, vhosts = f, v }(vhostFlags, vhosts)
+	good := writeTemp(t, "good", "* a:22\n")
+	bad := writeTemp(t, "bad", "alice\n")
+	for _, test := range []struct {
+		flags   listFlag
+		want    int
+		wantErr string
+	}{
+		{nil, 0, ""},
+		{listFlag{"a=" + good, "b="}, 2, ""},
+		{listFlag{"a=", "A="}, 0, "given twice"},
+		{listFlag{"a=" + bad}, 0, "no destinations"},
+		{listFlag{"a=" + good + ".missing"}, 0, "no such file"},
+		{listFlag{"a"}, 0, "want name="},
+	} {
+		vhostFlags, vhosts = test.flags, nil
+		err := setupVhosts()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("setupVhosts(%q) = %v, want error containing %q", test.flags, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("setupVhosts(%q): %v", test.flags, err)
+		}
+		if len(vhosts) != test.want {
+			t.Errorf("setupVhosts(%q) made %d vhosts, want %d", test.flags, len(vhosts), test.want)
+		}
+	}
+}
+
+func TestRequestVhost(t *testing.T) {
+	defer func(v map[string]*vhost) { vhosts = v }(vhosts)
+	a := &vhost{name: "a.example.com"}
+	for _, test := range []struct {
+		vhosts map[string]*vhost
+		host   string
+		want   *vhost
+		wantOK bool
+	}{
+		{nil, "anything", nil, true},
+		{map[string]*vhost{a.name: a}, "a.example.com", a, true},
+		{map[string]*vhost{a.name: a}, "A.Example.Com:8443", a, true},
+		{map[string]*vhost{a.name: a}, "b.example.com", nil, false},
+		{map[string]*vhost{a.name: a}, "a.example.com.evil", nil, false},
+	} {
+		vhosts = test.vhosts
+		r := httptest.NewRequest("GET", "/proxy/h/22", nil)
+		r.Host = test.host
+		if vh, ok := requestVhost(r); vh != test.want || ok != test.wantOK {
+			t.Errorf("requestVhost(%q) = %v, %v; want %v, %v", test.host, vh, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+// TestHandleProxyVhosts opens tunnels to two backends through two vhosts,
+// each with its own policy, one requiring an identity.
+func TestHandleProxyVhosts(t *testing.T) {
+	defer func(f listFlag, v map[string]*vhost) { vhostFlags, vhosts = f, v }(vhostFlags, vhosts)
+	defer func(v bool) { *trustBasicAuth = v }(*trustBasicAuth)
+	*trustBasicAuth = true
+
+	var ports []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		ports = append(ports, port)
+	}
+	vhostFlags = listFlag{
+		"a.example.com=" + writeTemp(t, "a", fmt.Sprintf("* 127.0.0.1:%s\n", ports[0])),
+		"b.example.com=" + writeTemp(t, "b", fmt.Sprintf("* 127.0.0.1:%s\n", ports[1])) + ",require_identity",
+	}
+	vhosts = nil
+	if err := setupVhosts(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/proxy/{host}/{port}", handleProxy)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		host string
+		user string
+		port string
+		want int
+	}{
+		{"a.example.com", "", ports[0], http.StatusSwitchingProtocols},
+		{"a.example.com", "", ports[1], http.StatusForbidden},
+		{"b.example.com", "alice", ports[1], http.StatusSwitchingProtocols},
+		{"b.example.com", "alice", ports[0], http.StatusForbidden},
+		{"b.example.com", "", ports[1], http.StatusUnauthorized},
+		{"c.example.com", "", ports[0], http.StatusNotFound},
+	} {
+		h := http.Header{"Host": {test.host}}
+		if test.user != "" {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(test.user, "checked in front")
+			h.Set("Authorization", r.Header.Get("Authorization"))
+		}
+		c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/proxy/127.0.0.1/"+test.port, h)
+		if resp == nil {
+			t.Fatalf("%s as %q to %s: %v", test.host, test.user, test.port, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("%s as %q to %s: status %d, want %d", test.host, test.user, test.port, resp.StatusCode, test.want)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	webhookURL     = flag.String("webhook_url", "", "URL to POST a JSON event to when tunnels open and close. Empty disables.")
+	webhookEvents  = flag.String("webhook_events", "open,close", "Comma separated events to send to -webhook_url: open, close.")
+	webhookTimeout = flag.Duration("webhook_timeout", 5*time.Second, "Timeout for each -webhook_url request.")
+	webhookRetries = flag.Int("webhook_retries", 3, "How many times to retry a failed -webhook_url request, with backoff.")
+	webhookQueue   = flag.Int("webhook_queue", 1000, "Max events waiting to be sent to -webhook_url. Events beyond that are dropped.")
+	webhookWorkers = flag.Int("webhook_workers", 4, "Number of concurrent -webhook_url requests.")
+
+	metricWebhooks = expvar.NewMap("webhooks")
+
+	webhookCh      chan *tunnelEvent
+	webhookEnabled = map[string]bool{}
+)
+
+// tunnelEvent is the JSON body POSTed to -webhook_url.
+type tunnelEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Identity string    `json:"identity,omitempty"`
+	ClientID string    `json:"client_id,omitempty"`
+	ConnID   string    `json:"connection_id,omitempty"`
+	Dest     string    `json:"dest"`
+
+	// Only set for "close".
+	BytesIn    int64   `json:"bytes_in,omitempty"`
+	BytesOut   int64   `json:"bytes_out,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// setupWebhooks validates the webhook flags and starts the workers.
+func setupWebhooks() error {
+	if *webhookURL == "" {
+		return nil
+	}
+	for _, e := range strings.Split(*webhookEvents, ",") {
+		switch e = strings.TrimSpace(e); e {
+		case "open", "close":
+			webhookEnabled[e] = true
+		case "":
+		default:
+			return fmt.Errorf("unknown -webhook_events event %q", e)
+		}
+	}
+	if *webhookWorkers < 1 {
+		return fmt.Errorf("-webhook_workers must be at least 1")
+	}
+	webhookCh = make(chan *tunnelEvent, *webhookQueue)
+	client := &http.Client{Timeout: *webhookTimeout}
+	for i := 0; i < *webhookWorkers; i++ {
+		go webhookWorker(client)
+	}
+	return nil
+}
+
+// sendEvent queues ev for -webhook_url without ever blocking the caller.
+// If the queue is full the event is dropped.
+func sendEvent(ev *tunnelEvent) {
+	if webhookCh == nil || !webhookEnabled[ev.Event] {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case webhookCh <- ev:
+	default:
+		metricWebhooks.Add("dropped", 1)
+	}
+}
+
+func webhookWorker(client *http.Client) {
+	for ev := range webhookCh {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			log.Errorf("Encoding webhook event: %v", err)
+			continue
+		}
+		backoff := time.Second
+		for try := 0; ; try++ {
+			err = postWebhook(client, b)
+			if err == nil {
+				metricWebhooks.Add("sent", 1)
+				break
+			}
+			if try >= *webhookRetries {
+				log.Warningf("Webhook for %s of tunnel to %s failed, giving up: %v", ev.Event, ev.Dest, err)
+				metricWebhooks.Add("failed", 1)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postWebhook(client *http.Client, body []byte) error {
+	resp, err := client.Post(*webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}